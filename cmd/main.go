@@ -2,37 +2,69 @@ package main
 
 import (
 	"context"
-	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"authorization_flow_keycloak/internal/auth"
 	"authorization_flow_keycloak/internal/config"
+	"authorization_flow_keycloak/internal/logging"
 	"authorization_flow_keycloak/internal/server"
+	"authorization_flow_keycloak/internal/tracing"
 
 	"github.com/redis/go-redis/v9"
 )
 
+// tracingShutdownTimeout bounds the export of the spans still buffered
+// when the server stops
+const tracingShutdownTimeout = 5 * time.Second
+
 func main() {
-	ctx := context.Background()
+	// Stop gracefully on SIGINT and SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	config, err := config.LoadFromEnv()
 	if err != nil {
-		log.Fatalf("failed to load env file config : %v", err)
-		return
+		logging.Fatal("failed to load env file config", "error", err)
+	}
+	if err := logging.Setup(config.Log.Level, config.Log.Format); err != nil {
+		logging.Fatal("failed to configure logging", "error", err)
+	}
+	tracer, err := tracing.Setup(ctx, config.Tracing)
+	if err != nil {
+		logging.Fatal("failed to configure tracing", "error", err)
 	}
 	// Use configuration values
-	log.Printf("Starting server on port %s", config.App.Port)
+	slog.Info("starting server", "port", config.App.Port)
 
-	authClient, err := auth.New(ctx, config.Auth)
-	if err != nil {
-		log.Fatalf("failed to initialize auth client : %v", err)
+	// One auth client per realm, built lazily. The default realm is built
+	// eagerly so a misconfigured Keycloak fails at startup.
+	authClients := auth.NewRegistry(config.Auth, config.Tenant.Realms)
+	if _, err := authClients.Client(ctx, config.Auth.Realm); err != nil {
+		logging.Fatal("failed to initialize auth client", "error", err)
 	}
 
 	// initialize redis client
 	rdb := redis.NewClient(config.RedisClient)
+	if err := tracing.InstrumentRedis(rdb); err != nil {
+		logging.Fatal("failed to instrument redis client", "error", err)
+	}
 
 	// Create and start server
-	srv := server.NewServer(ctx, config, authClient, rdb)
-	if err := srv.Start(); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	srv := server.NewServer(ctx, config, authClients, rdb)
+	err = srv.Start(ctx)
+	// Flush the buffered spans. ctx is already cancelled after SIGTERM, and
+	// Fatal exits without running defers.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancel()
+	if shutdownErr := tracer.Shutdown(shutdownCtx); shutdownErr != nil {
+		slog.Warn("failed to flush spans", "error", shutdownErr)
+	}
+	if err != nil {
+		logging.Fatal("server failed", "error", err)
 	}
+	slog.Info("server stopped")
 }
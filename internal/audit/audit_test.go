@@ -0,0 +1,78 @@
+package audit
+
+import (
+	"context"
+	"testing"
+)
+
+// eventSink keeps the written events
+type eventSink []Event
+
+func (s *eventSink) Write(_ context.Context, event Event) error {
+	*s = append(*s, event)
+	return nil
+}
+
+func TestRedaction(t *testing.T) {
+	event := Event{Type: TypeLogin, Username: "jane", Email: "jane@example.com", IP: "192.0.2.130"}
+	tests := []struct {
+		name      string
+		redaction Redaction
+		event     Event
+		want      Event
+	}{
+		{"nothing redacted", Redaction{}, event, event},
+		{
+			name:      "everything redacted",
+			redaction: Redaction{Email: true, IP: true, Username: true},
+			event:     event,
+			want:      Event{Type: TypeLogin, Email: "j***@example.com", IP: "192.0.2.0"},
+		},
+		{
+			name:      "IPv6 keeps the /48",
+			redaction: Redaction{IP: true},
+			event:     Event{IP: "2001:db8:1234:5678::1"},
+			want:      Event{IP: "2001:db8:1234::"},
+		},
+		{
+			name:      "IPv4 mapped IPv6",
+			redaction: Redaction{IP: true},
+			event:     Event{IP: "::ffff:192.0.2.130"},
+			want:      Event{IP: "192.0.2.0"},
+		},
+		{
+			name:      "unparsable IP dropped",
+			redaction: Redaction{IP: true},
+			event:     Event{IP: "unknown"},
+			want:      Event{},
+		},
+		{
+			name:      "email without local part",
+			redaction: Redaction{Email: true},
+			event:     Event{Email: "@example.com"},
+			want:      Event{Email: "***"},
+		},
+		{
+			name:      "not an email",
+			redaction: Redaction{Email: true},
+			event:     Event{Email: "jane"},
+			want:      Event{Email: "***"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &eventSink{}
+			NewLogger(tt.redaction, sink).Record(context.Background(), tt.event)
+			if len(*sink) != 1 {
+				t.Fatalf("%d events written, want 1", len(*sink))
+			}
+			got := (*sink)[0]
+			if got.Time.IsZero() {
+				t.Fatal("event time not set")
+			}
+			if got.Email != tt.want.Email || got.IP != tt.want.IP || got.Username != tt.want.Username || got.Type != tt.want.Type {
+				t.Fatalf("event = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker is a minimal circuit breaker guarding calls to Keycloak.
+// After maxFailures consecutive failures it opens for cooldown, then lets a
+// single trial call through (half-open) which closes it again on success.
+type breaker struct {
+	maxFailures int
+	cooldown    time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+func newBreaker(maxFailures int, cooldown time.Duration) *breaker {
+	return &breaker{maxFailures: maxFailures, cooldown: cooldown}
+}
+
+// allow reports whether a call may be attempted
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.maxFailures {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.trial {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// success closes the breaker
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.trial = false
+}
+
+// failure records a failed call, (re)opening the breaker past the threshold
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.trial = false
+	if b.failures >= b.maxFailures {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
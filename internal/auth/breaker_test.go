@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker(3, 50*time.Millisecond)
+	steps := []struct {
+		name      string
+		record    func()
+		wantAllow bool
+	}{
+		{"closed", nil, true},
+		{"one failure", b.failure, true},
+		{"two failures", b.failure, true},
+		{"success resets", b.success, true},
+		{"first failure again", b.failure, true},
+		{"second failure", b.failure, true},
+		{"opened", b.failure, false},
+	}
+	for _, step := range steps {
+		if step.record != nil {
+			step.record()
+		}
+		if got := b.allow(); got != step.wantAllow {
+			t.Fatalf("%s: allow() = %v, want %v", step.name, got, step.wantAllow)
+		}
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("half-open breaker refused the trial call")
+	}
+	if b.allow() {
+		t.Fatal("half-open breaker allowed a second call during the trial")
+	}
+	// A failed trial opens it again for the cooldown
+	b.failure()
+	if b.allow() {
+		t.Fatal("breaker allowed a call after the failed trial")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("breaker refused the next trial")
+	}
+	b.success()
+	if !b.allow() || !b.allow() {
+		t.Fatal("breaker not closed after a successful trial")
+	}
+}
@@ -0,0 +1,282 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"authorization_flow_keycloak/internal/metrics"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// Client authentication methods supported at the token endpoint
+const (
+	ClientAuthSecret        = "client_secret"   // shared ClientSecret (default)
+	ClientAuthPrivateKeyJWT = "private_key_jwt" // signed client assertion (RFC 7523)
+	ClientAuthTLS           = "tls_client_auth" // mutual TLS client certificate (RFC 8705)
+)
+
+const (
+	clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	clientAssertionTTL  = time.Minute
+)
+
+// KeySet holds the private keys used to sign client assertions.
+// The first file is the active signing key, the following ones are only
+// published so Keycloak already knows them when they become active.
+// Files are reloaded when they change on disk, which allows rotating a key
+// in place without restarting the server.
+type KeySet struct {
+	files []string
+
+	mu      sync.Mutex
+	modTime []time.Time
+	keys    []jose.JSONWebKey
+}
+
+// NewKeySet loads the PEM or JWK encoded private keys from files
+func NewKeySet(files []string) (*KeySet, error) {
+	if len(files) == 0 {
+		return nil, errors.New("at least one client key file is required")
+	}
+	ks := &KeySet{
+		files:   files,
+		modTime: make([]time.Time, len(files)),
+		keys:    make([]jose.JSONWebKey, len(files)),
+	}
+	if err := ks.reload(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// reload re-reads every key file whose modification time changed
+func (ks *KeySet) reload() error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	for i, file := range ks.files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("failed to stat client key %s: %w", file, err)
+		}
+		if info.ModTime().Equal(ks.modTime[i]) {
+			continue
+		}
+		key, err := loadPrivateKey(file)
+		if err != nil {
+			return err
+		}
+		ks.keys[i] = key
+		ks.modTime[i] = info.ModTime()
+	}
+	return nil
+}
+
+// signingKey returns the active key, picking up rotated files first
+func (ks *KeySet) signingKey() (jose.JSONWebKey, error) {
+	if err := ks.reload(); err != nil {
+		return jose.JSONWebKey{}, err
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.keys[0], nil
+}
+
+// PublicJWKS returns the public part of every key, to be served as the
+// client's JWKS URL configured in Keycloak
+func (ks *KeySet) PublicJWKS() (jose.JSONWebKeySet, error) {
+	if err := ks.reload(); err != nil {
+		return jose.JSONWebKeySet{}, err
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	set := jose.JSONWebKeySet{}
+	for _, key := range ks.keys {
+		set.Keys = append(set.Keys, key.Public())
+	}
+	return set, nil
+}
+
+// loadPrivateKey reads a JWK or PEM (PKCS#1, PKCS#8 or SEC 1) private key.
+// PEM keys have no key id so the RFC 7638 thumbprint is used instead.
+func loadPrivateKey(file string) (jose.JSONWebKey, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return jose.JSONWebKey{}, fmt.Errorf("failed to read client key %s: %w", file, err)
+	}
+
+	var key jose.JSONWebKey
+	if strings.HasPrefix(strings.TrimSpace(string(raw)), "{") {
+		if err := json.Unmarshal(raw, &key); err != nil {
+			return jose.JSONWebKey{}, fmt.Errorf("failed to parse JWK %s: %w", file, err)
+		}
+	} else {
+		block, _ := pem.Decode(raw)
+		if block == nil {
+			return jose.JSONWebKey{}, fmt.Errorf("no PEM block in %s", file)
+		}
+		private, err := parsePEMPrivateKey(block.Bytes)
+		if err != nil {
+			return jose.JSONWebKey{}, fmt.Errorf("failed to parse PEM %s: %w", file, err)
+		}
+		key = jose.JSONWebKey{Key: private}
+	}
+	if key.IsPublic() {
+		return jose.JSONWebKey{}, fmt.Errorf("client key %s is not a private key", file)
+	}
+
+	if key.Algorithm == "" {
+		alg, err := signatureAlgorithm(key.Key)
+		if err != nil {
+			return jose.JSONWebKey{}, fmt.Errorf("client key %s: %w", file, err)
+		}
+		key.Algorithm = string(alg)
+	}
+	if key.KeyID == "" {
+		thumbprint, err := key.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return jose.JSONWebKey{}, fmt.Errorf("failed to compute key id of %s: %w", file, err)
+		}
+		key.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+	}
+	key.Use = "sig"
+	return key, nil
+}
+
+func parsePEMPrivateKey(der []byte) (interface{}, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	return x509.ParseECPrivateKey(der)
+}
+
+// signatureAlgorithm picks the JWS algorithm matching the key type
+func signatureAlgorithm(key interface{}) (jose.SignatureAlgorithm, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return jose.RS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jose.ES256, nil
+		case elliptic.P384():
+			return jose.ES384, nil
+		case elliptic.P521():
+			return jose.ES512, nil
+		}
+	}
+	return "", errors.New("unsupported key type")
+}
+
+// clientAssertion signs a short lived JWT identifying the client (RFC 7523).
+// Keycloak accepts the realm issuer as audience for every endpoint.
+func (c *Client) clientAssertion() (string, error) {
+	key, err := c.keys.signingKey()
+	if err != nil {
+		return "", err
+	}
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.SignatureAlgorithm(key.Algorithm), Key: key},
+		(&jose.SignerOptions{}).WithType("JWT"),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to create assertion signer: %w", err)
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := jwt.Claims{
+		Issuer:   c.Oauth.ClientID,
+		Subject:  c.Oauth.ClientID,
+		Audience: jwt.Audience{c.issuer},
+		ID:       base64.RawURLEncoding.EncodeToString(jti),
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(clientAssertionTTL)),
+	}
+	return jwt.Signed(signer).Claims(claims).Serialize()
+}
+
+// authenticateClient adds the client credentials for the configured
+// authentication method to a back channel request
+func (c *Client) authenticateClient(params url.Values) error {
+	params.Set("client_id", c.Oauth.ClientID)
+	switch c.authMethod {
+	case ClientAuthPrivateKeyJWT:
+		assertion, err := c.clientAssertion()
+		if err != nil {
+			return fmt.Errorf("failed to sign client assertion: %w", err)
+		}
+		params.Set("client_assertion_type", clientAssertionType)
+		params.Set("client_assertion", assertion)
+	case ClientAuthTLS:
+		// The client certificate presented by httpClient authenticates us
+	default:
+		params.Set("client_secret", c.Oauth.ClientSecret)
+	}
+	return nil
+}
+
+// backChannelTimeout bounds every call to Keycloak so a hung request cannot
+// hold the request that made it
+const backChannelTimeout = 30 * time.Second
+
+// newHTTPClient returns the client used for back channel calls, presenting
+// the client certificate when tls_client_auth is configured. Its latency is
+// recorded in the OpenID provider metrics and its requests are traced.
+func newHTTPClient(config *Config) (*http.Client, error) {
+	if config.ClientAuthMethod != ClientAuthTLS {
+		return &http.Client{Transport: instrumentTransport(nil), Timeout: backChannelTimeout}, nil
+	}
+	cert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientCertKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client certificate: %w", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	return &http.Client{Transport: instrumentTransport(transport), Timeout: backChannelTimeout}, nil
+}
+
+// instrumentTransport adds the provider metrics and a span per request to
+// base, passing the trace context on to Keycloak
+func instrumentTransport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(metrics.Transport(base), otelhttp.WithSpanNameFormatter(
+		func(_ string, r *http.Request) string {
+			return "keycloak " + metrics.OIDCEndpoint(r.URL.Path)
+		},
+	))
+}
+
+// PublicJWKS returns the public client assertion keys of the realm
+func (c *Client) PublicJWKS() (jose.JSONWebKeySet, error) {
+	if c.keys == nil {
+		return jose.JSONWebKeySet{}, errors.New("client does not use private_key_jwt")
+	}
+	return c.keys.PublicJWKS()
+}
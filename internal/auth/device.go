@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+const grantTypeDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+
+// Device flow errors of the token endpoint (RFC 8628 section 3.5)
+const (
+	DeviceAuthorizationPending = "authorization_pending"
+	DeviceSlowDown             = "slow_down"
+	DeviceAccessDenied         = "access_denied"
+	DeviceExpiredToken         = "expired_token"
+)
+
+// DeviceAuthorization is the device authorization response (RFC 8628 section 3.2)
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// SupportsDeviceFlow reports whether the realm advertises a device authorization endpoint
+func (c *Client) SupportsDeviceFlow() bool {
+	return c.deviceEndpoint != ""
+}
+
+// DeviceAuthorization starts a device flow for clients that cannot receive a
+// browser redirect (CLI tools, TVs). The user enters UserCode at VerificationURI
+// while the device polls PollDeviceToken with DeviceCode.
+func (c *Client) DeviceAuthorization(ctx context.Context, scopes ...string) (*DeviceAuthorization, error) {
+	if !c.SupportsDeviceFlow() {
+		return nil, errors.New("realm does not support the device authorization grant")
+	}
+	params := url.Values{"scope": {strings.Join(scopes, " ")}}
+	if err := c.authenticateClient(params); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.deviceEndpoint,
+		strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build device authorization request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call device authorization endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var oauthErr oauthError
+		_ = json.NewDecoder(resp.Body).Decode(&oauthErr)
+		return nil, fmt.Errorf("device authorization endpoint returned %d: %s %s",
+			resp.StatusCode, oauthErr.Error, oauthErr.Description)
+	}
+
+	var authorization DeviceAuthorization
+	if err := json.NewDecoder(resp.Body).Decode(&authorization); err != nil {
+		return nil, fmt.Errorf("failed to decode device authorization: %w", err)
+	}
+	// RFC 8628: clients must wait 5 seconds between polls when no interval is given
+	if authorization.Interval == 0 {
+		authorization.Interval = 5
+	}
+	return &authorization, nil
+}
+
+// PollDeviceToken asks the token endpoint once whether the user approved the
+// device. Pending, slow_down, denied and expired states are returned as
+// *TokenError with the matching Device* code; polling is left to the caller.
+func (c *Client) PollDeviceToken(ctx context.Context, deviceCode string, dpopKey *DPoPKey) (*oauth2.Token, error) {
+	return c.tokenRequest(ctx, url.Values{
+		"grant_type":  {grantTypeDeviceCode},
+		"device_code": {deviceCode},
+	}, dpopKey)
+}
@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+const dpopProofType = "dpop+jwt"
+
+// DPoPProofWindow is how far a proof's iat may be from the server clock
+const DPoPProofWindow = time.Minute
+
+// dpopAlgorithms are the asymmetric algorithms accepted for incoming proofs
+var dpopAlgorithms = []jose.SignatureAlgorithm{
+	jose.ES256, jose.ES384, jose.ES512, jose.RS256, jose.PS256, jose.EdDSA,
+}
+
+// DPoPEnabled reports whether tokens of this realm are bound with DPoP
+func (c *Client) DPoPEnabled() bool {
+	return c.dpop
+}
+
+// DPoPKey is the per-session key pair binding tokens to this server (RFC 9449)
+type DPoPKey struct {
+	jwk jose.JSONWebKey
+}
+
+// NewDPoPKey generates a fresh P-256 key pair identified by its thumbprint
+func NewDPoPKey() (*DPoPKey, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate DPoP key: %w", err)
+	}
+	jwk := jose.JSONWebKey{Key: private, Algorithm: string(jose.ES256), Use: "sig"}
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute DPoP key thumbprint: %w", err)
+	}
+	jwk.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+	return &DPoPKey{jwk: jwk}, nil
+}
+
+// ParseDPoPKey restores a key previously serialized with MarshalJSON
+func ParseDPoPKey(raw []byte) (*DPoPKey, error) {
+	var jwk jose.JSONWebKey
+	if err := json.Unmarshal(raw, &jwk); err != nil {
+		return nil, fmt.Errorf("failed to parse DPoP key: %w", err)
+	}
+	if jwk.IsPublic() {
+		return nil, errors.New("DPoP key is not a private key")
+	}
+	return &DPoPKey{jwk: jwk}, nil
+}
+
+// ID returns the JWK thumbprint, the value Keycloak puts in cnf.jkt
+func (k *DPoPKey) ID() string {
+	return k.jwk.KeyID
+}
+
+// MarshalJSON serializes the private key as a JWK for persistence
+func (k *DPoPKey) MarshalJSON() ([]byte, error) {
+	return json.Marshal(k.jwk)
+}
+
+// dpopClaims are the claims of a DPoP proof JWT
+type dpopClaims struct {
+	ID       string           `json:"jti"`
+	Method   string           `json:"htm"`
+	URL      string           `json:"htu"`
+	IssuedAt *jwt.NumericDate `json:"iat"`
+	ATH      string           `json:"ath,omitempty"`
+}
+
+// Proof signs a DPoP proof for a request. accessToken is only set when the
+// proof accompanies a protected resource request and is hashed into ath.
+func (k *DPoPKey) Proof(method, url, accessToken string) (string, error) {
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.SignatureAlgorithm(k.jwk.Algorithm), Key: k.jwk.Key},
+		(&jose.SignerOptions{EmbedJWK: true}).WithType(dpopProofType),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to create DPoP signer: %w", err)
+	}
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	claims := dpopClaims{
+		ID:       base64.RawURLEncoding.EncodeToString(jti),
+		Method:   method,
+		URL:      url,
+		IssuedAt: jwt.NewNumericDate(time.Now()),
+	}
+	if accessToken != "" {
+		claims.ATH = accessTokenHash(accessToken)
+	}
+	return jwt.Signed(signer).Claims(claims).Serialize()
+}
+
+// DPoPProof is a validated incoming proof
+type DPoPProof struct {
+	ID         string    // jti, must be checked against a replay cache
+	Thumbprint string    // thumbprint of the key that signed the proof
+	IssuedAt   time.Time // iat
+}
+
+// VerifyDPoPProof validates a proof sent with a protected resource request:
+// signature by the embedded public key, typ, htm, htu, iat window and ath.
+// Binding to the token (cnf.jkt == Thumbprint) and jti replay are left to the caller.
+func VerifyDPoPProof(proof, method, url, accessToken string) (*DPoPProof, error) {
+	token, err := jwt.ParseSigned(proof, dpopAlgorithms)
+	if err != nil {
+		return nil, fmt.Errorf("malformed DPoP proof: %w", err)
+	}
+	header := token.Headers[0]
+	if typ, _ := header.ExtraHeaders[jose.HeaderType].(string); typ != dpopProofType {
+		return nil, errors.New("DPoP proof has wrong typ")
+	}
+	if header.JSONWebKey == nil || !header.JSONWebKey.IsPublic() {
+		return nil, errors.New("DPoP proof has no public jwk")
+	}
+
+	var claims dpopClaims
+	if err := token.Claims(header.JSONWebKey, &claims); err != nil {
+		return nil, fmt.Errorf("invalid DPoP proof signature: %w", err)
+	}
+	if claims.ID == "" || claims.IssuedAt == nil {
+		return nil, errors.New("DPoP proof misses jti or iat")
+	}
+	if claims.Method != method || claims.URL != url {
+		return nil, errors.New("DPoP proof htm/htu do not match the request")
+	}
+	issuedAt := claims.IssuedAt.Time()
+	if skew := time.Since(issuedAt); skew > DPoPProofWindow || skew < -DPoPProofWindow {
+		return nil, errors.New("DPoP proof iat outside the accepted window")
+	}
+	if claims.ATH != accessTokenHash(accessToken) {
+		return nil, errors.New("DPoP proof ath does not match the access token")
+	}
+
+	thumbprint, err := header.JSONWebKey.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute DPoP key thumbprint: %w", err)
+	}
+	return &DPoPProof{
+		ID:         claims.ID,
+		Thumbprint: base64.RawURLEncoding.EncodeToString(thumbprint),
+		IssuedAt:   issuedAt,
+	}, nil
+}
+
+// accessTokenHash is the ath claim: base64url(SHA-256(access token))
+func accessTokenHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// signProof signs a proof with arbitrary claims and type
+func signProof(t *testing.T, key *DPoPKey, typ string, claims dpopClaims) string {
+	t.Helper()
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.ES256, Key: key.jwk.Key},
+		(&jose.SignerOptions{EmbedJWK: true}).WithType(jose.ContentType(typ)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := jwt.Signed(signer).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proof
+}
+
+func TestVerifyDPoPProof(t *testing.T) {
+	const (
+		method      = "POST"
+		htu         = "https://app.example.com/api/reports"
+		accessToken = "access-token"
+	)
+	key, err := NewDPoPKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := func() dpopClaims {
+		return dpopClaims{
+			ID:       "jti-1",
+			Method:   method,
+			URL:      htu,
+			IssuedAt: jwt.NewNumericDate(time.Now()),
+			ATH:      accessTokenHash(accessToken),
+		}
+	}
+	tests := []struct {
+		name    string
+		typ     string
+		claims  func(dpopClaims) dpopClaims
+		wantErr string
+	}{
+		{name: "valid", claims: func(c dpopClaims) dpopClaims { return c }},
+		{name: "other method", claims: func(c dpopClaims) dpopClaims { c.Method = "GET"; return c }, wantErr: "htm/htu"},
+		{name: "other host", claims: func(c dpopClaims) dpopClaims { c.URL = "https://evil.example.com/api/reports"; return c }, wantErr: "htm/htu"},
+		{name: "other path", claims: func(c dpopClaims) dpopClaims { c.URL = "https://app.example.com/api/users"; return c }, wantErr: "htm/htu"},
+		{name: "issued in the past", claims: func(c dpopClaims) dpopClaims {
+			c.IssuedAt = jwt.NewNumericDate(time.Now().Add(-2 * DPoPProofWindow))
+			return c
+		}, wantErr: "iat"},
+		{name: "issued in the future", claims: func(c dpopClaims) dpopClaims {
+			c.IssuedAt = jwt.NewNumericDate(time.Now().Add(2 * DPoPProofWindow))
+			return c
+		}, wantErr: "iat"},
+		{name: "other access token", claims: func(c dpopClaims) dpopClaims { c.ATH = accessTokenHash("other-token"); return c }, wantErr: "ath"},
+		{name: "no access token hash", claims: func(c dpopClaims) dpopClaims { c.ATH = ""; return c }, wantErr: "ath"},
+		{name: "no jti", claims: func(c dpopClaims) dpopClaims { c.ID = ""; return c }, wantErr: "jti"},
+		{name: "wrong type", typ: "JWT", claims: func(c dpopClaims) dpopClaims { return c }, wantErr: "typ"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			typ := tt.typ
+			if typ == "" {
+				typ = dpopProofType
+			}
+			proof := signProof(t, key, typ, tt.claims(valid()))
+			verified, err := VerifyDPoPProof(proof, method, htu, accessToken)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to mention %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if verified.ID != "jti-1" || verified.Thumbprint != key.ID() {
+				t.Fatalf("proof = %+v, want jti-1 signed by %s", verified, key.ID())
+			}
+		})
+	}
+}
+
+func TestVerifyDPoPProofOwnProof(t *testing.T) {
+	key, err := NewDPoPKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := key.Proof("GET", "https://app.example.com/api/me", "access-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyDPoPProof(proof, "GET", "https://app.example.com/api/me", "access-token"); err != nil {
+		t.Fatal(err)
+	}
+	// A proof must embed the public key it is signed with
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signer, _ := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: other},
+		(&jose.SignerOptions{EmbedJWK: false}).WithType(dpopProofType))
+	unsigned, _ := jwt.Signed(signer).Claims(dpopClaims{ID: "jti", Method: "GET"}).Serialize()
+	if _, err := VerifyDPoPProof(unsigned, "GET", "https://app.example.com/api/me", ""); err == nil {
+		t.Fatal("proof without an embedded key accepted")
+	}
+}
@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
+)
+
+// Token exchange identifiers (RFC 8693)
+const (
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// exchangedTokens caches downstream tokens per subject token and audience.
+// Entries are keyed by the SHA-256 of the subject token and follow the
+// session's access token through refreshes with MoveDownstreamTokens, so
+// EvictDownstreamTokens finds every token exchanged during the session.
+type exchangedTokens struct {
+	mu      sync.Mutex
+	entries map[string]map[string]*oauth2.Token // subject token hash -> audience -> token
+	// exchanges runs one exchange per subject token and audience at a time
+	exchanges singleflight.Group
+}
+
+// ExchangeToken swaps an access token for one issued to a downstream
+// audience with Keycloak's token exchange (RFC 8693). The calling client must
+// be allowed to exchange tokens for the audience in Keycloak. A DPoP bound
+// subject token is sent with a proof of its key, dpopKey.
+func (c *Client) ExchangeToken(
+	ctx context.Context,
+	subjectToken, audience string,
+	dpopKey *DPoPKey,
+) (*oauth2.Token, error) {
+	return c.tokenRequest(ctx, url.Values{
+		"grant_type":           {grantTypeTokenExchange},
+		"subject_token":        {subjectToken},
+		"subject_token_type":   {tokenTypeAccessToken},
+		"requested_token_type": {tokenTypeAccessToken},
+		"audience":             {audience},
+	}, dpopKey)
+}
+
+// DownstreamToken returns a token for the audience on behalf of the user of
+// an access token, with dpopKey set when the access token is DPoP bound.
+// Tokens are cached per access token and audience until shortly before
+// expiry, and concurrent requests for the same token share one exchange.
+func (c *Client) DownstreamToken(
+	ctx context.Context,
+	accessToken, audience string,
+	dpopKey *DPoPKey,
+) (*oauth2.Token, error) {
+	subject := subjectTokenHash(accessToken)
+
+	c.exchanged.mu.Lock()
+	token, ok := c.exchanged.entries[subject][audience]
+	c.exchanged.mu.Unlock()
+	if ok && !expiresSoon(token) {
+		return token, nil
+	}
+
+	result, err, _ := c.exchanged.exchanges.Do(subject+"|"+audience, func() (interface{}, error) {
+		// Detached from the first caller so its cancellation does not fail
+		// the requests waiting on the same exchange
+		token, err := c.ExchangeToken(context.WithoutCancel(ctx), accessToken, audience, dpopKey)
+		if err != nil {
+			return nil, err
+		}
+		c.exchanged.mu.Lock()
+		defer c.exchanged.mu.Unlock()
+		// Drop expired entries of ended sessions so the cache does not grow forever
+		for key, tokens := range c.exchanged.entries {
+			for aud, cached := range tokens {
+				if expiresSoon(cached) {
+					delete(tokens, aud)
+				}
+			}
+			if len(tokens) == 0 {
+				delete(c.exchanged.entries, key)
+			}
+		}
+		if c.exchanged.entries[subject] == nil {
+			c.exchanged.entries[subject] = make(map[string]*oauth2.Token)
+		}
+		c.exchanged.entries[subject][audience] = token
+		return token, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*oauth2.Token), nil
+}
+
+// EvictDownstreamTokens removes the tokens exchanged for an access token from
+// the cache and returns them, so they can be revoked with the session
+func (c *Client) EvictDownstreamTokens(accessToken string) []*oauth2.Token {
+	subject := subjectTokenHash(accessToken)
+
+	c.exchanged.mu.Lock()
+	defer c.exchanged.mu.Unlock()
+	var evicted []*oauth2.Token
+	for _, token := range c.exchanged.entries[subject] {
+		evicted = append(evicted, token)
+	}
+	delete(c.exchanged.entries, subject)
+	return evicted
+}
+
+// MoveDownstreamTokens files the tokens exchanged for a session's previous
+// access token under the one that replaced it, so they are evicted and
+// revoked with the session instead of being left behind by a refresh. A
+// token already cached for the current access token and the same audience
+// is kept, the previous one is returned so it can be revoked.
+func (c *Client) MoveDownstreamTokens(previous, current string) []*oauth2.Token {
+	from, to := subjectTokenHash(previous), subjectTokenHash(current)
+	if from == to {
+		return nil
+	}
+
+	c.exchanged.mu.Lock()
+	defer c.exchanged.mu.Unlock()
+	tokens, ok := c.exchanged.entries[from]
+	if !ok {
+		return nil
+	}
+	delete(c.exchanged.entries, from)
+	if c.exchanged.entries[to] == nil {
+		c.exchanged.entries[to] = make(map[string]*oauth2.Token)
+	}
+	var displaced []*oauth2.Token
+	for audience, token := range tokens {
+		if _, ok := c.exchanged.entries[to][audience]; ok {
+			displaced = append(displaced, token)
+			continue
+		}
+		c.exchanged.entries[to][audience] = token
+	}
+	return displaced
+}
+
+func subjectTokenHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return hex.EncodeToString(sum[:])
+}
+
+func expiresSoon(token *oauth2.Token) bool {
+	return !token.Expiry.IsZero() && time.Until(token.Expiry) < serviceTokenEarlyExpiry
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDownstreamToken(t *testing.T) {
+	keycloak := newFakeKeycloak(t)
+	var exchanges atomic.Int32
+	var proofs atomic.Int32
+	keycloak.token = func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		if r.PostForm.Get("grant_type") != grantTypeTokenExchange || r.PostForm.Get("audience") != "billing" {
+			t.Errorf("unexpected token request %v", r.PostForm)
+		}
+		if r.Header.Get("DPoP") != "" {
+			proofs.Add(1)
+		}
+		n := exchanges.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		writeToken(w, fmt.Sprintf("downstream-%s-%d", r.PostForm.Get("subject_token"), n), 300)
+	}
+	client, err := New(context.Background(), keycloak.config("acme"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// Concurrent requests of a session share one exchange
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.DownstreamToken(ctx, "session-a", "billing", nil); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := exchanges.Load(); got != 1 {
+		t.Fatalf("%d exchanges, want 1", got)
+	}
+	cached, err := client.DownstreamToken(ctx, "session-a", "billing", nil)
+	if err != nil || exchanges.Load() != 1 {
+		t.Fatalf("cached token not reused: %v", err)
+	}
+
+	// Ending the session evicts its tokens, the next request exchanges again
+	evicted := client.EvictDownstreamTokens("session-a")
+	if len(evicted) != 1 || evicted[0].AccessToken != cached.AccessToken {
+		t.Fatalf("evicted %v, want %s", evicted, cached.AccessToken)
+	}
+	if _, err := client.DownstreamToken(ctx, "session-a", "billing", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := exchanges.Load(); got != 2 {
+		t.Fatalf("%d exchanges after eviction, want 2", got)
+	}
+
+	// DPoP bound subject tokens are sent with a proof
+	key, err := NewDPoPKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.DownstreamToken(ctx, "session-b", "billing", key); err != nil {
+		t.Fatal(err)
+	}
+	if got := proofs.Load(); got != 1 {
+		t.Fatalf("%d exchanges with a DPoP proof, want 1", got)
+	}
+}
+
+func TestMoveDownstreamTokens(t *testing.T) {
+	keycloak := newFakeKeycloak(t)
+	keycloak.token = func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		writeToken(w, "downstream-"+r.PostForm.Get("subject_token")+"-"+r.PostForm.Get("audience"), 300)
+	}
+	client, err := New(context.Background(), keycloak.config("acme"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, audience := range []string{"billing", "reports"} {
+		if _, err := client.DownstreamToken(ctx, "before-refresh", audience, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A request with the new access token already exchanged one audience
+	if _, err := client.DownstreamToken(ctx, "after-refresh", "reports", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	displaced := client.MoveDownstreamTokens("before-refresh", "after-refresh")
+	if len(displaced) != 1 || displaced[0].AccessToken != "downstream-before-refresh-reports" {
+		t.Fatalf("displaced %v, want the previous reports token", displaced)
+	}
+	if evicted := client.EvictDownstreamTokens("before-refresh"); len(evicted) != 0 {
+		t.Fatalf("%d tokens left under the previous access token", len(evicted))
+	}
+	// Logging out after the refresh evicts the tokens exchanged before it
+	evicted := map[string]bool{}
+	for _, token := range client.EvictDownstreamTokens("after-refresh") {
+		evicted[token.AccessToken] = true
+	}
+	if len(evicted) != 2 || !evicted["downstream-before-refresh-billing"] || !evicted["downstream-after-refresh-reports"] {
+		t.Fatalf("evicted %v", evicted)
+	}
+}
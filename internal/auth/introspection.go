@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrIntrospectionUnavailable is returned whenever Keycloak did not answer
+// whether the token is active: the endpoint cannot be reached, rejects the
+// request (e.g. wrong client credentials), answers something other than an
+// introspection response, or the circuit breaker is open. Only an explicit
+// active:false means the token is inactive. Callers are expected to fall
+// back to local token verification.
+var ErrIntrospectionUnavailable = errors.New("token introspection unavailable")
+
+// Circuit breaker settings for the introspection endpoint
+const (
+	introspectionMaxFailures = 5
+	introspectionCooldown    = 30 * time.Second
+)
+
+// Introspection is the RFC 7662 response. Claims holds the whole response,
+// Keycloak includes the token claims (sub, scope, realm_access, ...) in it.
+type Introspection struct {
+	Active    bool
+	ExpiresAt time.Time
+	Claims    map[string]interface{}
+}
+
+// IntrospectionEnabled reports whether access tokens must be checked
+// against Keycloak instead of only verifying their signature locally
+func (c *Client) IntrospectionEnabled() bool {
+	return c.introspect && c.introspectionEndpoint != ""
+}
+
+// Introspect asks Keycloak whether an access token is still active (RFC 7662),
+// which catches tokens revoked before their expiry and supports opaque tokens.
+func (c *Client) Introspect(ctx context.Context, accessToken string) (*Introspection, error) {
+	if !c.introspectionBreaker.allow() {
+		return nil, ErrIntrospectionUnavailable
+	}
+	result, err := c.introspectionRequest(ctx, accessToken)
+	if err != nil {
+		c.introspectionBreaker.failure()
+		return nil, fmt.Errorf("%w: %v", ErrIntrospectionUnavailable, err)
+	}
+	c.introspectionBreaker.success()
+	return result, nil
+}
+
+func (c *Client) introspectionRequest(ctx context.Context, accessToken string) (*Introspection, error) {
+	params := url.Values{
+		"token":           {accessToken},
+		"token_type_hint": {"access_token"},
+	}
+	if err := c.authenticateClient(params); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.introspectionEndpoint,
+		strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build introspection request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// A rejected request says nothing about the token, e.g. a 401 for wrong
+	// client credentials must not log every user out
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection endpoint returned %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return ParseIntrospection(body)
+}
+
+// ParseIntrospection decodes a raw introspection response, also used to
+// restore cached results. A response without a boolean active member is
+// rejected rather than read as inactive.
+func ParseIntrospection(body []byte) (*Introspection, error) {
+	var claims map[string]interface{}
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, fmt.Errorf("failed to decode introspection response: %w", err)
+	}
+	active, ok := claims["active"].(bool)
+	if !ok {
+		return nil, errors.New("introspection response has no active member")
+	}
+	result := &Introspection{Active: active, Claims: claims}
+	if exp, ok := claims["exp"].(float64); ok {
+		result.ExpiresAt = time.Unix(int64(exp), 0)
+	}
+	return result, nil
+}
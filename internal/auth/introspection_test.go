@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIntrospect(t *testing.T) {
+	tests := []struct {
+		name            string
+		status          int
+		body            string
+		wantActive      bool
+		wantUnavailable bool
+	}{
+		{name: "active", status: http.StatusOK, body: `{"active":true,"sub":"user-1","exp":4102444800}`, wantActive: true},
+		{name: "inactive", status: http.StatusOK, body: `{"active":false}`},
+		{name: "wrong client credentials", status: http.StatusUnauthorized, body: `{"error":"invalid_client"}`, wantUnavailable: true},
+		{name: "forbidden", status: http.StatusForbidden, wantUnavailable: true},
+		{name: "server error", status: http.StatusServiceUnavailable, wantUnavailable: true},
+		{name: "not JSON", status: http.StatusOK, body: `<html>login</html>`, wantUnavailable: true},
+		{name: "no active member", status: http.StatusOK, body: `{"sub":"user-1"}`, wantUnavailable: true},
+		{name: "active not a boolean", status: http.StatusOK, body: `{"active":"false"}`, wantUnavailable: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keycloak := newFakeKeycloak(t)
+			keycloak.introspect = func(w http.ResponseWriter, r *http.Request) {
+				if r.FormValue("token") != "access-token" || r.FormValue("client_secret") != "secret" {
+					t.Errorf("introspection request = %v", r.PostForm)
+				}
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}
+			config := keycloak.config("acme")
+			config.Introspection = true
+			client, err := New(context.Background(), config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !client.IntrospectionEnabled() {
+				t.Fatal("introspection not enabled")
+			}
+
+			result, err := client.Introspect(context.Background(), "access-token")
+			if tt.wantUnavailable {
+				if !errors.Is(err, ErrIntrospectionUnavailable) {
+					t.Fatalf("error = %v, want ErrIntrospectionUnavailable", err)
+				}
+				if client.introspectionBreaker.failures != 1 {
+					t.Fatalf("breaker failures = %d, want the failure counted", client.introspectionBreaker.failures)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Active != tt.wantActive {
+				t.Fatalf("Active = %v, want %v", result.Active, tt.wantActive)
+			}
+			if tt.wantActive && (result.Claims["sub"] != "user-1" || !result.ExpiresAt.Equal(time.Unix(4102444800, 0))) {
+				t.Fatalf("result = %+v", result)
+			}
+		})
+	}
+}
+
+func TestIntrospectBreaker(t *testing.T) {
+	keycloak := newFakeKeycloak(t)
+	var calls atomic.Int32
+	var healthy atomic.Bool
+	keycloak.introspect = func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"active":true}`))
+	}
+	config := keycloak.config("acme")
+	config.Introspection = true
+	client, err := New(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.introspectionBreaker = newBreaker(2, 50*time.Millisecond)
+
+	for i := 0; i < 4; i++ {
+		if _, err := client.Introspect(context.Background(), "access-token"); !errors.Is(err, ErrIntrospectionUnavailable) {
+			t.Fatalf("call %d: error = %v, want ErrIntrospectionUnavailable", i+1, err)
+		}
+	}
+	// The breaker opened after two failures
+	if got := calls.Load(); got != 2 {
+		t.Fatalf("%d introspection requests, want 2", got)
+	}
+	healthy.Store(true)
+	time.Sleep(60 * time.Millisecond)
+	if result, err := client.Introspect(context.Background(), "access-token"); err != nil || !result.Active {
+		t.Fatalf("trial call = %v, %v", result, err)
+	}
+	if _, err := client.Introspect(context.Background(), "access-token"); err != nil {
+		t.Fatalf("breaker not closed after the trial: %v", err)
+	}
+}
@@ -3,6 +3,9 @@ package auth
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"golang.org/x/oauth2"
@@ -11,27 +14,132 @@ import (
 type Config struct {
 	BaseURL      string // Authorization base url
 	ClientID     string // client id oauth
-	RedirectURL  string // valid redirect url
+	RedirectURL  string // valid redirect url, "{realm}" is replaced with the realm
 	ClientSecret string
 	Realm        string // keycloak realm
+
+	// ClientAuthMethod selects how the client authenticates to the token
+	// endpoint: ClientAuthSecret (default), ClientAuthPrivateKeyJWT or ClientAuthTLS
+	ClientAuthMethod  string
+	ClientKeyFiles    []string // private_key_jwt signing keys (PEM or JWK), first one is active
+	ClientCertFile    string   // tls_client_auth certificate (PEM)
+	ClientCertKeyFile string   // tls_client_auth certificate private key (PEM)
+
+	// DPoP binds issued tokens to a per-session key pair (RFC 9449)
+	DPoP bool
+
+	// Introspection checks access tokens against Keycloak (RFC 7662)
+	// so revoked tokens are rejected before they expire
+	Introspection         bool
+	IntrospectionCacheTTL time.Duration // how long introspection results may be cached
+
+	// UserInfoClaims are the UserInfo endpoint claims kept in the session
+	UserInfoClaims []string
 }
 
 // Client struct holds all components needed for authentication
 type Client struct {
+	Realm    string                // Keycloak realm this client authenticates against
 	Provider *oidc.Provider        // Handles OIDC protocol operations with Keycloak
 	OIDC     *oidc.IDTokenVerifier // Verifies JWT tokens from Keycloak
 	Oauth    oauth2.Config         // Manages OAuth2 flow (authorization codes, tokens)
+
+	// parEndpoint is the pushed authorization request endpoint, empty when
+	// the realm does not advertise PAR (RFC 9126) in its discovery document
+	parEndpoint string
+
+	issuer        string       // realm issuer, audience of client assertions
+	tokenEndpoint string       // token endpoint, the mTLS alias for tls_client_auth
+	authMethod    string       // client authentication method
+	keys          *KeySet      // client assertion keys for private_key_jwt
+	httpClient    *http.Client // back channel client, presents the mTLS certificate
+	dpop          bool         // request DPoP bound tokens
+
+	introspect            bool     // introspect access tokens instead of only verifying them
+	introspectionEndpoint string   // RFC 7662 endpoint from discovery
+	introspectionBreaker  *breaker // stops calling an unreachable introspection endpoint
+
+	revocationEndpoint string // RFC 7009 endpoint from discovery
+	deviceEndpoint     string // RFC 8628 device authorization endpoint from discovery
+
+	userInfoClaims []string // UserInfo claims kept in the session
+
+	services  *serviceTokens   // client credentials token sources
+	exchanged *exchangedTokens // token exchange results per subject token and audience
+}
+
+// providerClaims holds the discovery metadata go-oidc does not expose
+type providerClaims struct {
+	Issuer                string `json:"issuer"`
+	PAREndpoint           string `json:"pushed_authorization_request_endpoint"`
+	IntrospectionEndpoint string `json:"introspection_endpoint"`
+	RevocationEndpoint    string `json:"revocation_endpoint"`
+	DeviceEndpoint        string `json:"device_authorization_endpoint"`
+	MTLSAliases           struct {
+		TokenEndpoint         string `json:"token_endpoint"`
+		PAREndpoint           string `json:"pushed_authorization_request_endpoint"`
+		IntrospectionEndpoint string `json:"introspection_endpoint"`
+		RevocationEndpoint    string `json:"revocation_endpoint"`
+		DeviceEndpoint        string `json:"device_authorization_endpoint"`
+	} `json:"mtls_endpoint_aliases"`
 }
 
 func New(ctx context.Context, config *Config) (*Client, error) {
 	// Construct the provider URL using Keycloak realm
 	providerURL := fmt.Sprintf("%s/realms/%s", config.BaseURL, config.Realm)
 
-	provider, err := oidc.NewProvider(ctx, providerURL)
+	httpClient, err := newHTTPClient(config)
+	if err != nil {
+		return nil, err
+	}
+	// Discovery and JWKS requests go through the back channel client too
+	provider, err := oidc.NewProvider(oidc.ClientContext(ctx, httpClient), providerURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get provider: %v", err)
 	}
 
+	var metadata providerClaims
+	if err := provider.Claims(&metadata); err != nil {
+		return nil, fmt.Errorf("failed to decode provider metadata: %v", err)
+	}
+
+	// Resolve how the client authenticates on back channel calls
+	authMethod := config.ClientAuthMethod
+	if authMethod == "" {
+		authMethod = ClientAuthSecret
+	}
+	tokenEndpoint := provider.Endpoint().TokenURL
+	parEndpoint := metadata.PAREndpoint
+	introspectionEndpoint := metadata.IntrospectionEndpoint
+	revocationEndpoint := metadata.RevocationEndpoint
+	deviceEndpoint := metadata.DeviceEndpoint
+	var keys *KeySet
+	switch authMethod {
+	case ClientAuthSecret:
+	case ClientAuthPrivateKeyJWT:
+		if keys, err = NewKeySet(config.ClientKeyFiles); err != nil {
+			return nil, err
+		}
+	case ClientAuthTLS:
+		// Certificate bound requests must go to the mTLS endpoint aliases when advertised
+		if metadata.MTLSAliases.TokenEndpoint != "" {
+			tokenEndpoint = metadata.MTLSAliases.TokenEndpoint
+		}
+		if metadata.MTLSAliases.PAREndpoint != "" {
+			parEndpoint = metadata.MTLSAliases.PAREndpoint
+		}
+		if metadata.MTLSAliases.IntrospectionEndpoint != "" {
+			introspectionEndpoint = metadata.MTLSAliases.IntrospectionEndpoint
+		}
+		if metadata.MTLSAliases.RevocationEndpoint != "" {
+			revocationEndpoint = metadata.MTLSAliases.RevocationEndpoint
+		}
+		if metadata.MTLSAliases.DeviceEndpoint != "" {
+			deviceEndpoint = metadata.MTLSAliases.DeviceEndpoint
+		}
+	default:
+		return nil, fmt.Errorf("unsupported client auth method %q", authMethod)
+	}
 	// Create ID token verifier
 	verifier := provider.Verifier(&oidc.Config{
 		ClientID: config.ClientID,
@@ -43,16 +151,24 @@ func New(ctx context.Context, config *Config) (*Client, error) {
 	oauth2Config := oauth2.Config{
 		ClientID:     config.ClientID,
 		ClientSecret: config.ClientSecret,
-		RedirectURL:  config.RedirectURL,
+		RedirectURL:  strings.ReplaceAll(config.RedirectURL, "{realm}", config.Realm),
 		Endpoint:     provider.Endpoint(),
 		Scopes: []string{
 			oidc.ScopeOpenID, // Required for OIDC authentication
 			"roles",          // Request user roles from Keycloak
 		},
 	}
+	// The token endpoint may be the mTLS alias, and without a secret the
+	// client_id goes in the body next to the assertion instead of Basic auth
+	oauth2Config.Endpoint.TokenURL = tokenEndpoint
+	if authMethod != ClientAuthSecret {
+		oauth2Config.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+	}
 
 	// Return initialized client with all required components
 	return &Client{
+		Realm: config.Realm,
+
 		// oauth2Config: Used for OAuth2 operations like:
 		// - Generating login URL (AuthCodeURL)
 		// - Exchanging auth code for tokens (Exchange)
@@ -70,6 +186,26 @@ func New(ctx context.Context, config *Config) (*Client, error) {
 		// - Handles OIDC protocol details
 		// - Manages provider metadata
 		Provider: provider,
+
+		parEndpoint:   parEndpoint,
+		issuer:        metadata.Issuer,
+		tokenEndpoint: tokenEndpoint,
+		authMethod:    authMethod,
+		keys:          keys,
+		httpClient:    httpClient,
+		dpop:          config.DPoP,
+
+		introspect:            config.Introspection,
+		introspectionEndpoint: introspectionEndpoint,
+		introspectionBreaker:  newBreaker(introspectionMaxFailures, introspectionCooldown),
+
+		revocationEndpoint: revocationEndpoint,
+		deviceEndpoint:     deviceEndpoint,
+
+		userInfoClaims: config.UserInfoClaims,
+
+		services:  &serviceTokens{sources: make(map[string]oauth2.TokenSource)},
+		exchanged: &exchangedTokens{entries: make(map[string]map[string]*oauth2.Token)},
 	}, nil
 }
 
@@ -81,16 +217,6 @@ func (c *Client) AuthCodeURL(state string) string {
 	return c.Oauth.AuthCodeURL(state)
 }
 
-// Exchange converts an authorization code into OAuth2 tokens.
-// This method is called after the user is redirected back from Keycloak
-// with an authorization code. It returns:
-// - access_token: for accessing protected resources
-// - refresh_token: for getting new access tokens
-// - id_token: contains user information
-func (c *Client) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
-	return c.Oauth.Exchange(ctx, code)
-}
-
 // VerifyIDToken validates and decodes the ID token from the OAuth2 token response.
 // It performs several checks:
 // - Verifies the token signature
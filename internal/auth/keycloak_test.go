@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// fakeKeycloak serves the discovery documents of any realm and lets tests
+// answer the token endpoint
+type fakeKeycloak struct {
+	*httptest.Server
+	discoveries atomic.Int32
+	// block holds the discovery of a realm until it is closed
+	block map[string]chan struct{}
+	// token answers the token endpoint, 400 when nil
+	token http.HandlerFunc
+	// revoke answers the revocation endpoint, 200 when nil
+	revoke http.HandlerFunc
+	// par answers the pushed authorization request endpoint, which is only
+	// advertised when set
+	par http.HandlerFunc
+	// introspect answers the introspection endpoint, which is only
+	// advertised when set
+	introspect http.HandlerFunc
+}
+
+func newFakeKeycloak(t *testing.T) *fakeKeycloak {
+	t.Helper()
+	f := &fakeKeycloak{block: make(map[string]chan struct{})}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeKeycloak) serve(w http.ResponseWriter, r *http.Request) {
+	rest, ok := strings.CutPrefix(r.URL.Path, "/realms/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	realm, path, _ := strings.Cut(rest, "/")
+	issuer := f.URL + "/realms/" + realm
+	switch path {
+	case ".well-known/openid-configuration":
+		f.discoveries.Add(1)
+		if block, ok := f.block[realm]; ok {
+			<-block
+		}
+		discovery := map[string]string{
+			"issuer":                 issuer,
+			"authorization_endpoint": issuer + "/protocol/openid-connect/auth",
+			"token_endpoint":         issuer + "/protocol/openid-connect/token",
+			"userinfo_endpoint":      issuer + "/protocol/openid-connect/userinfo",
+			"jwks_uri":               issuer + "/protocol/openid-connect/certs",
+			"revocation_endpoint":    issuer + "/protocol/openid-connect/revoke",
+		}
+		if f.introspect != nil {
+			discovery["introspection_endpoint"] = issuer + "/protocol/openid-connect/token/introspect"
+		}
+		if f.par != nil {
+			discovery["pushed_authorization_request_endpoint"] = issuer + "/protocol/openid-connect/ext/par/request"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(discovery)
+	case "protocol/openid-connect/token":
+		if f.token == nil {
+			http.Error(w, `{"error":"invalid_request"}`, http.StatusBadRequest)
+			return
+		}
+		f.token(w, r)
+	case "protocol/openid-connect/token/introspect":
+		if f.introspect == nil {
+			http.NotFound(w, r)
+			return
+		}
+		f.introspect(w, r)
+	case "protocol/openid-connect/ext/par/request":
+		if f.par == nil {
+			http.NotFound(w, r)
+			return
+		}
+		f.par(w, r)
+	case "protocol/openid-connect/revoke":
+		if f.revoke != nil {
+			f.revoke(w, r)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// config returns a client configuration pointing at the fake server
+func (f *fakeKeycloak) config(realm string) *Config {
+	return &Config{
+		BaseURL:      f.URL,
+		ClientID:     "app",
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost/auth/callback",
+		Realm:        realm,
+	}
+}
+
+// signToken returns a JWT with the claims, signed by a throwaway key
+func signToken(t *testing.T, claims interface{}) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// writeToken answers a token request with an access token
+func writeToken(w http.ResponseWriter, accessToken string, expiresIn int) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   expiresIn,
+	})
+}
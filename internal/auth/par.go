@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// parResponse is the body returned by the pushed authorization request endpoint
+type parResponse struct {
+	RequestURI string `json:"request_uri"`
+	ExpiresIn  int    `json:"expires_in"`
+}
+
+// oauthError is the standard OAuth2 error body (RFC 6749 section 5.2)
+type oauthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+// SupportsPAR reports whether the realm advertises a PAR endpoint
+func (c *Client) SupportsPAR() bool {
+	return c.parEndpoint != ""
+}
+
+// AuthorizationURL returns the URL the user is redirected to for login.
+// When the realm supports Pushed Authorization Requests (RFC 9126) the
+// authorization parameters are sent to Keycloak over the back channel and the
+// returned URL only carries client_id and request_uri. Otherwise it falls back
+// to the classic front channel URL built by AuthCodeURL.
+func (c *Client) AuthorizationURL(
+	ctx context.Context,
+	state string,
+	opts ...oauth2.AuthCodeOption,
+) (string, error) {
+	authURL := c.Oauth.AuthCodeURL(state, opts...)
+	if !c.SupportsPAR() {
+		return authURL, nil
+	}
+
+	// Reuse the query built by oauth2 so both flows send identical parameters
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse authorization url: %w", err)
+	}
+	requestURI, err := c.pushAuthorizationRequest(ctx, parsed.Query())
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{
+		"client_id":   {c.Oauth.ClientID},
+		"request_uri": {requestURI},
+	}
+	parsed.RawQuery = query.Encode()
+	return parsed.String(), nil
+}
+
+// pushAuthorizationRequest posts the authorization parameters to the PAR
+// endpoint and returns the request_uri referencing them
+func (c *Client) pushAuthorizationRequest(ctx context.Context, params url.Values) (string, error) {
+	if err := c.authenticateClient(params); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.parEndpoint,
+		strings.NewReader(params.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("failed to build PAR request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to push authorization request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		var oauthErr oauthError
+		_ = json.NewDecoder(resp.Body).Decode(&oauthErr)
+		return "", fmt.Errorf("PAR endpoint returned %d: %s %s",
+			resp.StatusCode, oauthErr.Error, oauthErr.Description)
+	}
+
+	var body parResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode PAR response: %w", err)
+	}
+	if body.RequestURI == "" {
+		return "", fmt.Errorf("PAR response has no request_uri")
+	}
+	return body.RequestURI, nil
+}
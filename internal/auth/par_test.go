@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestAuthorizationURL(t *testing.T) {
+	const requestURI = "urn:ietf:params:oauth:request_uri:6esc_11ACC5bwc014ltc14eY22c"
+	tests := []struct {
+		name      string
+		par       http.HandlerFunc // nil when the realm does not advertise PAR
+		wantQuery url.Values       // expected parameters of the login URL
+		wantErr   string
+	}{
+		{
+			name: "pushed request",
+			par: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusCreated)
+				_ = json.NewEncoder(w).Encode(parResponse{RequestURI: requestURI, ExpiresIn: 60})
+			},
+			wantQuery: url.Values{"client_id": {"app"}, "request_uri": {requestURI}},
+		},
+		{
+			name: "rejected request",
+			par: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(oauthError{Error: "invalid_request", Description: "invalid redirect_uri"})
+			},
+			wantErr: "PAR endpoint returned 400: invalid_request invalid redirect_uri",
+		},
+		{
+			name: "response without request_uri",
+			par: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusCreated)
+				_, _ = w.Write([]byte(`{"expires_in":60}`))
+			},
+			wantErr: "no request_uri",
+		},
+		{
+			name: "PAR not advertised",
+			wantQuery: url.Values{
+				"client_id":     {"app"},
+				"redirect_uri":  {"http://localhost/auth/callback"},
+				"response_type": {"code"},
+				"scope":         {"openid roles"},
+				"state":         {"state-1"},
+				"nonce":         {"nonce-1"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keycloak := newFakeKeycloak(t)
+			var pushed url.Values
+			if tt.par != nil {
+				keycloak.par = func(w http.ResponseWriter, r *http.Request) {
+					if err := r.ParseForm(); err != nil {
+						t.Error(err)
+					}
+					pushed = r.PostForm
+					tt.par(w, r)
+				}
+			}
+			client, err := New(context.Background(), keycloak.config("acme"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := client.SupportsPAR(); got != (tt.par != nil) {
+				t.Fatalf("SupportsPAR() = %v", got)
+			}
+
+			authURL, err := client.AuthorizationURL(context.Background(), "state-1", oauth2.SetAuthURLParam("nonce", "nonce-1"))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to mention %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := url.Parse(authURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(parsed.Path, "/protocol/openid-connect/auth") {
+				t.Fatalf("login URL %s is not the authorization endpoint", authURL)
+			}
+			for name, want := range tt.wantQuery {
+				if got := parsed.Query()[name]; strings.Join(got, " ") != strings.Join(want, " ") {
+					t.Fatalf("%s = %v, want %v", name, got, want)
+				}
+			}
+			if tt.par == nil {
+				return
+			}
+			if len(parsed.Query()) != len(tt.wantQuery) {
+				t.Fatalf("login URL %s carries more than the request_uri", authURL)
+			}
+			// The parameters travel over the authenticated back channel
+			if pushed.Get("state") != "state-1" || pushed.Get("nonce") != "nonce-1" || pushed.Get("client_secret") != "secret" {
+				t.Fatalf("pushed parameters = %v", pushed)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// ErrUnknownRealm is returned when a request targets a realm that is not configured
+var ErrUnknownRealm = errors.New("unknown realm")
+
+// Registry lazily builds and caches one Client per Keycloak realm.
+// Every realm shares the base Config (Keycloak URL, client credentials)
+// and only differs by the realm name and the redirect URL derived from it.
+type Registry struct {
+	config *Config
+	realms map[string]bool
+
+	mu      sync.RWMutex
+	clients map[string]*Client
+	// discovery runs one discovery per realm at a time, outside of mu so a
+	// slow realm does not hold up the others
+	discovery singleflight.Group
+}
+
+// NewRegistry creates a registry that serves the given realms
+func NewRegistry(config *Config, realms []string) *Registry {
+	allowed := make(map[string]bool, len(realms))
+	for _, realm := range realms {
+		allowed[realm] = true
+	}
+	return &Registry{
+		config:  config,
+		realms:  allowed,
+		clients: make(map[string]*Client),
+	}
+}
+
+// Client returns the Client of a realm, running OIDC discovery on first use.
+// Failed discoveries are not cached so a Keycloak outage heals by itself.
+func (r *Registry) Client(ctx context.Context, realm string) (*Client, error) {
+	if !r.realms[realm] {
+		return nil, ErrUnknownRealm
+	}
+
+	r.mu.RLock()
+	client, ok := r.clients[realm]
+	r.mu.RUnlock()
+	if ok {
+		return client, nil
+	}
+
+	result, err, _ := r.discovery.Do(realm, func() (interface{}, error) {
+		r.mu.RLock()
+		client, ok := r.clients[realm]
+		r.mu.RUnlock()
+		if ok {
+			return client, nil
+		}
+		config := *r.config
+		config.Realm = realm
+		// Detached from the first caller so its cancellation does not fail
+		// the requests waiting on the same discovery
+		client, err := New(context.WithoutCancel(ctx), &config)
+		if err != nil {
+			return nil, err
+		}
+		r.mu.Lock()
+		r.clients[realm] = client
+		r.mu.Unlock()
+		return client, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*Client), nil
+}
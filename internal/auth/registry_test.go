@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegistryClient(t *testing.T) {
+	keycloak := newFakeKeycloak(t)
+	registry := NewRegistry(keycloak.config("main"), []string{"main", "slow"})
+
+	if _, err := registry.Client(context.Background(), "other"); !errors.Is(err, ErrUnknownRealm) {
+		t.Fatalf("unknown realm: got %v, want ErrUnknownRealm", err)
+	}
+
+	// Concurrent first uses of a realm share one discovery
+	var wg sync.WaitGroup
+	clients := make([]*Client, 10)
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client, err := registry.Client(context.Background(), "main")
+			if err != nil {
+				t.Errorf("Client: %v", err)
+			}
+			clients[i] = client
+		}(i)
+	}
+	wg.Wait()
+	if got := keycloak.discoveries.Load(); got != 1 {
+		t.Errorf("discoveries = %d, want 1", got)
+	}
+	for _, client := range clients {
+		if client != clients[0] {
+			t.Fatal("realm clients differ")
+		}
+	}
+}
+
+func TestRegistryClientSlowRealm(t *testing.T) {
+	keycloak := newFakeKeycloak(t)
+	release := make(chan struct{})
+	keycloak.block["slow"] = release
+	defer close(release)
+	registry := NewRegistry(keycloak.config("main"), []string{"main", "slow"})
+	if _, err := registry.Client(context.Background(), "main"); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() { _, _ = registry.Client(context.Background(), "slow") }()
+	for keycloak.discoveries.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// A hanging discovery must not hold up cached realms
+	done := make(chan struct{})
+	go func() {
+		_, _ = registry.Client(context.Background(), "main")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("cached realm blocked by the discovery of another realm")
+	}
+}
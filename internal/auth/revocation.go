@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default size of the revocation queue of the server
+const (
+	RevocationWorkers   = 4
+	RevocationQueueSize = 1024
+)
+
+// Retry policy of asynchronous revocations
+const (
+	revocationAttempts = 4
+	revocationBackoff  = time.Second
+	revocationTimeout  = 10 * time.Second
+)
+
+// Revoke invalidates a token at Keycloak (RFC 7009). tokenTypeHint is
+// "refresh_token" or "access_token". Revoking a refresh token also ends the
+// client session it belongs to in Keycloak.
+func (c *Client) Revoke(ctx context.Context, token, tokenTypeHint string) error {
+	if c.revocationEndpoint == "" {
+		return fmt.Errorf("realm does not advertise a revocation endpoint")
+	}
+	params := url.Values{
+		"token":           {token},
+		"token_type_hint": {tokenTypeHint},
+	}
+	if err := c.authenticateClient(params); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.revocationEndpoint,
+		strings.NewReader(params.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to build revocation request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call revocation endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+	// RFC 7009: unknown or already invalid tokens are answered with 200 as well
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("revocation endpoint returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// RevocationQueue revokes the tokens of torn down sessions in the background
+// with a fixed number of workers, so logout latency does not depend on
+// Keycloak and an outage cannot pile up goroutines. Shutdown waits for the
+// queued revocations.
+type RevocationQueue struct {
+	jobs chan revocation
+	wg   sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// revocation is one token to revoke with the client of its realm
+type revocation struct {
+	client *Client
+	token  string
+	hint   string
+}
+
+// NewRevocationQueue starts the workers of a queue holding up to size tokens
+func NewRevocationQueue(workers, size int) *RevocationQueue {
+	q := &RevocationQueue{jobs: make(chan revocation, size)}
+	q.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+func (q *RevocationQueue) work() {
+	defer q.wg.Done()
+	for job := range q.jobs {
+		if err := job.client.revokeWithRetry(job.token, job.hint); err != nil {
+			slog.Warn("failed to revoke token", "realm", job.client.Realm, "token_type_hint", job.hint, "error", err)
+		}
+	}
+}
+
+// Revoke queues the refresh and access tokens of a session, retried with
+// exponential backoff. Empty tokens are skipped. Tokens are dropped when the
+// queue is full or shut down, they still expire on their own.
+func (q *RevocationQueue) Revoke(client *Client, refreshToken, accessToken string) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	for _, job := range []revocation{
+		{client, refreshToken, "refresh_token"},
+		{client, accessToken, "access_token"},
+	} {
+		if job.token == "" {
+			continue
+		}
+		if q.closed {
+			slog.Warn("token revocation skipped, shutting down", "realm", client.Realm, "token_type_hint", job.hint)
+			continue
+		}
+		select {
+		case q.jobs <- job:
+		default:
+			slog.Warn("token revocation dropped, queue is full", "realm", client.Realm, "token_type_hint", job.hint)
+		}
+	}
+}
+
+// Shutdown stops accepting revocations and waits until the queued ones are
+// done or ctx expires
+func (q *RevocationQueue) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("token revocations still pending: %w", ctx.Err())
+	}
+}
+
+func (c *Client) revokeWithRetry(token, tokenTypeHint string) error {
+	var err error
+	backoff := revocationBackoff
+	for attempt := 1; attempt <= revocationAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), revocationTimeout)
+		err = c.Revoke(ctx, token, tokenTypeHint)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if attempt < revocationAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestRevocationQueue(t *testing.T) {
+	keycloak := newFakeKeycloak(t)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var revoked []string
+	keycloak.revoke = func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		mu.Lock()
+		revoked = append(revoked, r.PostFormValue("token"))
+		mu.Unlock()
+	}
+	client, err := New(context.Background(), keycloak.config("acme"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The worker is busy with the first token, the second waits in the queue
+	// and the third is dropped instead of blocking the caller
+	queue := NewRevocationQueue(1, 1)
+	queue.Revoke(client, "refresh-1", "")
+	time.Sleep(50 * time.Millisecond)
+	queue.Revoke(client, "refresh-2", "access-2")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := queue.Shutdown(ctx); err == nil {
+		t.Fatal("Shutdown returned before the queue was drained")
+	}
+	// Revocations after shutdown are skipped
+	queue.Revoke(client, "refresh-3", "access-3")
+
+	close(release)
+	if err := queue.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"refresh-1", "refresh-2"}
+	if len(revoked) != len(want) || revoked[0] != want[0] || revoked[1] != want[1] {
+		t.Fatalf("revoked %v, want %v", revoked, want)
+	}
+}
+
+func TestIsInvalidGrant(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"invalid grant", &TokenError{StatusCode: 400, Code: "invalid_grant"}, true},
+		{"wrapped", fmt.Errorf("failed to refresh: %w", &TokenError{StatusCode: 400, Code: "invalid_grant"}), true},
+		{"other token error", &TokenError{StatusCode: 401, Code: "invalid_client"}, false},
+		{"oauth2 invalid grant", &oauth2.RetrieveError{ErrorCode: "invalid_grant"}, true},
+		{"oauth2 server error", &oauth2.RetrieveError{ErrorCode: "server_error"}, false},
+		{"server error", &TokenError{StatusCode: 503}, false},
+		{"network error", context.DeadlineExceeded, false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsInvalidGrant(tt.err); got != tt.want {
+				t.Fatalf("IsInvalidGrant(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"golang.org/x/oauth2"
+)
+
+// serviceTokenEarlyExpiry renews service tokens this long before they expire
+// so a token never runs out while a downstream request is in flight
+const serviceTokenEarlyExpiry = 30 * time.Second
+
+// serviceTokenRefreshAhead is how long before expiry a service token in use
+// is renewed in the background, so callers do not wait for Keycloak
+const serviceTokenRefreshAhead = time.Minute
+
+// serviceTokenRetry is the delay between background renewals that failed
+const serviceTokenRetry = 5 * time.Second
+
+// tokenAlgorithms are the signature algorithms of Keycloak access tokens
+var tokenAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512, jose.EdDSA,
+}
+
+// serviceTokens caches one token source per audience and scope set
+type serviceTokens struct {
+	mu      sync.Mutex
+	sources map[string]oauth2.TokenSource
+}
+
+// ServiceTokenSource returns a token source obtaining tokens for this backend
+// itself with the client credentials grant, e.g. to call other Keycloak
+// protected services. Sources are cached per audience and scopes and shared
+// across goroutines. Tokens are renewed in the background before they
+// expire while the source is in use.
+//
+// The audience is requested with the audience parameter and checked in the
+// issued token: in Keycloak one of the scopes must map it with an audience
+// mapper, or every token request fails.
+func (c *Client) ServiceTokenSource(audience string, scopes ...string) oauth2.TokenSource {
+	sorted := append([]string(nil), scopes...)
+	sort.Strings(sorted)
+	key := audience + "|" + strings.Join(sorted, " ")
+
+	c.services.mu.Lock()
+	defer c.services.mu.Unlock()
+	if source, ok := c.services.sources[key]; ok {
+		return source
+	}
+	source := newRefreshingTokenSource(&clientCredentialsSource{
+		client:   c,
+		audience: audience,
+		scopes:   sorted,
+	}, serviceTokenEarlyExpiry, serviceTokenRefreshAhead)
+	c.services.sources[key] = source
+	return source
+}
+
+// ServiceTransport wraps base so every request carries a service token
+func (c *Client) ServiceTransport(base http.RoundTripper, audience string, scopes ...string) http.RoundTripper {
+	return &oauth2.Transport{
+		Source: c.ServiceTokenSource(audience, scopes...),
+		Base:   base,
+	}
+}
+
+// clientCredentialsSource fetches a new token on every call, caching is
+// done by the surrounding refreshingTokenSource
+type clientCredentialsSource struct {
+	client   *Client
+	audience string
+	scopes   []string
+}
+
+func (s *clientCredentialsSource) Token() (*oauth2.Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), backChannelTimeout)
+	defer cancel()
+	return s.client.ClientCredentialsToken(ctx, s.audience, s.scopes...)
+}
+
+// ClientCredentialsToken requests a new token for the client's service
+// account, restricted to audience when set. Prefer ServiceTokenSource, which
+// caches the token.
+func (c *Client) ClientCredentialsToken(ctx context.Context, audience string, scopes ...string) (*oauth2.Token, error) {
+	params := url.Values{"grant_type": {"client_credentials"}}
+	if len(scopes) > 0 {
+		params.Set("scope", strings.Join(scopes, " "))
+	}
+	if audience == "" {
+		return c.tokenRequest(ctx, params, nil)
+	}
+	params.Set("audience", audience)
+	token, err := c.tokenRequest(ctx, params, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAudience(token.AccessToken, audience); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// ServiceAccountToken requests a token for the service account of another
+// confidential client of the realm, authenticated with that client's own
+// secret, e.g. the client of an integration presenting its API key
+func (c *Client) ServiceAccountToken(ctx context.Context, clientID, clientSecret string) (*oauth2.Token, error) {
+	return c.postToken(ctx, url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+	}, nil)
+}
+
+// checkAudience reports an error when the aud claim of a JWT access token
+// lacks audience. The token comes straight from the token endpoint, its
+// signature is left to the services receiving it.
+func checkAudience(accessToken, audience string) error {
+	token, err := jwt.ParseSigned(accessToken, tokenAlgorithms)
+	if err != nil {
+		return fmt.Errorf("failed to parse service token: %w", err)
+	}
+	var claims jwt.Claims
+	if err := token.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return fmt.Errorf("failed to decode service token: %w", err)
+	}
+	if !claims.Audience.Contains(audience) {
+		return fmt.Errorf("service token is not issued for audience %q, map it with an audience mapper", audience)
+	}
+	return nil
+}
+
+// refreshingTokenSource caches the token of source and renews it in the
+// background refreshAhead before it expires, so callers only wait for the
+// token endpoint on first use. A source unused since the last renewal stops
+// renewing and restarts on its next use. Tokens are handed out until
+// earlyExpiry before they expire.
+type refreshingTokenSource struct {
+	source       oauth2.TokenSource
+	earlyExpiry  time.Duration
+	refreshAhead time.Duration
+
+	mu    sync.Mutex
+	token *oauth2.Token
+	used  bool // Token was called since the last renewal
+	idle  bool // the renewal was skipped because the source was unused
+}
+
+func newRefreshingTokenSource(
+	source oauth2.TokenSource,
+	earlyExpiry, refreshAhead time.Duration,
+) *refreshingTokenSource {
+	return &refreshingTokenSource{
+		source:       source,
+		earlyExpiry:  earlyExpiry,
+		refreshAhead: refreshAhead,
+	}
+}
+
+func (s *refreshingTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used = true
+	if s.valid() {
+		if s.idle {
+			// Renew in the background again, right away when the token is
+			// already due
+			s.idle = false
+			s.scheduleLocked(time.Until(s.token.Expiry) - s.refreshAhead)
+		}
+		return s.token, nil
+	}
+	// Concurrent callers wait for this request instead of sending their own
+	token, err := s.source.Token()
+	if err != nil {
+		return nil, err
+	}
+	s.setLocked(token)
+	return token, nil
+}
+
+// valid reports whether the cached token can still be handed out
+func (s *refreshingTokenSource) valid() bool {
+	return s.token != nil &&
+		(s.token.Expiry.IsZero() || time.Until(s.token.Expiry) > s.earlyExpiry)
+}
+
+// setLocked caches a new token and schedules its renewal
+func (s *refreshingTokenSource) setLocked(token *oauth2.Token) {
+	s.token = token
+	s.used = false
+	s.idle = false
+	// Tokens shorter lived than refreshAhead are only renewed by Token
+	if delay := time.Until(token.Expiry) - s.refreshAhead; !token.Expiry.IsZero() && delay > 0 {
+		s.scheduleLocked(delay)
+	}
+}
+
+func (s *refreshingTokenSource) scheduleLocked(delay time.Duration) {
+	time.AfterFunc(max(delay, 0), s.renew)
+}
+
+// renew fetches a token in the background while the cached one is still
+// handed out
+func (s *refreshingTokenSource) renew() {
+	s.mu.Lock()
+	current, used := s.token, s.used
+	if !used {
+		s.idle = true
+	}
+	s.mu.Unlock()
+	if !used {
+		return
+	}
+
+	token, err := s.source.Token()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != current {
+		// A caller renewed the token in the meantime
+		return
+	}
+	if err != nil {
+		slog.Warn("failed to renew service token", "error", err)
+		// Retry while the cached token is valid, Token fetches it afterwards
+		if time.Until(current.Expiry)-s.earlyExpiry > serviceTokenRetry {
+			s.scheduleLocked(serviceTokenRetry)
+		}
+		return
+	}
+	s.setLocked(token)
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+	"golang.org/x/oauth2"
+)
+
+func TestClientCredentialsAudience(t *testing.T) {
+	tests := []struct {
+		name     string
+		audience string
+		issued   []string
+		wantErr  bool
+	}{
+		{name: "no audience requested", issued: []string{"account"}},
+		{name: "audience granted", audience: "billing", issued: []string{"account", "billing"}},
+		{name: "audience not mapped", audience: "billing", issued: []string{"account"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keycloak := newFakeKeycloak(t)
+			keycloak.token = func(w http.ResponseWriter, r *http.Request) {
+				if err := r.ParseForm(); err != nil {
+					t.Fatal(err)
+				}
+				if got := r.PostForm.Get("audience"); got != tt.audience {
+					t.Errorf("audience = %q, want %q", got, tt.audience)
+				}
+				writeToken(w, signToken(t, jwt.Claims{Audience: tt.issued}), 300)
+			}
+			client, err := New(context.Background(), keycloak.config("acme"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = client.ClientCredentialsToken(context.Background(), tt.audience)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ClientCredentialsToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServiceAccountToken(t *testing.T) {
+	keycloak := newFakeKeycloak(t)
+	keycloak.token = func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		// Authenticated as the integration's client, not as this backend
+		if _, _, ok := r.BasicAuth(); ok {
+			t.Error("backend credentials sent with the integration's grant")
+		}
+		if r.PostForm.Get("client_id") != "billing" || r.PostForm.Get("client_secret") != "api-key" {
+			t.Errorf("client credentials = %v", r.PostForm)
+		}
+		writeToken(w, "service-account", 300)
+	}
+	client, err := New(context.Background(), keycloak.config("acme"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := client.ServiceAccountToken(context.Background(), "billing", "api-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "service-account" {
+		t.Fatalf("access token = %q", token.AccessToken)
+	}
+}
+
+// countingSource issues tokens valid for lifetime and counts them
+type countingSource struct {
+	lifetime time.Duration
+	issued   atomic.Int32
+}
+
+func (s *countingSource) Token() (*oauth2.Token, error) {
+	s.issued.Add(1)
+	return &oauth2.Token{AccessToken: "token", Expiry: time.Now().Add(s.lifetime)}, nil
+}
+
+func TestRefreshingTokenSource(t *testing.T) {
+	source := &countingSource{lifetime: 600 * time.Millisecond}
+	tokens := newRefreshingTokenSource(source, 10*time.Millisecond, 400*time.Millisecond)
+
+	if _, err := tokens.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if got := source.issued.Load(); got != 1 {
+		t.Fatalf("issued %d tokens, want the first one reused", got)
+	}
+
+	// Renewed in the background 200ms in, before it expires
+	time.Sleep(300 * time.Millisecond)
+	if got := source.issued.Load(); got != 2 {
+		t.Fatalf("issued %d tokens, want a background renewal", got)
+	}
+	if _, err := tokens.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if got := source.issued.Load(); got != 2 {
+		t.Fatalf("issued %d tokens, want the renewed one reused", got)
+	}
+
+	// Used since the last renewal, renewed again 400ms in
+	time.Sleep(200 * time.Millisecond)
+	if got := source.issued.Load(); got != 3 {
+		t.Fatalf("issued %d tokens, want a second background renewal", got)
+	}
+	// Unused since then, the source stops renewing
+	time.Sleep(400 * time.Millisecond)
+	if got := source.issued.Load(); got != 3 {
+		t.Fatalf("issued %d tokens, want no renewal of an unused source", got)
+	}
+}
+
+func TestRefreshingTokenSourceIdle(t *testing.T) {
+	source := &countingSource{lifetime: 600 * time.Millisecond}
+	tokens := newRefreshingTokenSource(source, 10*time.Millisecond, 400*time.Millisecond)
+
+	if _, err := tokens.Token(); err != nil {
+		t.Fatal(err)
+	}
+	// Unused when the renewal is due 200ms in, the source goes idle
+	time.Sleep(300 * time.Millisecond)
+	if got := source.issued.Load(); got != 1 {
+		t.Fatalf("issued %d tokens, want no renewal of an unused source", got)
+	}
+
+	// Used again, the cached token is handed out and renewed right away
+	if _, err := tokens.Token(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := source.issued.Load(); got != 2 {
+		t.Fatalf("issued %d tokens, want a background renewal after the idle period", got)
+	}
+
+	// And renewal continues on schedule while the source is used
+	if _, err := tokens.Token(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if got := source.issued.Load(); got != 3 {
+		t.Fatalf("issued %d tokens, want the renewed token renewed again", got)
+	}
+	if _, err := tokens.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if got := source.issued.Load(); got != 3 {
+		t.Fatalf("issued %d tokens, want callers served from the cache", got)
+	}
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// TokenError is an OAuth2 error returned by the token endpoint
+type TokenError struct {
+	StatusCode  int
+	Code        string // error, e.g. invalid_grant
+	Description string // error_description
+}
+
+func (e *TokenError) Error() string {
+	return fmt.Sprintf("token endpoint returned %d: %s %s", e.StatusCode, e.Code, e.Description)
+}
+
+// IsInvalidGrant reports whether err is the token endpoint rejecting the
+// grant, e.g. a refresh token that expired or was revoked or wrong user
+// credentials. Other errors may be transient and do not mean the grant is gone.
+func IsInvalidGrant(err error) bool {
+	var tokenErr *TokenError
+	if errors.As(err, &tokenErr) {
+		return tokenErr.Code == "invalid_grant"
+	}
+	// Grants sent through oauth2.Config
+	var retrieveErr *oauth2.RetrieveError
+	return errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "invalid_grant"
+}
+
+// tokenResponse is the successful token endpoint response (RFC 6749 section 5.1)
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// Exchange converts an authorization code into OAuth2 tokens.
+// This method is called after the user is redirected back from Keycloak
+// with an authorization code. It returns:
+// - access_token: for accessing protected resources
+// - refresh_token: for getting new access tokens
+// - id_token: contains user information
+//
+// When dpopKey is set the tokens are bound to it with a DPoP proof.
+func (c *Client) Exchange(ctx context.Context, code string, dpopKey *DPoPKey) (*oauth2.Token, error) {
+	var opts []oauth2.AuthCodeOption
+	if c.authMethod != ClientAuthSecret {
+		// oauth2.Config sends the client secret itself, only assertions are added
+		params := url.Values{}
+		if err := c.authenticateClient(params); err != nil {
+			return nil, err
+		}
+		for name := range params {
+			opts = append(opts, oauth2.SetAuthURLParam(name, params.Get(name)))
+		}
+	}
+	httpClient := c.httpClient
+	if dpopKey != nil {
+		httpClient = &http.Client{
+			Transport: &dpopTransport{key: dpopKey, base: httpClient.Transport, tokenRequests: true},
+			Timeout:   httpClient.Timeout,
+		}
+	}
+	return c.Oauth.Exchange(context.WithValue(ctx, oauth2.HTTPClient, httpClient), code, opts...)
+}
+
+// PasswordToken obtains tokens with the resource owner password credentials
+// grant, for legacy integrations that cannot follow the browser flow. It is
+// sent through oauth2.Config like Exchange, which authenticates the client
+// with its secret only.
+func (c *Client) PasswordToken(ctx context.Context, username, password string) (*oauth2.Token, error) {
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, c.httpClient)
+	return c.Oauth.PasswordCredentialsToken(ctx, username, password)
+}
+
+// Refresh obtains a new token set using a refresh token. Tokens bound with
+// DPoP must be refreshed with a proof of the same key.
+func (c *Client) Refresh(ctx context.Context, refreshToken string, dpopKey *DPoPKey) (*oauth2.Token, error) {
+	return c.tokenRequest(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	}, dpopKey)
+}
+
+// tokenRequest posts a grant to the token endpoint, authenticating the
+// client with the configured method and attaching a DPoP proof when a key is given
+func (c *Client) tokenRequest(ctx context.Context, params url.Values, dpopKey *DPoPKey) (*oauth2.Token, error) {
+	if err := c.authenticateClient(params); err != nil {
+		return nil, err
+	}
+	return c.postToken(ctx, params, dpopKey)
+}
+
+// postToken posts a grant to the token endpoint as is, params must
+// authenticate the client
+func (c *Client) postToken(ctx context.Context, params url.Values, dpopKey *DPoPKey) (*oauth2.Token, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.tokenEndpoint,
+		strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if dpopKey != nil {
+		proof, err := dpopKey.Proof(http.MethodPost, c.tokenEndpoint, "")
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("DPoP", proof)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call token endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var oauthErr oauthError
+		_ = json.Unmarshal(body, &oauthErr)
+		return nil, &TokenError{
+			StatusCode:  resp.StatusCode,
+			Code:        oauthErr.Error,
+			Description: oauthErr.Description,
+		}
+	}
+
+	var tr tokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return nil, fmt.Errorf("failed to decode token response: %w", err)
+	}
+	// Keep every field (id_token, scope, ...) reachable through Token.Extra
+	var extra map[string]interface{}
+	if err := json.Unmarshal(body, &extra); err != nil {
+		return nil, fmt.Errorf("failed to decode token response: %w", err)
+	}
+	token := &oauth2.Token{
+		AccessToken:  tr.AccessToken,
+		TokenType:    tr.TokenType,
+		RefreshToken: tr.RefreshToken,
+	}
+	if tr.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+	return token.WithExtra(extra), nil
+}
@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// writeECKey writes a PEM private key and returns its path
+func writeECKey(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "client.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExchangeClientAuthentication(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		dpop   bool
+		check  func(t *testing.T, r *http.Request)
+	}{
+		{
+			name:   "client secret in basic auth",
+			method: ClientAuthSecret,
+			check: func(t *testing.T, r *http.Request) {
+				user, password, ok := r.BasicAuth()
+				if !ok || user != "app" || password != "secret" {
+					t.Errorf("basic auth = %q %q %t", user, password, ok)
+				}
+				if r.PostForm.Get("client_secret") != "" {
+					t.Error("client secret sent twice")
+				}
+			},
+		},
+		{
+			name:   "private_key_jwt assertion",
+			method: ClientAuthPrivateKeyJWT,
+			check: func(t *testing.T, r *http.Request) {
+				if _, _, ok := r.BasicAuth(); ok {
+					t.Error("unexpected basic auth")
+				}
+				if r.PostForm.Get("client_id") != "app" {
+					t.Errorf("client_id = %q", r.PostForm.Get("client_id"))
+				}
+				if r.PostForm.Get("client_assertion_type") != clientAssertionType ||
+					r.PostForm.Get("client_assertion") == "" {
+					t.Error("missing client assertion")
+				}
+			},
+		},
+		{
+			name:   "DPoP proof on the token request",
+			method: ClientAuthSecret,
+			dpop:   true,
+			check: func(t *testing.T, r *http.Request) {
+				proof := r.Header.Get("DPoP")
+				if proof == "" {
+					t.Fatal("missing DPoP proof")
+				}
+				parsed, err := jwt.ParseSigned(proof, dpopAlgorithms)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var claims dpopClaims
+				if err := parsed.Claims(parsed.Headers[0].JSONWebKey, &claims); err != nil {
+					t.Fatal(err)
+				}
+				url := "http://" + r.Host + r.URL.Path
+				if claims.Method != http.MethodPost || claims.URL != url || claims.ATH != "" {
+					t.Errorf("proof claims = %+v", claims)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keycloak := newFakeKeycloak(t)
+			keycloak.token = func(w http.ResponseWriter, r *http.Request) {
+				if err := r.ParseForm(); err != nil {
+					t.Fatal(err)
+				}
+				if r.PostForm.Get("code") != "the-code" {
+					t.Errorf("code = %q", r.PostForm.Get("code"))
+				}
+				tt.check(t, r)
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{
+					"access_token":  "access",
+					"refresh_token": "refresh",
+					"token_type":    "Bearer",
+					"expires_in":    300,
+				})
+			}
+			config := keycloak.config("main")
+			config.ClientAuthMethod = tt.method
+			if tt.method == ClientAuthPrivateKeyJWT {
+				config.ClientSecret = ""
+				config.ClientKeyFiles = []string{writeECKey(t)}
+			}
+			client, err := New(context.Background(), config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var dpopKey *DPoPKey
+			if tt.dpop {
+				if dpopKey, err = NewDPoPKey(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			token, err := client.Exchange(context.Background(), "the-code", dpopKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.AccessToken != "access" || token.RefreshToken != "refresh" {
+				t.Errorf("token = %+v", token)
+			}
+		})
+	}
+}
+
+func TestHTTPClientTimeout(t *testing.T) {
+	for _, method := range []string{ClientAuthSecret, ClientAuthPrivateKeyJWT} {
+		client, err := newHTTPClient(&Config{ClientAuthMethod: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if client.Timeout != backChannelTimeout {
+			t.Errorf("%s: timeout = %v, want %v", method, client.Timeout, backChannelTimeout)
+		}
+	}
+}
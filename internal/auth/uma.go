@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// grantTypeUMATicket is the Keycloak Authorization Services grant (UMA 2.0)
+const grantTypeUMATicket = "urn:ietf:params:oauth:grant-type:uma-ticket"
+
+// Permission is a Keycloak Authorization Services permission on a resource,
+// optionally narrowed to one of its scopes. It is written resource#scope.
+type Permission struct {
+	Resource string
+	Scope    string
+}
+
+// ParsePermission parses a resource or resource#scope permission
+func ParsePermission(s string) (Permission, error) {
+	resource, scope, _ := strings.Cut(s, "#")
+	if resource == "" {
+		return Permission{}, fmt.Errorf("invalid permission %q, expected resource#scope", s)
+	}
+	return Permission{Resource: resource, Scope: scope}, nil
+}
+
+func (p Permission) String() string {
+	if p.Scope == "" {
+		return p.Resource
+	}
+	return p.Resource + "#" + p.Scope
+}
+
+// RPT is a requesting party token and the permissions Keycloak granted in it
+type RPT struct {
+	Token     string
+	ExpiresAt time.Time
+	granted   []rptPermission
+}
+
+// rptPermission is an entry of the authorization.permissions claim of an RPT
+type rptPermission struct {
+	ResourceID   string   `json:"rsid"`
+	ResourceName string   `json:"rsname"`
+	Scopes       []string `json:"scopes"`
+}
+
+// Granted reports whether the RPT grants the permission
+func (r *RPT) Granted(p Permission) bool {
+	if r == nil {
+		return false
+	}
+	for _, granted := range r.granted {
+		if granted.ResourceName != p.Resource && granted.ResourceID != p.Resource {
+			continue
+		}
+		if p.Scope == "" {
+			return true
+		}
+		for _, scope := range granted.Scopes {
+			if scope == p.Scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RequestingPartyToken asks Keycloak for an RPT covering the permissions on
+// behalf of the user of accessToken. audience is the resource server client,
+// this client when empty. Keycloak only puts granted permissions in the RPT
+// and answers access_denied when none is granted, in which case a nil RPT is
+// returned without error. A DPoP bound access token is sent with a proof of
+// its key, dpopKey.
+func (c *Client) RequestingPartyToken(
+	ctx context.Context,
+	accessToken, audience string,
+	permissions []Permission,
+	dpopKey *DPoPKey,
+) (*RPT, error) {
+	if audience == "" {
+		audience = c.Oauth.ClientID
+	}
+	params := url.Values{
+		"grant_type":    {grantTypeUMATicket},
+		"audience":      {audience},
+		"subject_token": {accessToken},
+	}
+	for _, p := range permissions {
+		params.Add("permission", p.String())
+	}
+	token, err := c.tokenRequest(ctx, params, dpopKey)
+	var tokenErr *TokenError
+	if errors.As(err, &tokenErr) && tokenErr.StatusCode == http.StatusForbidden {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to request RPT: %w", err)
+	}
+
+	rpt, err := c.Provider.Verifier(&oidc.Config{
+		SkipClientIDCheck: true,
+	}).Verify(ctx, token.AccessToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify RPT: %w", err)
+	}
+	var claims struct {
+		Authorization struct {
+			Permissions []rptPermission `json:"permissions"`
+		} `json:"authorization"`
+	}
+	if err := rpt.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("failed to decode RPT permissions: %w", err)
+	}
+	return &RPT{
+		Token:     token.AccessToken,
+		ExpiresAt: rpt.Expiry,
+		granted:   claims.Authorization.Permissions,
+	}, nil
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestParsePermission(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Permission
+		wantErr bool
+	}{
+		{in: "invoices#read", want: Permission{Resource: "invoices", Scope: "read"}},
+		{in: "invoices", want: Permission{Resource: "invoices"}},
+		{in: "#read", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParsePermission(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePermission(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("ParsePermission(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+			if !tt.wantErr && got.String() != tt.in {
+				t.Fatalf("String() = %q, want %q", got.String(), tt.in)
+			}
+		})
+	}
+}
+
+func TestRPTGranted(t *testing.T) {
+	rpt := &RPT{granted: []rptPermission{
+		{ResourceID: "1b6e", ResourceName: "invoices", Scopes: []string{"read"}},
+		{ResourceID: "9f2a", ResourceName: "reports"},
+	}}
+	tests := []struct {
+		name       string
+		rpt        *RPT
+		permission Permission
+		want       bool
+	}{
+		{"granted scope", rpt, Permission{Resource: "invoices", Scope: "read"}, true},
+		{"other scope", rpt, Permission{Resource: "invoices", Scope: "write"}, false},
+		{"resource by name", rpt, Permission{Resource: "invoices"}, true},
+		{"resource by ID", rpt, Permission{Resource: "9f2a"}, true},
+		{"resource without the scope", rpt, Permission{Resource: "reports", Scope: "read"}, false},
+		{"unknown resource", rpt, Permission{Resource: "payroll"}, false},
+		{"no RPT", nil, Permission{Resource: "invoices"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rpt.Granted(tt.permission); got != tt.want {
+				t.Fatalf("Granted(%v) = %v, want %v", tt.permission, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestingPartyTokenDPoP(t *testing.T) {
+	keycloak := newFakeKeycloak(t)
+	var proof string
+	keycloak.token = func(w http.ResponseWriter, r *http.Request) {
+		proof = r.Header.Get("DPoP")
+		http.Error(w, `{"error":"access_denied"}`, http.StatusForbidden)
+	}
+	client, err := New(context.Background(), keycloak.config("acme"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := NewDPoPKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpt, err := client.RequestingPartyToken(context.Background(), "access", "", []Permission{{Resource: "invoices"}}, key)
+	if err != nil || rpt != nil {
+		t.Fatalf("RequestingPartyToken = %v, %v, want a denial", rpt, err)
+	}
+	if proof == "" {
+		t.Fatal("DPoP bound subject token sent without a proof")
+	}
+}
@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// UserInfo fetches the OIDC UserInfo endpoint with the session access token
+// and returns the subject, username and email plus the configured
+// UserInfoClaims that are present.
+// DPoP bound tokens are sent with the DPoP scheme and a proof of dpopKey.
+func (c *Client) UserInfo(
+	ctx context.Context,
+	accessToken string,
+	dpopKey *DPoPKey,
+) (map[string]interface{}, error) {
+	token := &oauth2.Token{AccessToken: accessToken, TokenType: "Bearer"}
+	httpClient := c.httpClient
+	if dpopKey != nil {
+		token.TokenType = "DPoP"
+		httpClient = &http.Client{
+			Transport: &dpopTransport{key: dpopKey, base: httpClient.Transport},
+			Timeout:   httpClient.Timeout,
+		}
+	}
+
+	info, err := c.Provider.UserInfo(oidc.ClientContext(ctx, httpClient), oauth2.StaticTokenSource(token))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch user info: %w", err)
+	}
+	var all map[string]interface{}
+	if err := info.Claims(&all); err != nil {
+		return nil, fmt.Errorf("failed to decode user info: %w", err)
+	}
+
+	claims := map[string]interface{}{"sub": info.Subject}
+	// The username and email are part of every session, the other claims
+	// only when configured
+	for _, name := range append([]string{"preferred_username", "email"}, c.userInfoClaims...) {
+		if value, ok := all[name]; ok {
+			claims[name] = value
+		}
+	}
+	return claims, nil
+}
+
+// dpopTransport adds a DPoP proof to every request using the DPoP scheme,
+// or to every request when tokenRequests is set (token endpoint calls have
+// no access token to bind the proof to)
+type dpopTransport struct {
+	key           *DPoPKey
+	base          http.RoundTripper
+	tokenRequests bool
+}
+
+func (t *dpopTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	scheme, accessToken, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+	if scheme != "DPoP" {
+		accessToken = ""
+	}
+	if scheme == "DPoP" || t.tokenRequests {
+		htu := req.URL.Scheme + "://" + req.URL.Host + req.URL.Path
+		proof, err := t.key.Proof(req.Method, htu, accessToken)
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Header.Set("DPoP", proof)
+	}
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
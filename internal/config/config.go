@@ -1,25 +1,181 @@
 package config
 
 import (
+	"encoding/base64"
 	"fmt"
-	"log"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"authorization_flow_keycloak/internal/auth"
 
 	"github.com/joho/godotenv"
 	"github.com/redis/go-redis/v9"
+	"gopkg.in/yaml.v3"
+)
+
+// Supported ways of resolving the tenant (Keycloak realm) of a request
+const (
+	TenantModeNone      = ""          // single realm taken from KEYCLOAK_REALM
+	TenantModeSubdomain = "subdomain" // realm.example.com
+	TenantModePath      = "path"      // /t/realm/...
+	TenantModeHeader    = "header"    // X-Tenant: realm
+)
+
+// Supported span exporters
+const (
+	TracingExporterNone = "none" // tracing disabled, trace context is still propagated
+	TracingExporterOTLP = "otlp" // OTLP over HTTP
 )
 
 type Config struct {
 	App         *AppConfig
 	Auth        *auth.Config
+	Session     *SessionConfig
+	Tenant      *TenantConfig
+	LegacyLogin *LegacyLoginConfig
+	Offline     *OfflineConfig
+	UMA         *UMAConfig
+	Policy      *PolicyConfig
+	Groups      *GroupsConfig
+	Proxy       *ProxyConfig
+	RateLimits  map[string]RateLimitRule // per route group: auth, verify, dashboard, api, proxy
+	Audit       *AuditConfig
+	Log         *LogConfig
+	Tracing     *TracingConfig
 	RedisClient *redis.Options
 }
 type AppConfig struct {
 	Port string
+	// TrustedProxies are the addresses or CIDR ranges of the reverse proxies
+	// whose X-Forwarded-For is believed for the client IP, and whose
+	// X-Forwarded-Proto and X-Forwarded-Host for the URL of DPoP proofs. The
+	// connection's address and the Host header are used when empty.
+	TrustedProxies []string
+	// MetricsToken is the bearer token Prometheus scrapes /metrics with,
+	// which is not served when it is empty
+	MetricsToken string
+}
+
+// SessionConfig configures browser sessions
+type SessionConfig struct {
+	// Refresh renews expired access tokens with the refresh token of the
+	// session instead of ending it
+	Refresh bool
+	// DPoPKeyEncryptionKey is the AES-256 key encrypting the DPoP private
+	// keys of sessions in Redis, required when KEYCLOAK_DPOP is enabled
+	DPoPKeyEncryptionKey []byte
+}
+
+// TenantConfig describes how requests are mapped to Keycloak realms
+type TenantConfig struct {
+	Mode   string   // one of the TenantMode* constants
+	Header string   // header carrying the realm when Mode is header
+	Realms []string // realms this server is allowed to serve
+}
+
+// LegacyLoginConfig enables the JSON password and API key login endpoints
+// for integrations that cannot follow the browser redirect flow
+type LegacyLoginConfig struct {
+	Enabled   bool
+	APIKeys   map[string]APIKey // hex SHA-256 of the API key -> integration
+	RateLimit int               // attempts per minute per client IP and per account
+}
+
+// APIKey is the integration an API key belongs to. The key is the client
+// secret of the integration's own Keycloak client, its session acts as
+// that client's service account.
+type APIKey struct {
+	Name     string
+	ClientID string
+}
+
+// OfflineConfig enables offline access consent for background jobs
+type OfflineConfig struct {
+	Enabled       bool
+	EncryptionKey []byte // AES-256 key encrypting stored offline tokens
+	// JobScope is the scope a job's bearer token needs to obtain access
+	// tokens of offline users
+	JobScope string
+}
+
+// UMAConfig maps routes to the Keycloak Authorization Services permissions
+// they require
+type UMAConfig struct {
+	Enabled  bool
+	Audience string // resource server client ID, the app's client when empty
+	// Permissions maps "METHOD /route" (relative to the tenant root, with gin
+	// parameters like :id) to the permissions that must all be granted
+	Permissions map[string][]auth.Permission
+	CacheTTL    time.Duration // how long decisions are cached per session
+}
+
+// PolicyConfig points to the local ABAC policy file, disabled when empty
+type PolicyConfig struct {
+	File string
+}
+
+// GroupsConfig configures group membership authorization
+type GroupsConfig struct {
+	Claim     string   // token claim holding the group paths
+	Dashboard []string // groups (and their subgroups) allowed on the dashboard, anyone when empty
+}
+
+// ProxyConfig lists the upstreams served in reverse proxy mode, read from
+// the YAML file of PROXY_CONFIG
+type ProxyConfig struct {
+	Upstreams []UpstreamConfig `yaml:"upstreams"`
+}
+
+// UpstreamConfig is an application proxied under a path prefix
+type UpstreamConfig struct {
+	Name        string `yaml:"name"`
+	Prefix      string `yaml:"prefix"`       // path prefix relative to the tenant root, e.g. /grafana
+	URL         string `yaml:"url"`          // upstream base URL
+	StripPrefix bool   `yaml:"strip_prefix"` // drop the tenant root and prefix from the upstream path
+	// Roles are the realm roles allowed on the upstream, any of them is
+	// enough. Every authenticated user is allowed when empty.
+	Roles []string `yaml:"roles"`
+	// PassAccessToken sends the user's access token as a bearer token,
+	// exchanged for TokenAudience first when set
+	PassAccessToken bool   `yaml:"pass_access_token"`
+	TokenAudience   string `yaml:"token_audience"`
+	// API answers requests without a session with 401 JSON instead of a
+	// redirect to the login page, for upstreams serving an API or the
+	// backend of a single page application
+	API bool `yaml:"api"`
+}
+
+// RateLimitRule allows Limit requests per Window, per client IP and per session
+type RateLimitRule struct {
+	Limit  int
+	Window time.Duration
+}
+
+// AuditConfig selects where audit events go, the application log when no
+// sink is configured
+type AuditConfig struct {
+	File        string // JSON lines file
+	RedisStream string // Redis Stream name
+	// Redact lists the personal data removed from events: email, ip, username
+	Redact []string
+}
+
+// LogConfig configures the structured logger
+type LogConfig struct {
+	Level  string // debug, info, warn or error
+	Format string // json or text
+}
+
+// TracingConfig configures OpenTelemetry tracing
+type TracingConfig struct {
+	Exporter    string  // one of the TracingExporter* constants
+	Endpoint    string  // OTLP/HTTP collector URL, the OTEL_EXPORTER_OTLP_* variables when empty
+	ServiceName string  // service.name resource attribute
+	SampleRatio float64 // share of new traces recorded, parent decisions are followed
 }
 
 func LoadFromEnv() (*Config, error) {
@@ -34,23 +190,74 @@ func LoadFromEnv() (*Config, error) {
 	err = godotenv.Load(envPath)
 
 	if err != nil {
-		log.Fatal("Error loading .env file", err)
+		return nil, fmt.Errorf("failed to load .env file: %w", err)
 	}
 	redisDB, err := strconv.Atoi(requireEnv("REDIS_DATABASE"))
 	if err != nil {
-		log.Fatal("failed to convert redis db")
+		return nil, fmt.Errorf("invalid REDIS_DATABASE: %w", err)
+	}
+	tenant, err := loadTenantConfig()
+	if err != nil {
+		return nil, err
+	}
+	authConfig := loadAuthConfig()
+	legacyLogin, err := loadLegacyLoginConfig(authConfig.ClientAuthMethod)
+	if err != nil {
+		return nil, err
+	}
+	session, err := loadSessionConfig(authConfig.DPoP)
+	if err != nil {
+		return nil, err
+	}
+	offline, err := loadOfflineConfig()
+	if err != nil {
+		return nil, err
+	}
+	uma, err := loadUMAConfig()
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := loadProxyConfig()
+	if err != nil {
+		return nil, err
+	}
+	rateLimits, err := loadRateLimits()
+	if err != nil {
+		return nil, err
+	}
+	tracing, err := loadTracingConfig()
+	if err != nil {
+		return nil, err
 	}
 	return &Config{
 		App: &AppConfig{
-			Port: requireEnv("APP_PORT"),
+			Port:           requireEnv("APP_PORT"),
+			TrustedProxies: splitList(getEnv("TRUSTED_PROXIES", "")),
+			MetricsToken:   getEnv("METRICS_TOKEN", ""),
 		},
-		Auth: &auth.Config{
-			BaseURL:      requireEnv("KEYCLOAK_URL"),
-			ClientID:     requireEnv("KEYCLOAK_CLIENT_ID"),
-			Realm:        requireEnv("KEYCLOAK_REALM"),
-			ClientSecret: requireEnv("KEYCLOAK_CLIENT_SECRET"),
-			RedirectURL:  requireEnv("KEYCLOAK_REDIRECT_URL"),
+		Auth:        authConfig,
+		Session:     session,
+		Tenant:      tenant,
+		LegacyLogin: legacyLogin,
+		Offline:     offline,
+		UMA:         uma,
+		Policy:      &PolicyConfig{File: getEnv("POLICY_FILE", "")},
+		Groups: &GroupsConfig{
+			Claim:     getEnv("GROUPS_CLAIM", "groups"),
+			Dashboard: splitList(getEnv("DASHBOARD_GROUPS", "")),
 		},
+		Proxy:      proxy,
+		RateLimits: rateLimits,
+		Audit: &AuditConfig{
+			File:        getEnv("AUDIT_FILE", ""),
+			RedisStream: getEnv("AUDIT_REDIS_STREAM", ""),
+			Redact:      splitList(getEnv("AUDIT_REDACT", "")),
+		},
+		Log: &LogConfig{
+			Level:  getEnv("LOG_LEVEL", "info"),
+			Format: getEnv("LOG_FORMAT", "json"),
+		},
+		Tracing: tracing,
 		RedisClient: &redis.Options{
 			Addr:     fmt.Sprintf("%s:%s", requireEnv("REDIS_HOST"), requireEnv("REDIS_PORT")),
 			Username: requireEnv("REDIS_USERNAME"),
@@ -60,6 +267,203 @@ func LoadFromEnv() (*Config, error) {
 	}, nil
 }
 
+func loadAuthConfig() *auth.Config {
+	cfg := &auth.Config{
+		BaseURL:          requireEnv("KEYCLOAK_URL"),
+		ClientID:         requireEnv("KEYCLOAK_CLIENT_ID"),
+		Realm:            requireEnv("KEYCLOAK_REALM"),
+		RedirectURL:      requireEnv("KEYCLOAK_REDIRECT_URL"),
+		ClientAuthMethod: getEnv("KEYCLOAK_CLIENT_AUTH_METHOD", auth.ClientAuthSecret),
+		DPoP:             getEnvBool("KEYCLOAK_DPOP", false),
+
+		Introspection:         getEnvBool("KEYCLOAK_INTROSPECTION", false),
+		IntrospectionCacheTTL: getEnvDuration("KEYCLOAK_INTROSPECTION_CACHE_TTL", 30*time.Second),
+
+		UserInfoClaims: splitList(getEnv("KEYCLOAK_USERINFO_CLAIMS",
+			"given_name,family_name,locale,picture,groups")),
+	}
+	// Only the credentials of the selected method are required
+	switch cfg.ClientAuthMethod {
+	case auth.ClientAuthPrivateKeyJWT:
+		cfg.ClientKeyFiles = splitList(requireEnv("KEYCLOAK_CLIENT_KEY_FILES"))
+	case auth.ClientAuthTLS:
+		cfg.ClientCertFile = requireEnv("KEYCLOAK_CLIENT_CERT_FILE")
+		cfg.ClientCertKeyFile = requireEnv("KEYCLOAK_CLIENT_CERT_KEY_FILE")
+	default:
+		cfg.ClientSecret = requireEnv("KEYCLOAK_CLIENT_SECRET")
+	}
+	return cfg
+}
+
+func loadTenantConfig() (*TenantConfig, error) {
+	mode := strings.ToLower(getEnv("TENANT_MODE", TenantModeNone))
+	switch mode {
+	case TenantModeNone, TenantModeSubdomain, TenantModePath, TenantModeHeader:
+	default:
+		return nil, fmt.Errorf("unsupported TENANT_MODE %q", mode)
+	}
+	// The default realm is always served, extra realms are opt-in
+	realms := []string{requireEnv("KEYCLOAK_REALM")}
+	realms = append(realms, splitList(getEnv("TENANT_REALMS", ""))...)
+	return &TenantConfig{
+		Mode:   mode,
+		Header: getEnv("TENANT_HEADER", "X-Tenant"),
+		Realms: realms,
+	}, nil
+}
+
+func loadLegacyLoginConfig(clientAuthMethod string) (*LegacyLoginConfig, error) {
+	// Keys are configured as name:sha256hex:client_id so the plain keys are never stored
+	apiKeys := make(map[string]APIKey)
+	for _, entry := range splitList(getEnv("LEGACY_API_KEYS", "")) {
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 || parts[0] == "" || len(parts[1]) != 64 || parts[2] == "" {
+			return nil, fmt.Errorf("invalid LEGACY_API_KEYS entry %q, expected name:sha256hex:client_id", entry)
+		}
+		apiKeys[strings.ToLower(parts[1])] = APIKey{Name: parts[0], ClientID: parts[2]}
+	}
+	rateLimit, err := strconv.Atoi(getEnv("LEGACY_LOGIN_RATE_LIMIT", "5"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LEGACY_LOGIN_RATE_LIMIT: %w", err)
+	}
+	enabled := getEnvBool("LEGACY_LOGIN_ENABLED", false)
+	// The password grant is sent through oauth2.Config, which only
+	// authenticates the client with its secret
+	if enabled && clientAuthMethod != auth.ClientAuthSecret {
+		return nil, fmt.Errorf("LEGACY_LOGIN_ENABLED requires KEYCLOAK_CLIENT_AUTH_METHOD=%s", auth.ClientAuthSecret)
+	}
+	return &LegacyLoginConfig{
+		Enabled:   enabled,
+		APIKeys:   apiKeys,
+		RateLimit: rateLimit,
+	}, nil
+}
+
+func loadSessionConfig(dpop bool) (*SessionConfig, error) {
+	key, err := getEnvKey("SESSION_DPOP_KEY")
+	if err != nil {
+		return nil, err
+	}
+	// DPoP keys are never stored in Redis unencrypted
+	if dpop && key == nil {
+		return nil, fmt.Errorf("SESSION_DPOP_KEY is required when KEYCLOAK_DPOP is enabled")
+	}
+	return &SessionConfig{
+		Refresh:              getEnvBool("SESSION_REFRESH", false),
+		DPoPKeyEncryptionKey: key,
+	}, nil
+}
+
+func loadOfflineConfig() (*OfflineConfig, error) {
+	// Offline access is only offered when a key to encrypt the tokens is set
+	key, err := getEnvKey("OFFLINE_TOKEN_KEY")
+	if err != nil || key == nil {
+		return &OfflineConfig{}, err
+	}
+	return &OfflineConfig{
+		Enabled:       true,
+		EncryptionKey: key,
+		JobScope:      getEnv("OFFLINE_JOB_SCOPE", "offline_jobs"),
+	}, nil
+}
+
+func loadUMAConfig() (*UMAConfig, error) {
+	// Entries are "METHOD /route=resource#scope", a route listed several
+	// times requires every permission
+	permissions := make(map[string][]auth.Permission)
+	for _, entry := range splitList(getEnv("UMA_PERMISSIONS", "")) {
+		route, raw, found := strings.Cut(entry, "=")
+		method, path, valid := strings.Cut(strings.TrimSpace(route), " ")
+		if !found || !valid || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid UMA_PERMISSIONS entry %q, expected METHOD /route=resource#scope", entry)
+		}
+		permission, err := auth.ParsePermission(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("invalid UMA_PERMISSIONS entry %q: %w", entry, err)
+		}
+		key := strings.ToUpper(method) + " " + path
+		permissions[key] = append(permissions[key], permission)
+	}
+	return &UMAConfig{
+		Enabled:     len(permissions) > 0,
+		Audience:    getEnv("UMA_AUDIENCE", ""),
+		Permissions: permissions,
+		CacheTTL:    getEnvDuration("UMA_CACHE_TTL", time.Minute),
+	}, nil
+}
+
+// reservedPrefixes are the routes of the service itself
+var reservedPrefixes = []string{"/auth", "/dashboard", "/api", "/logout", "/health", "/metrics"}
+
+func loadProxyConfig() (*ProxyConfig, error) {
+	cfg := &ProxyConfig{}
+	file := getEnv("PROXY_CONFIG", "")
+	if file == "" {
+		return cfg, nil
+	}
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PROXY_CONFIG: %w", err)
+	}
+	if err := yaml.Unmarshal(raw, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse PROXY_CONFIG: %w", err)
+	}
+	for i, upstream := range cfg.Upstreams {
+		prefix := strings.TrimSuffix(upstream.Prefix, "/")
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("upstream %q: prefix must start with /", upstream.Name)
+		}
+		for _, reserved := range reservedPrefixes {
+			if prefix == reserved || strings.HasPrefix(prefix, reserved+"/") {
+				return nil, fmt.Errorf("upstream %q: prefix %s is used by the service", upstream.Name, reserved)
+			}
+		}
+		if target, err := url.Parse(upstream.URL); err != nil || target.Scheme == "" || target.Host == "" {
+			return nil, fmt.Errorf("upstream %q: invalid url %q", upstream.Name, upstream.URL)
+		}
+		cfg.Upstreams[i].Prefix = prefix
+	}
+	return cfg, nil
+}
+
+func loadRateLimits() (map[string]RateLimitRule, error) {
+	// Entries are group=limit/window, e.g. auth=30/1m
+	rules := make(map[string]RateLimitRule)
+	for _, entry := range splitList(getEnv("RATE_LIMITS", "auth=30/1m")) {
+		group, rule, found := strings.Cut(entry, "=")
+		rawLimit, rawWindow, valid := strings.Cut(rule, "/")
+		limit, err := strconv.Atoi(rawLimit)
+		if !found || !valid || err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid RATE_LIMITS entry %q, expected group=limit/window", entry)
+		}
+		window, err := time.ParseDuration(rawWindow)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("invalid RATE_LIMITS window in %q", entry)
+		}
+		rules[strings.TrimSpace(group)] = RateLimitRule{Limit: limit, Window: window}
+	}
+	return rules, nil
+}
+
+func loadTracingConfig() (*TracingConfig, error) {
+	exporter := strings.ToLower(getEnv("TRACING_EXPORTER", TracingExporterNone))
+	switch exporter {
+	case TracingExporterNone, TracingExporterOTLP:
+	default:
+		return nil, fmt.Errorf("unsupported TRACING_EXPORTER %q", exporter)
+	}
+	sampleRatio, err := strconv.ParseFloat(getEnv("TRACING_SAMPLE_RATIO", "1"), 64)
+	if err != nil || sampleRatio < 0 || sampleRatio > 1 {
+		return nil, fmt.Errorf("invalid TRACING_SAMPLE_RATIO, expected a number between 0 and 1")
+	}
+	return &TracingConfig{
+		Exporter:    exporter,
+		Endpoint:    getEnv("TRACING_OTLP_ENDPOINT", ""),
+		ServiceName: getEnv("TRACING_SERVICE_NAME", "authorization-flow-keycloak"),
+		SampleRatio: sampleRatio,
+	}, nil
+}
+
 func requireEnv(key string) string {
 	value := os.Getenv(key)
 	if value == "" {
@@ -67,3 +471,53 @@ func requireEnv(key string) string {
 	}
 	return value
 }
+
+// getEnv returns the value of an optional variable or the fallback when unset
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getEnvKey decodes an AES-256 key given as 32 bytes in base64, nil when unset
+func getEnvKey(key string) ([]byte, error) {
+	encoded := getEnv(key, "")
+	if encoded == "" {
+		return nil, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(decoded) != 32 {
+		return nil, fmt.Errorf("%s must be 32 bytes encoded in base64", key)
+	}
+	return decoded, nil
+}
+
+// getEnvBool parses an optional boolean variable
+func getEnvBool(key string, fallback bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// getEnvDuration parses an optional duration variable such as "30s"
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// splitList parses a comma separated variable, ignoring empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
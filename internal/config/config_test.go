@@ -0,0 +1,103 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"authorization_flow_keycloak/internal/auth"
+)
+
+func TestLoadLegacyLoginConfig(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	tests := []struct {
+		name       string
+		env        map[string]string
+		authMethod string
+		want       map[string]APIKey
+		wantErr    string
+	}{
+		{
+			name:       "api keys",
+			env:        map[string]string{"LEGACY_LOGIN_ENABLED": "true", "LEGACY_API_KEYS": "billing:" + strings.ToUpper(hash) + ":billing-client"},
+			authMethod: auth.ClientAuthSecret,
+			want:       map[string]APIKey{hash: {Name: "billing", ClientID: "billing-client"}},
+		},
+		{
+			name:       "entry without client",
+			env:        map[string]string{"LEGACY_API_KEYS": "billing:" + hash},
+			authMethod: auth.ClientAuthSecret,
+			wantErr:    `"billing:` + hash + `"`,
+		},
+		{
+			name:       "short hash",
+			env:        map[string]string{"LEGACY_API_KEYS": "billing:abc:billing-client"},
+			authMethod: auth.ClientAuthSecret,
+			wantErr:    "billing:abc:billing-client",
+		},
+		{
+			name:       "private_key_jwt",
+			env:        map[string]string{"LEGACY_LOGIN_ENABLED": "true"},
+			authMethod: auth.ClientAuthPrivateKeyJWT,
+			wantErr:    "KEYCLOAK_CLIENT_AUTH_METHOD",
+		},
+		{
+			name:       "tls_client_auth while disabled",
+			authMethod: auth.ClientAuthTLS,
+			want:       map[string]APIKey{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LEGACY_LOGIN_ENABLED", "")
+			t.Setenv("LEGACY_API_KEYS", "")
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			cfg, err := loadLegacyLoginConfig(tt.authMethod)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to mention %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cfg.APIKeys, tt.want) {
+				t.Fatalf("APIKeys = %v, want %v", cfg.APIKeys, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadProxyConfigReservedPrefixes(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		wantErr bool
+	}{
+		{"/grafana", false},
+		{"/metrics", true},
+		{"/metrics/node", true},
+		{"/metrics-exporter", false},
+		{"/debug/pprof", false},
+		{"/health", true},
+		{"/auth", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "proxy.yaml")
+			content := "upstreams:\n  - name: app\n    prefix: " + tt.prefix + "\n    url: http://app:8080\n"
+			if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("PROXY_CONFIG", file)
+			_, err := loadProxyConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadProxyConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
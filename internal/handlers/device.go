@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"authorization_flow_keycloak/internal/auth"
+	"authorization_flow_keycloak/internal/metrics"
+	"authorization_flow_keycloak/internal/middleware"
+	"authorization_flow_keycloak/internal/store"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+)
+
+// deviceSlowDownStep is added to the polling interval on every slow_down (RFC 8628)
+const deviceSlowDownStep = 5
+
+// deviceScopes are requested for device logins, matching the browser login
+var deviceScopes = []string{"openid", "profile", "email"}
+
+type deviceTokenRequest struct {
+	DeviceCode string `form:"device_code" json:"device_code" binding:"required"`
+	// Session asks for a browser session cookie instead of the raw tokens
+	Session bool `form:"session" json:"session"`
+}
+
+// StartDeviceHandler starts a device authorization for CLI clients.
+//
+// Returns:
+// - 200: device_code, user_code, verification_uri, expires_in and interval
+// - 502: Bad Gateway if Keycloak refuses the device authorization
+func (a *AuthHandler) StartDeviceHandler(c *gin.Context) {
+	authorization, err := a.startDeviceAuthorization(c)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to start device authorization"})
+		return
+	}
+	c.JSON(http.StatusOK, authorization)
+}
+
+// ShowDevicePage starts a device authorization and shows the user code, for
+// devices with a screen but no keyboard. The page polls DeviceTokenHandler
+// and continues to the dashboard once the user approved it on another device.
+func (a *AuthHandler) ShowDevicePage(c *gin.Context) {
+	authorization, err := a.startDeviceAuthorization(c)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to start device authorization"})
+		return
+	}
+	c.HTML(http.StatusOK, "device.html", gin.H{
+		"userCode":                authorization.UserCode,
+		"verificationURI":         authorization.VerificationURI,
+		"verificationURIComplete": authorization.VerificationURIComplete,
+		"deviceCode":              authorization.DeviceCode,
+		"interval":                authorization.Interval,
+		"pollURL":                 middleware.BasePath(c) + "/auth/device/token",
+	})
+}
+
+func (a *AuthHandler) startDeviceAuthorization(c *gin.Context) (*auth.DeviceAuthorization, error) {
+	authorization, err := middleware.AuthClient(c).DeviceAuthorization(c, deviceScopes...)
+	if err != nil {
+		return nil, err
+	}
+	// Track the polling interval so fast pollers get slow_down from us too
+	data := store.DeviceData{Interval: authorization.Interval}
+	// Browser sessions are DPoP bound like any other session. The key is
+	// created once, every poll of the authorization must prove the same key.
+	dpopKey, err := a.newDPoPKey(c)
+	if err != nil {
+		return nil, err
+	}
+	if dpopKey != nil {
+		if err := a.storeDPoPKey(c, dpopKey); err != nil {
+			return nil, err
+		}
+		data.DPoPKeyID = dpopKey.ID()
+	}
+	ttl := time.Duration(authorization.ExpiresIn) * time.Second
+	if err := a.deviceStore.WithTenant(middleware.Tenant(c)).SetDevice(
+		c, authorization.DeviceCode, data, ttl); err != nil {
+		return nil, err
+	}
+	metrics.LoginStarted("device")
+	return authorization, nil
+}
+
+// DeviceTokenHandler polls the token endpoint once for a device authorization.
+// Devices must respect the returned interval and add 5 seconds on slow_down.
+//
+// Returns:
+// - 200: the tokens, or {"redirect": ...} after creating a session when session=true
+// - 400: authorization_pending, slow_down, access_denied or expired_token (RFC 8628)
+// - 500: Internal Server Error if the device authorization cannot be loaded
+// - 502: Bad Gateway if the token endpoint fails
+func (a *AuthHandler) DeviceTokenHandler(c *gin.Context) {
+	var request deviceTokenRequest
+	if err := c.ShouldBind(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+		return
+	}
+	deviceStore := a.deviceStore.WithTenant(middleware.Tenant(c))
+	data, err := deviceStore.GetDevice(c, request.DeviceCode)
+	if errors.Is(err, store.ErrDeviceNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": auth.DeviceExpiredToken})
+		return
+	}
+	if err != nil {
+		// The authorization may still be pending, the device polls again
+		slog.WarnContext(c, "failed to load device authorization", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load device authorization"})
+		return
+	}
+	// Polling faster than allowed is answered without bothering Keycloak
+	now := time.Now()
+	if now.Before(data.NextPoll) {
+		a.slowDown(c, deviceStore, request.DeviceCode, data)
+		return
+	}
+
+	var dpopKey *auth.DPoPKey
+	if request.Session {
+		dpopKey, err = a.deviceDPoPKey(c, data)
+		if errors.Is(err, store.ErrDPoPKeyNotFound) {
+			// The key expired with a device that stopped polling
+			_ = deviceStore.DeleteDevice(c, request.DeviceCode)
+			c.JSON(http.StatusBadRequest, gin.H{"error": auth.DeviceExpiredToken})
+			return
+		}
+		if err != nil {
+			slog.WarnContext(c, "failed to load device DPoP key", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load device authorization"})
+			return
+		}
+	}
+	oauthToken, err := middleware.AuthClient(c).PollDeviceToken(c, request.DeviceCode, dpopKey)
+	var tokenErr *auth.TokenError
+	if errors.As(err, &tokenErr) {
+		switch tokenErr.Code {
+		case auth.DeviceAuthorizationPending:
+			data.NextPoll = now.Add(time.Duration(data.Interval) * time.Second)
+			_ = deviceStore.UpdateDevice(c, request.DeviceCode, *data)
+			a.touchDeviceDPoPKey(c, data)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":    auth.DeviceAuthorizationPending,
+				"interval": data.Interval,
+			})
+		case auth.DeviceSlowDown:
+			a.slowDown(c, deviceStore, request.DeviceCode, data)
+		default:
+			// access_denied, expired_token: the authorization is over
+			_ = deviceStore.DeleteDevice(c, request.DeviceCode)
+			a.deleteDeviceDPoPKey(c, data)
+			recordLogin(c, "device", nil, tokenErr.Code)
+			c.JSON(http.StatusBadRequest, gin.H{"error": tokenErr.Code})
+		}
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to poll token endpoint"})
+		return
+	}
+	_ = deviceStore.DeleteDevice(c, request.DeviceCode)
+
+	if !request.Session {
+		// The raw tokens are not DPoP bound, the key is not needed
+		a.deleteDeviceDPoPKey(c, data)
+		recordLogin(c, "device", nil, "")
+		c.JSON(http.StatusOK, deviceTokenResponse(oauthToken))
+		return
+	}
+	userInfo, err := a.validateAndGetClaimsIDToken(c, oauthToken)
+	if err != nil {
+		recordLogin(c, "device", nil, "invalid_id_token")
+		c.JSON(http.StatusInternalServerError,
+			gin.H{"error": "Failed to validate and get claims id token"})
+		return
+	}
+	if err := a.createSession(c, oauthToken, userInfo, dpopKey); err != nil {
+		recordLogin(c, "device", userInfo, "session_error")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store session"})
+		return
+	}
+	recordLogin(c, "device", userInfo, "")
+	c.JSON(http.StatusOK, gin.H{"redirect": middleware.BasePath(c) + "/dashboard"})
+}
+
+// deviceTokenResponse is the token response of a device without a session.
+// expires_in is left out when Keycloak did not send one.
+func deviceTokenResponse(oauthToken *oauth2.Token) gin.H {
+	response := gin.H{
+		"access_token":  oauthToken.AccessToken,
+		"refresh_token": oauthToken.RefreshToken,
+		"id_token":      oauthToken.Extra("id_token"),
+		"token_type":    oauthToken.TokenType,
+	}
+	if !oauthToken.Expiry.IsZero() {
+		response["expires_in"] = int(time.Until(oauthToken.Expiry).Round(time.Second).Seconds())
+	}
+	return response
+}
+
+// deviceDPoPKey loads the DPoP key created with a device authorization, nil
+// when DPoP is disabled
+func (a *AuthHandler) deviceDPoPKey(c *gin.Context, data *store.DeviceData) (*auth.DPoPKey, error) {
+	if data.DPoPKeyID == "" {
+		return nil, nil
+	}
+	jwk, err := a.dpopStore.WithTenant(middleware.Tenant(c)).GetKey(c, data.DPoPKeyID)
+	if err != nil {
+		return nil, err
+	}
+	return auth.ParseDPoPKey(jwk)
+}
+
+// touchDeviceDPoPKey keeps the DPoP key of a pending authorization alive
+// while the device polls
+func (a *AuthHandler) touchDeviceDPoPKey(c *gin.Context, data *store.DeviceData) {
+	if data.DPoPKeyID == "" {
+		return
+	}
+	if err := a.dpopStore.WithTenant(middleware.Tenant(c)).TouchKey(c, data.DPoPKeyID); err != nil {
+		slog.WarnContext(c, "failed to extend device DPoP key", "error", err)
+	}
+}
+
+// deleteDeviceDPoPKey removes the DPoP key of an authorization that did not
+// end in a session
+func (a *AuthHandler) deleteDeviceDPoPKey(c *gin.Context, data *store.DeviceData) {
+	if data.DPoPKeyID == "" {
+		return
+	}
+	if err := a.dpopStore.WithTenant(middleware.Tenant(c)).DeleteKey(c, data.DPoPKeyID); err != nil {
+		slog.WarnContext(c, "failed to delete device DPoP key", "error", err)
+	}
+}
+
+// slowDown increases the polling interval of a device and tells it so
+func (a *AuthHandler) slowDown(
+	c *gin.Context,
+	deviceStore store.DeviceStore,
+	deviceCode string,
+	data *store.DeviceData,
+) {
+	data.Interval += deviceSlowDownStep
+	data.NextPoll = time.Now().Add(time.Duration(data.Interval) * time.Second)
+	_ = deviceStore.UpdateDevice(c, deviceCode, *data)
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error":    auth.DeviceSlowDown,
+		"interval": data.Interval,
+	})
+}
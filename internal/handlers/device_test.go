@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"authorization_flow_keycloak/internal/store"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+)
+
+func TestDeviceTokenResponse(t *testing.T) {
+	tests := []struct {
+		name          string
+		expiry        time.Time
+		wantExpiresIn interface{}
+	}{
+		{name: "with expiry", expiry: time.Now().Add(5 * time.Minute), wantExpiresIn: 300},
+		{name: "without expiry", wantExpiresIn: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := &oauth2.Token{AccessToken: "access", TokenType: "Bearer", Expiry: tt.expiry}
+			response := deviceTokenResponse(token)
+			expiresIn, ok := response["expires_in"]
+			if tt.wantExpiresIn == nil {
+				if ok {
+					t.Fatalf("expires_in = %v, want it omitted", expiresIn)
+				}
+				return
+			}
+			if expiresIn != tt.wantExpiresIn {
+				t.Fatalf("expires_in = %v, want %v", expiresIn, tt.wantExpiresIn)
+			}
+			if response["access_token"] != "access" {
+				t.Fatalf("access_token = %v", response["access_token"])
+			}
+		})
+	}
+}
+
+// failingDeviceStore answers every GetDevice with err
+type failingDeviceStore struct {
+	store.DeviceStore
+	err error
+}
+
+func (s *failingDeviceStore) GetDevice(context.Context, string) (*store.DeviceData, error) {
+	return nil, s.err
+}
+
+func (s *failingDeviceStore) WithTenant(string) store.DeviceStore {
+	return s
+}
+
+func TestDeviceTokenHandlerStoreErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantError  string
+	}{
+		{name: "authorization expired", err: store.ErrDeviceNotFound, wantStatus: http.StatusBadRequest, wantError: `"expired_token"`},
+		{name: "store down", err: errors.New("failed to get device data: connection refused"), wantStatus: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &AuthHandler{deviceStore: &failingDeviceStore{err: tt.err}}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/device/token", handler.DeviceTokenHandler)
+			body := url.Values{"device_code": {"device-1"}}.Encode()
+			r := httptest.NewRequest(http.MethodPost, "/device/token", strings.NewReader(body))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Body.String(); tt.wantError != "" && !strings.Contains(got, tt.wantError) {
+				t.Fatalf("body = %s, want %s", got, tt.wantError)
+			} else if tt.wantError == "" && strings.Contains(got, "expired_token") {
+				t.Fatalf("body = %s, a store failure must not end the authorization", got)
+			}
+		})
+	}
+}
@@ -5,33 +5,48 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 
+	"authorization_flow_keycloak/internal/audit"
 	"authorization_flow_keycloak/internal/auth"
 	"authorization_flow_keycloak/internal/constant"
+	"authorization_flow_keycloak/internal/logging"
+	"authorization_flow_keycloak/internal/metrics"
+	"authorization_flow_keycloak/internal/middleware"
 	"authorization_flow_keycloak/internal/store"
 
+	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/gin-gonic/gin"
 	"golang.org/x/oauth2"
 )
 
+// AuthHandler serves the login flow of every tenant. The realm specific
+// auth client is taken from the request context set by the tenant resolver,
+// and stores are scoped to the realm before use.
 type AuthHandler struct {
-	authClient   *auth.Client
 	authStore    store.AuthStore
 	sessionStore store.SessionStore
+	dpopStore    store.DPoPStore
+	deviceStore  store.DeviceStore
+	offlineStore store.OfflineTokenStore // nil when offline access is disabled
 }
 
 func NewAuthHandler(
-	authClient *auth.Client,
 	authStore store.AuthStore,
 	sessionStore store.SessionStore,
+	dpopStore store.DPoPStore,
+	deviceStore store.DeviceStore,
+	offlineStore store.OfflineTokenStore,
 ) *AuthHandler {
 	return &AuthHandler{
-		authClient:   authClient,
 		authStore:    authStore,
 		sessionStore: sessionStore,
+		dpopStore:    dpopStore,
+		deviceStore:  deviceStore,
+		offlineStore: offlineStore,
 	}
 }
 
@@ -47,73 +62,181 @@ func generateRandomSecureString() (string, error) {
 // LoginHandler initiates the OAuth2 authorization code flow with Keycloak.
 // It generates a secure state parameter to prevent CSRF attacks and stores it
 // in Redis for later verification during the callback phase.
+// With ?offline=true, sent by the offline consent page, it also requests the
+// offline_access scope so background jobs can act on behalf of the user.
 //
 // Returns:
 // - 302: Redirects to Keycloak login page
 // - 500: Internal Server Error if state generation or storage fails
+// - 502: Bad Gateway if the pushed authorization request fails
 func (a *AuthHandler) LoginHandler(c *gin.Context) {
+	metrics.LoginStarted("oidc")
 	state, err := generateRandomSecureString()
 	if err != nil {
+		metrics.LoginFailed("oidc", "state")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate state"})
 		return
 	}
 
 	// Store state in session for later verification
-	if err = a.authStore.SetState(c, state); err != nil {
+	if err = a.authStore.WithTenant(middleware.Tenant(c)).SetState(c, state); err != nil {
+		metrics.LoginFailed("oidc", "state")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save session"})
 		return
 	}
-	// Build authentication URL
-	authURL := a.authClient.Oauth.AuthCodeURL(
+	scope := "openid profile email"
+	if a.offlineStore != nil && c.Query("offline") == "true" {
+		scope += " " + oidc.ScopeOfflineAccess
+	}
+	// Build authentication URL, pushing the parameters to Keycloak first
+	// when the realm supports PAR
+	authURL, err := middleware.AuthClient(c).AuthorizationURL(
+		c,
 		state,
 		oauth2.SetAuthURLParam("response_type", "code"),
-		oauth2.SetAuthURLParam("scope", "openid profile email"),
+		oauth2.SetAuthURLParam("scope", scope),
 	)
+	if err != nil {
+		metrics.LoginFailed("oidc", "authorization_request")
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to create authorization request"})
+		return
+	}
 
 	// Redirect to Keycloak login page
 	c.Redirect(http.StatusTemporaryRedirect, authURL)
 }
 
+// JWKSHandler publishes the public client assertion keys so Keycloak can
+// verify private_key_jwt assertions ("Use JWKS URL" in the client credentials tab)
+func (a *AuthHandler) JWKSHandler(c *gin.Context) {
+	jwks, err := middleware.AuthClient(c).PublicJWKS()
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No client keys configured"})
+		return
+	}
+	c.JSON(http.StatusOK, jwks)
+}
+
 // Add this method to server.go
 func (a *AuthHandler) ShowLoginPage(c *gin.Context) {
-	c.HTML(http.StatusOK, "login.html", nil)
+	data := gin.H{
+		"loginURL": middleware.BasePath(c) + "/auth/login",
+	}
+	if a.offlineStore != nil {
+		data["offlineURL"] = middleware.BasePath(c) + "/auth/offline"
+	}
+	c.HTML(http.StatusOK, "login.html", data)
+}
+
+// ShowOfflineConsentPage explains what offline access allows and lets the
+// user opt in before logging in with the offline_access scope
+func (a *AuthHandler) ShowOfflineConsentPage(c *gin.Context) {
+	c.HTML(http.StatusOK, "offline.html", gin.H{
+		"acceptURL":  middleware.BasePath(c) + "/auth/login?offline=true",
+		"declineURL": middleware.BasePath(c) + "/auth/login",
+	})
 }
 func (a *AuthHandler) CallbackHandler(c *gin.Context) {
 	if err := a.validateStateSession(c); err != nil {
+		slog.WarnContext(c, "callback failed", "stage", "state", "error", err)
+		recordLogin(c, "oidc", nil, "invalid_state")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to validate state session"})
 		return
 	}
-	oauthToken, err := a.tokenExchange(c)
+	// Bind the session tokens to a fresh key pair when DPoP is enabled
+	dpopKey, err := a.newDPoPKey(c)
+	if err != nil {
+		slog.ErrorContext(c, "callback failed", "stage", "dpop_key", "error", err)
+		recordLogin(c, "oidc", nil, "dpop_key_failed")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create DPoP key"})
+		return
+	}
+	oauthToken, err := a.tokenExchange(c, dpopKey)
 	if err != nil {
+		slog.WarnContext(c, "callback failed", "stage", "token_exchange", "error", err)
+		recordLogin(c, "oidc", nil, "token_exchange_failed")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to exchange token"})
 		return
 	}
 	userInfo, err := a.validateAndGetClaimsIDToken(c, oauthToken)
 	if err != nil {
+		slog.WarnContext(c, "callback failed", "stage", "id_token", "error", err)
+		recordLogin(c, "oidc", nil, "invalid_id_token")
 		c.JSON(http.StatusInternalServerError,
 			gin.H{"error": "Failed to validate and get claims id token"})
 		return
 	}
+	if err := a.createSession(c, oauthToken, userInfo, dpopKey); err != nil {
+		slog.ErrorContext(c, "callback failed", "stage", "session", "error", err)
+		recordLogin(c, "oidc", userInfo, "session_error")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store session"})
+		return
+	}
+	recordLogin(c, "oidc", userInfo, "")
+
+	// Redirect to dashboard using Gin's redirect method
+	c.Redirect(http.StatusTemporaryRedirect, middleware.BasePath(c)+"/dashboard")
+}
+
+// createSession stores a new session for the tokens of an authenticated user
+// and sets the session cookie. It is shared by every login flow.
+func (a *AuthHandler) createSession(
+	c *gin.Context,
+	oauthToken *oauth2.Token,
+	userInfo *oidcClaims,
+	dpopKey *auth.DPoPKey,
+) error {
 	sessionID, err := generateRandomSecureString()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate session ID"})
-		return
+		return fmt.Errorf("failed to generate session ID: %w", err)
+	}
+	csrfToken, err := middleware.NewCSRFToken()
+	if err != nil {
+		return fmt.Errorf("failed to generate CSRF token: %w", err)
 	}
 	// Create session data
 	sessionData := store.SessionData{
-		AccessToken: oauthToken.AccessToken, // From Keycloak
+		Realm:        middleware.Tenant(c),
+		AccessToken:  oauthToken.AccessToken,  // From Keycloak
+		RefreshToken: oauthToken.RefreshToken, // Used to renew the access token
+		CSRFToken:    csrfToken,
 		UserInfo: store.UserInfo{
+			Subject:  userInfo.Subject,
 			Username: userInfo.Username,
 			Email:    userInfo.Email,
 		},
 		CreatedAt: time.Now(),
 	}
-	log.Println("HEREEE : ", sessionData.CreatedAt)
+	if dpopKey != nil {
+		// Keep the key the tokens are bound to for later refreshes
+		if err := a.storeDPoPKey(c, dpopKey); err != nil {
+			return err
+		}
+		sessionData.DPoPKeyID = dpopKey.ID()
+	}
+	// Keep the offline token for background jobs when the user consented to it
+	if a.offlineStore != nil && grantedScope(oauthToken, oidc.ScopeOfflineAccess) {
+		err := a.offlineStore.WithTenant(sessionData.Realm).Set(c, userInfo.Subject, oauthToken.RefreshToken)
+		if err != nil {
+			return err
+		}
+		sessionData.OfflineAccess = true
+	}
+	// Enrich the session with the profile claims of the UserInfo endpoint,
+	// the ID token claims are enough to continue when it is unavailable
+	userInfoClaims, err := middleware.AuthClient(c).UserInfo(c, oauthToken.AccessToken, dpopKey)
+	if err == nil {
+		err = sessionData.UserInfo.ReplaceClaims(userInfoClaims)
+	}
+	if err != nil {
+		slog.WarnContext(c, "failed to load user info", "error", err)
+	}
 	// Store session
-	if err := a.sessionStore.Set(c, sessionID, sessionData); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store session"})
-		return
+	if err := a.sessionStore.WithTenant(sessionData.Realm).Set(c, sessionID, sessionData); err != nil {
+		return err
 	}
+	logging.SetSession(c, sessionID)
+	logging.SetSubject(c, userInfo.Subject)
 	// Note: Gin handles SameSite through the Config struct
 	c.SetSameSite(http.SameSiteStrictMode)
 	// Set secure session cookie using Gin's methods
@@ -121,14 +244,32 @@ func (a *AuthHandler) CallbackHandler(c *gin.Context) {
 		"session_id",                  // name
 		sessionID,                     // value
 		int(constant.SessionDuration), // maxAge in seconds
-		"/",                           // path
+		middleware.CookiePath(c),      // path (scoped to the tenant in path mode)
 		"",                            // domain (empty means default to current domain)
 		true,                          // Set secure to false for HTTP development
 		true,                          // httpOnly (prevents JavaScript access)
 	)
+	return nil
+}
 
-	// Redirect to dashboard using Gin's redirect method
-	c.Redirect(http.StatusTemporaryRedirect, "/dashboard")
+// LogoutHandler ends the current session. Deleting it from the session store
+// also revokes its tokens at Keycloak in the background. It is a POST route
+// behind RequireAuth and RequireCSRF so other sites cannot log users out.
+//
+// Returns:
+// - 303: Redirects to the login page
+func (a *AuthHandler) LogoutHandler(c *gin.Context) {
+	// Only a session that was actually ended is audited
+	if sessionID, err := c.Cookie("session_id"); err == nil && sessionID != "" {
+		if err := a.sessionStore.WithTenant(middleware.Tenant(c)).Delete(c, sessionID); err != nil {
+			slog.WarnContext(c, "failed to delete session", "error", err)
+			middleware.Audit(c, audit.Event{Type: audit.TypeLogout, Outcome: audit.OutcomeFailure, Reason: "store_error"})
+		} else {
+			middleware.Audit(c, audit.Event{Type: audit.TypeLogout, Outcome: audit.OutcomeSuccess})
+		}
+	}
+	c.SetCookie("session_id", "", -1, middleware.CookiePath(c), "", true, true)
+	c.Redirect(http.StatusSeeOther, middleware.BasePath(c)+"/")
 }
 func (a *AuthHandler) validateStateSession(c *gin.Context) error {
 	// Get state from callback parameters
@@ -137,8 +278,9 @@ func (a *AuthHandler) validateStateSession(c *gin.Context) error {
 		return errors.New("missing state parameter in callback")
 	}
 
-	// Retrieve stored state from Redis
-	storedState, err := a.authStore.GetState(c, stateParam)
+	// Retrieve stored state from Redis, a state issued for another tenant is not found
+	authStore := a.authStore.WithTenant(middleware.Tenant(c))
+	storedState, err := authStore.GetState(c, stateParam)
 	if err != nil {
 		return fmt.Errorf("failed to retrieve stored state: %w", err)
 	}
@@ -149,28 +291,80 @@ func (a *AuthHandler) validateStateSession(c *gin.Context) error {
 	}
 
 	// Clean up used state from store
-	if err = a.authStore.DeleteState(c, storedState); err != nil {
-		log.Printf("Warning: failed to delete used state: %v", err)
+	if err = authStore.DeleteState(c, storedState); err != nil {
+		slog.WarnContext(c, "failed to delete used state", "error", err)
 	}
 
 	return nil
 }
-func (a *AuthHandler) tokenExchange(c *gin.Context) (*oauth2.Token, error) {
+
+// newDPoPKey generates the DPoP key of a new session, returning nil when the
+// realm does not use DPoP. createSession persists it once tokens are issued.
+func (a *AuthHandler) newDPoPKey(c *gin.Context) (*auth.DPoPKey, error) {
+	if !middleware.AuthClient(c).DPoPEnabled() {
+		return nil, nil
+	}
+	return auth.NewDPoPKey()
+}
+
+// storeDPoPKey persists a DPoP key in the tenant of the request
+func (a *AuthHandler) storeDPoPKey(c *gin.Context, dpopKey *auth.DPoPKey) error {
+	jwk, err := dpopKey.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	return a.dpopStore.WithTenant(middleware.Tenant(c)).SetKey(c, dpopKey.ID(), jwk)
+}
+
+func (a *AuthHandler) tokenExchange(c *gin.Context, dpopKey *auth.DPoPKey) (*oauth2.Token, error) {
 	authorizationCode := c.Query("code")
 	if authorizationCode == "" {
 		return nil, errors.New("authorizationCode is required")
 	}
-	opts := []oauth2.AuthCodeOption{
-		oauth2.SetAuthURLParam("grant_type", "authorization_code"),
-	}
-	oauth2Token, err := a.authClient.Oauth.Exchange(c, authorizationCode, opts...)
+	oauth2Token, err := middleware.AuthClient(c).Exchange(c, authorizationCode, dpopKey)
 	if err != nil {
 		return nil, err
 	}
 	return oauth2Token, nil
 }
 
+// recordLogin records a login attempt in the audit log and the login
+// metrics, reason is empty on success and userInfo nil while the user is
+// still unknown. Reasons are metric labels and must be constants.
+func recordLogin(c *gin.Context, method string, userInfo *oidcClaims, reason string) {
+	event := audit.Event{
+		Type:    audit.TypeLogin,
+		Outcome: audit.OutcomeSuccess,
+		Method:  method,
+		Reason:  reason,
+	}
+	if reason != "" {
+		event.Outcome = audit.OutcomeFailure
+		metrics.LoginFailed(method, reason)
+	} else {
+		metrics.LoginCompleted(method)
+	}
+	if userInfo != nil {
+		event.Subject = userInfo.Subject
+		event.Username = userInfo.Username
+		event.Email = userInfo.Email
+	}
+	middleware.Audit(c, event)
+}
+
+// grantedScope reports whether the token response grants the scope
+func grantedScope(token *oauth2.Token, scope string) bool {
+	granted, _ := token.Extra("scope").(string)
+	for _, s := range strings.Fields(granted) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
 type oidcClaims struct {
+	Subject  string `json:"sub"`
 	Email    string `json:"email"`
 	Username string `json:"preferred_username"`
 }
@@ -184,7 +378,7 @@ func (a *AuthHandler) validateAndGetClaimsIDToken(
 		return nil, errors.New("no ID token found")
 	}
 	// Verify the ID token
-	idToken, err := a.authClient.OIDC.Verify(c.Request.Context(), rawIDToken)
+	idToken, err := middleware.AuthClient(c).OIDC.Verify(c.Request.Context(), rawIDToken)
 	if err != nil {
 		return nil, errors.New("failed to verify ID token")
 	}
@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"authorization_flow_keycloak/internal/auth"
+	"authorization_flow_keycloak/internal/config"
+	"authorization_flow_keycloak/internal/metrics"
+	"authorization_flow_keycloak/internal/middleware"
+	"authorization_flow_keycloak/internal/store"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+)
+
+// legacyRateWindow is the window LegacyLoginConfig.RateLimit applies to
+const legacyRateWindow = time.Minute
+
+type passwordLoginRequest struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type apiKeyLoginRequest struct {
+	APIKey string `json:"api_key" binding:"required"`
+}
+
+// LegacyLoginHandler serves the JSON login endpoints for integrations that can
+// only send a username/password or a static API key. Both create a normal
+// session cookie, are rate limited per client IP and account, and every
+// attempt is recorded in the audit log.
+type LegacyLoginHandler struct {
+	*AuthHandler
+	config  *config.LegacyLoginConfig
+	limiter store.RateLimiter
+}
+
+func NewLegacyLoginHandler(
+	authHandler *AuthHandler,
+	cfg *config.LegacyLoginConfig,
+	limiter store.RateLimiter,
+) *LegacyLoginHandler {
+	return &LegacyLoginHandler{
+		AuthHandler: authHandler,
+		config:      cfg,
+		limiter:     limiter,
+	}
+}
+
+// PasswordLoginHandler logs a user in with the resource owner password grant.
+//
+// Returns:
+// - 200: session created, the session cookie is set
+// - 400: Bad Request if username or password is missing
+// - 401: Unauthorized if Keycloak rejects the credentials
+// - 429: Too Many Requests with Retry-After when rate limited
+// - 502: Bad Gateway if the token endpoint fails
+func (l *LegacyLoginHandler) PasswordLoginHandler(c *gin.Context) {
+	var request passwordLoginRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username and password are required"})
+		return
+	}
+	metrics.LoginStarted("password")
+	if !l.allow(c, "ip:"+c.ClientIP(), "user:"+strings.ToLower(request.Username)) {
+		l.audit(c, "password", request.Username, "rate_limited")
+		return
+	}
+
+	authClient := middleware.AuthClient(c)
+	oauthToken, err := authClient.PasswordToken(c, request.Username, request.Password)
+	if auth.IsInvalidGrant(err) {
+		l.audit(c, "password", request.Username, "invalid_credentials")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+	if err != nil {
+		slog.WarnContext(c, "password grant failed", "error", err)
+		l.audit(c, "password", request.Username, "token_error")
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to obtain token"})
+		return
+	}
+	userInfo, err := l.validateAndGetClaimsIDToken(c, oauthToken)
+	if err != nil {
+		l.audit(c, "password", request.Username, "invalid_id_token")
+		c.JSON(http.StatusInternalServerError,
+			gin.H{"error": "Failed to validate and get claims id token"})
+		return
+	}
+	if err := l.createSession(c, oauthToken, userInfo, nil); err != nil {
+		l.audit(c, "password", request.Username, "session_error")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store session"})
+		return
+	}
+	recordLogin(c, "password", userInfo, "")
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// APIKeyLoginHandler logs an integration in with a static API key, accepted
+// in the X-API-Key header or the api_key JSON field. The key is the secret of
+// the integration's own Keycloak client and the session acts as that client's
+// service account, obtained with the client credentials grant.
+//
+// Returns:
+// - 200: session created, the session cookie is set
+// - 401: Unauthorized if the key is unknown
+// - 429: Too Many Requests with Retry-After when rate limited
+// - 502: Bad Gateway if Keycloak does not issue a token for the key
+func (l *LegacyLoginHandler) APIKeyLoginHandler(c *gin.Context) {
+	metrics.LoginStarted("api_key")
+	// Limit by IP before looking at the key so keys cannot be brute forced
+	if !l.allow(c, "ip:"+c.ClientIP()) {
+		l.audit(c, "api_key", "", "rate_limited")
+		return
+	}
+	apiKey := c.GetHeader("X-API-Key")
+	if apiKey == "" {
+		var request apiKeyLoginRequest
+		if err := c.ShouldBindJSON(&request); err == nil {
+			apiKey = request.APIKey
+		}
+	}
+	sum := sha256.Sum256([]byte(apiKey))
+	key, known := l.config.APIKeys[hex.EncodeToString(sum[:])]
+	name := key.Name
+	if !known {
+		l.audit(c, "api_key", "", "invalid_credentials")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+		return
+	}
+	if !l.allow(c, "apikey:"+name) {
+		l.audit(c, "api_key", name, "rate_limited")
+		return
+	}
+
+	authClient := middleware.AuthClient(c)
+	oauthToken, err := authClient.ServiceAccountToken(c, key.ClientID, apiKey)
+	if err != nil {
+		slog.WarnContext(c, "API key client credentials grant failed", "client_id", key.ClientID, "error", err)
+		l.audit(c, "api_key", name, "token_error")
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to obtain token"})
+		return
+	}
+	// Service account tokens carry no ID token, identify the session from the access token
+	token, err := authClient.Provider.Verifier(&oidc.Config{
+		SkipClientIDCheck: true,
+	}).Verify(c, oauthToken.AccessToken)
+	if err != nil {
+		l.audit(c, "api_key", name, "invalid_access_token")
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to verify token"})
+		return
+	}
+	userInfo := &oidcClaims{Subject: token.Subject, Username: name}
+	if err := l.createSession(c, oauthToken, userInfo, nil); err != nil {
+		l.audit(c, "api_key", name, "session_error")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store session"})
+		return
+	}
+	recordLogin(c, "api_key", userInfo, "")
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// allow counts an attempt against every key (client IP, account) and
+// answers 429 when any of them is over the limit
+func (l *LegacyLoginHandler) allow(c *gin.Context, keys ...string) bool {
+	tenant := middleware.Tenant(c)
+	for _, key := range keys {
+		allowed, retryAfter, err := l.limiter.Allow(c, "legacy:"+tenant+":"+key,
+			l.config.RateLimit, legacyRateWindow)
+		if err != nil {
+			// Fail closed, an unprotected password endpoint is worse than an unavailable one
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Rate limiter unavailable"})
+			return false
+		}
+		if !allowed {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many login attempts"})
+			return false
+		}
+	}
+	return true
+}
+
+// audit records a failed legacy login attempt with the account it named.
+// Passwords and keys are never recorded.
+func (l *LegacyLoginHandler) audit(c *gin.Context, method, account, reason string) {
+	recordLogin(c, method, &oidcClaims{Username: account}, reason)
+}
@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"authorization_flow_keycloak/internal/auth"
+	"authorization_flow_keycloak/internal/config"
+	"authorization_flow_keycloak/internal/middleware"
+	"authorization_flow_keycloak/internal/store"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// testRealm serves the discovery document and signing keys of the realm
+// "acme" and lets tests answer its token endpoint
+type testRealm struct {
+	*httptest.Server
+	key   *rsa.PrivateKey
+	token http.HandlerFunc
+}
+
+func newTestRealm(t *testing.T) *testRealm {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	realm := &testRealm{key: key}
+	realm.Server = httptest.NewServer(http.HandlerFunc(realm.serve))
+	t.Cleanup(realm.Close)
+	return realm
+}
+
+func (r *testRealm) issuer() string {
+	return r.URL + "/realms/acme"
+}
+
+func (r *testRealm) serve(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch strings.TrimPrefix(req.URL.Path, "/realms/acme/") {
+	case ".well-known/openid-configuration":
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 r.issuer(),
+			"authorization_endpoint": r.issuer() + "/protocol/openid-connect/auth",
+			"token_endpoint":         r.issuer() + "/protocol/openid-connect/token",
+			"jwks_uri":               r.issuer() + "/protocol/openid-connect/certs",
+		})
+	case "protocol/openid-connect/certs":
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+			Key: &r.key.PublicKey, KeyID: "realm-key", Algorithm: string(jose.RS256), Use: "sig",
+		}}})
+	case "protocol/openid-connect/token":
+		r.token(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// idToken returns an ID token of the realm for the client "app"
+func (r *testRealm) idToken(t *testing.T, subject, username string) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: r.key},
+		(&jose.SignerOptions{}).WithHeader("kid", "realm-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(map[string]interface{}{
+		"iss":                r.issuer(),
+		"aud":                "app",
+		"sub":                subject,
+		"preferred_username": username,
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(5 * time.Minute).Unix(),
+	}).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// allowingLimiter never rate limits
+type allowingLimiter struct{}
+
+func (allowingLimiter) Allow(context.Context, string, int, time.Duration) (bool, time.Duration, error) {
+	return true, 0, nil
+}
+
+// savingSessionStore keeps the created sessions
+type savingSessionStore struct {
+	store.SessionStore
+	sessions map[string]store.SessionData
+}
+
+func (s *savingSessionStore) Set(_ context.Context, sessionID string, data store.SessionData) error {
+	s.sessions[sessionID] = data
+	return nil
+}
+
+func (s *savingSessionStore) WithTenant(string) store.SessionStore {
+	return s
+}
+
+func TestPasswordLoginHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int    // token endpoint status
+		errorCode   string // token endpoint error, empty on success
+		wantStatus  int
+		wantSession bool
+	}{
+		{name: "valid credentials", status: http.StatusOK, wantStatus: http.StatusOK, wantSession: true},
+		{name: "invalid credentials", status: http.StatusBadRequest, errorCode: "invalid_grant", wantStatus: http.StatusUnauthorized},
+		// Direct access grants disabled for the client in Keycloak
+		{name: "password grant disabled", status: http.StatusBadRequest, errorCode: "unauthorized_client", wantStatus: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			realm := newTestRealm(t)
+			realm.token = func(w http.ResponseWriter, r *http.Request) {
+				if err := r.ParseForm(); err != nil {
+					t.Fatal(err)
+				}
+				if r.PostForm.Get("grant_type") != "password" ||
+					r.PostForm.Get("username") != "alice" || r.PostForm.Get("password") != "secret-password" {
+					t.Errorf("token request = %v", r.PostForm)
+				}
+				if tt.errorCode != "" {
+					w.WriteHeader(tt.status)
+					_ = json.NewEncoder(w).Encode(map[string]string{"error": tt.errorCode})
+					return
+				}
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{
+					"access_token":  "access-token",
+					"refresh_token": "refresh-token",
+					"id_token":      realm.idToken(t, "user-1", "alice"),
+					"token_type":    "Bearer",
+					"expires_in":    300,
+				})
+			}
+			registry := auth.NewRegistry(&auth.Config{
+				BaseURL:      realm.URL,
+				ClientID:     "app",
+				ClientSecret: "secret",
+				RedirectURL:  "http://localhost/auth/callback",
+				Realm:        "acme",
+			}, []string{"acme"})
+			sessions := &savingSessionStore{sessions: make(map[string]store.SessionData)}
+			handler := NewLegacyLoginHandler(
+				&AuthHandler{sessionStore: sessions},
+				&config.LegacyLoginConfig{Enabled: true, RateLimit: 5},
+				allowingLimiter{},
+			)
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.Use(middleware.NewTenantResolver(&config.TenantConfig{}, "acme", registry).Resolve())
+			router.POST("/auth/password", handler.PasswordLoginHandler)
+			body := `{"username":"alice","password":"secret-password"}`
+			r := httptest.NewRequest(http.MethodPost, "/auth/password", strings.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := len(sessions.sessions); got != 0 != tt.wantSession {
+				t.Fatalf("%d sessions created, want session %v", got, tt.wantSession)
+			}
+			if !tt.wantSession {
+				return
+			}
+			for _, session := range sessions.sessions {
+				if session.Realm != "acme" || session.AccessToken != "access-token" ||
+					session.UserInfo.Subject != "user-1" || session.UserInfo.Username != "alice" {
+					t.Fatalf("session = %+v", session)
+				}
+			}
+			if !strings.Contains(w.Header().Get("Set-Cookie"), "session_id=") {
+				t.Fatalf("no session cookie set: %v", w.Header())
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"authorization_flow_keycloak/internal/audit"
+	"authorization_flow_keycloak/internal/middleware"
+	"authorization_flow_keycloak/internal/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// deletingSessionStore records deleted sessions and fails with err
+type deletingSessionStore struct {
+	store.SessionStore
+	deleted []string
+	err     error
+}
+
+func (s *deletingSessionStore) Delete(_ context.Context, sessionID string) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.deleted = append(s.deleted, sessionID)
+	return nil
+}
+
+func (s *deletingSessionStore) WithTenant(string) store.SessionStore {
+	return s
+}
+
+// eventSink keeps the recorded audit events
+type eventSink []audit.Event
+
+func (s *eventSink) Write(_ context.Context, event audit.Event) error {
+	*s = append(*s, event)
+	return nil
+}
+
+func TestLogoutHandlerAudit(t *testing.T) {
+	tests := []struct {
+		name        string
+		cookie      string
+		deleteErr   error
+		wantOutcome string // empty when nothing may be audited
+	}{
+		{name: "session ended", cookie: "session-1", wantOutcome: audit.OutcomeSuccess},
+		{name: "no session cookie"},
+		{name: "session store down", cookie: "session-1", deleteErr: errors.New("connection refused"), wantOutcome: audit.OutcomeFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sessions := &deletingSessionStore{err: tt.deleteErr}
+			events := &eventSink{}
+			handler := &AuthHandler{sessionStore: sessions}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.Use(middleware.AuditLogger(audit.NewLogger(audit.Redaction{}, events)))
+			router.POST("/logout", handler.LogoutHandler)
+			r := httptest.NewRequest(http.MethodPost, "/logout", nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: "session_id", Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			if w.Code != http.StatusSeeOther {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusSeeOther)
+			}
+			if tt.wantOutcome == "" {
+				if len(*events) != 0 {
+					t.Fatalf("events = %+v, want none", *events)
+				}
+				return
+			}
+			if len(*events) != 1 || (*events)[0].Type != audit.TypeLogout || (*events)[0].Outcome != tt.wantOutcome {
+				t.Fatalf("events = %+v, want one %s logout", *events, tt.wantOutcome)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"authorization_flow_keycloak/internal/middleware"
+	"authorization_flow_keycloak/internal/offline"
+	"authorization_flow_keycloak/internal/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+type offlineTokenRequest struct {
+	Subject string `json:"subject" binding:"required"`
+}
+
+// OfflineHandler serves the offline access of background jobs and lets
+// users withdraw it
+type OfflineHandler struct {
+	tokens *offline.Tokens
+}
+
+func NewOfflineHandler(tokens *offline.Tokens) *OfflineHandler {
+	return &OfflineHandler{tokens: tokens}
+}
+
+// TokenHandler issues an access token on behalf of a user who granted
+// offline access, for background jobs. RequireBearer and RequireScopes with
+// the job scope must run first.
+//
+// Returns:
+// - 200: access_token, token_type and expires_in when known
+// - 400: Bad Request if the subject is missing
+// - 404: Not Found if the user has not granted offline access
+// - 502: Bad Gateway if the token endpoint fails
+func (o *OfflineHandler) TokenHandler(c *gin.Context) {
+	var request offlineTokenRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "subject is required"})
+		return
+	}
+	token, err := o.tokens.AccessToken(c, middleware.Tenant(c), request.Subject)
+	if errors.Is(err, offline.ErrNoConsent) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no_offline_access"})
+		return
+	}
+	if err != nil {
+		slog.WarnContext(c, "failed to issue offline access token", "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to obtain token"})
+		return
+	}
+	response := gin.H{
+		"access_token": token.AccessToken,
+		"token_type":   token.Type(),
+	}
+	if !token.Expiry.IsZero() {
+		response["expires_in"] = int(time.Until(token.Expiry).Round(time.Second).Seconds())
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// RevokeHandler withdraws the offline access of the signed in user, at
+// Keycloak and in the offline store. RequireAuth and RequireCSRF must run
+// first.
+//
+// Returns:
+// - 200: offline access withdrawn or never granted
+// - 502: Bad Gateway if Keycloak does not revoke the token
+func (o *OfflineHandler) RevokeHandler(c *gin.Context) {
+	rawSession, _ := c.Get("user_session")
+	sessionData, ok := rawSession.(*store.SessionData)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "No session found"})
+		return
+	}
+	if err := o.tokens.Revoke(c, sessionData.Realm, sessionData.UserInfo.Subject); err != nil {
+		slog.WarnContext(c, "failed to revoke offline access", "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to revoke offline access"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
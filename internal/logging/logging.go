@@ -0,0 +1,161 @@
+// Package logging configures log/slog for the service. Records logged with
+// a request context carry the request ID, the session ID hash, the subject
+// and the trace of the request, and attributes that could hold credentials are
+// redacted.
+package logging
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Log formats
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// redactedKeys are attribute keys whose values are never written
+var redactedKeys = map[string]bool{
+	"access_token":  true,
+	"refresh_token": true,
+	"id_token":      true,
+	"token":         true,
+	"password":      true,
+	"client_secret": true,
+	"api_key":       true,
+	"authorization": true,
+	"cookie":        true,
+	"session_id":    true,
+	"dpop":          true,
+}
+
+// Setup installs the default slog logger, which log.Printf also goes through.
+// level is debug, info, warn or error, format json or text.
+func Setup(level, format string) error {
+	var slogLevel slog.Level
+	if err := slogLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+	handler, err := newHandler(os.Stderr, slogLevel, format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+func newHandler(w io.Writer, level slog.Level, format string) (slog.Handler, error) {
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+	switch format {
+	case FormatJSON:
+		return &contextHandler{slog.NewJSONHandler(w, options)}, nil
+	case FormatText:
+		return &contextHandler{slog.NewTextHandler(w, options)}, nil
+	}
+	return nil, fmt.Errorf("invalid log format %q", format)
+}
+
+// redact replaces the value of credential attributes
+func redact(_ []string, attr slog.Attr) slog.Attr {
+	if redactedKeys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, "[REDACTED]")
+	}
+	return attr
+}
+
+// Fatal logs an error and exits, for startup failures
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// requestKey is the context key of the request attributes
+type requestKey struct{}
+
+// requestAttrs are the attributes added to the records of a request. The
+// session and subject are only known once the request is authenticated.
+type requestAttrs struct {
+	mu        sync.Mutex
+	requestID string
+	session   string
+	subject   string
+}
+
+// WithRequestID returns a context whose records carry the request ID
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestKey{}, &requestAttrs{requestID: requestID})
+}
+
+// RequestID returns the request ID of the context, if any
+func RequestID(ctx context.Context) string {
+	attrs, ok := ctx.Value(requestKey{}).(*requestAttrs)
+	if !ok {
+		return ""
+	}
+	return attrs.requestID
+}
+
+// SetSession adds the session to the records of the request. Only a short
+// hash is logged, which correlates records without exposing the session ID.
+func SetSession(ctx context.Context, sessionID string) {
+	if attrs, ok := ctx.Value(requestKey{}).(*requestAttrs); ok {
+		sum := sha256.Sum256([]byte(sessionID))
+		attrs.mu.Lock()
+		attrs.session = hex.EncodeToString(sum[:8])
+		attrs.mu.Unlock()
+	}
+}
+
+// SetSubject adds the authenticated user to the records of the request
+func SetSubject(ctx context.Context, subject string) {
+	if attrs, ok := ctx.Value(requestKey{}).(*requestAttrs); ok {
+		attrs.mu.Lock()
+		attrs.subject = subject
+		attrs.mu.Unlock()
+	}
+}
+
+// contextHandler adds the request attributes of the context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if attrs, ok := ctx.Value(requestKey{}).(*requestAttrs); ok {
+		attrs.mu.Lock()
+		record.AddAttrs(slog.String("request_id", attrs.requestID))
+		if attrs.session != "" {
+			record.AddAttrs(slog.String("session", attrs.session))
+		}
+		if attrs.subject != "" {
+			record.AddAttrs(slog.String("subject", attrs.subject))
+		}
+		attrs.mu.Unlock()
+	}
+	// Link the record to the trace of the request
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(
+			slog.String("trace_id", span.TraceID().String()),
+			slog.String("span_id", span.SpanID().String()),
+		)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,115 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name string
+		attr slog.Attr
+		want string
+	}{
+		{"access token", slog.String("access_token", "eyJhbGciOi"), "[REDACTED]"},
+		{"key in other case", slog.String("Authorization", "Bearer eyJhbGciOi"), "[REDACTED]"},
+		{"session ID", slog.String("session_id", "session-1"), "[REDACTED]"},
+		{"non string value", slog.Any("password", []byte("secret")), "[REDACTED]"},
+		{"inside a group", slog.Group("request", slog.String("cookie", "session_id=session-1")), "[REDACTED]"},
+		{"other attribute", slog.String("realm", "acme"), "acme"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			handler, err := newHandler(&buf, slog.LevelInfo, FormatJSON)
+			if err != nil {
+				t.Fatal(err)
+			}
+			slog.New(handler).Info("test", tt.attr)
+			if strings.Contains(buf.String(), "secret") || strings.Contains(buf.String(), "eyJ") || strings.Contains(buf.String(), "session-1") {
+				t.Fatalf("credential written: %s", buf.String())
+			}
+			if !strings.Contains(buf.String(), `"`+tt.want+`"`) {
+				t.Fatalf("record %s does not contain %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestAttributes(t *testing.T) {
+	var buf bytes.Buffer
+	handler, err := newHandler(&buf, slog.LevelInfo, FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(handler)
+
+	ctx := WithRequestID(context.Background(), "request-1")
+	SetSession(ctx, "session-1")
+	SetSubject(ctx, "user-1")
+	logger.InfoContext(ctx, "test")
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["request_id"] != "request-1" || record["subject"] != "user-1" {
+		t.Fatalf("record = %v", record)
+	}
+	if session, _ := record["session"].(string); len(session) != 16 || strings.Contains(buf.String(), "session-1") {
+		t.Fatalf("session = %q, want a short hash of the session ID", session)
+	}
+
+	// Records without a request context carry none of them
+	buf.Reset()
+	logger.Info("test")
+	if strings.Contains(buf.String(), "request_id") {
+		t.Fatalf("record %s has request attributes", buf.String())
+	}
+}
+
+func TestMiddlewareRequestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{"caller ID kept", "caller-id-1", true},
+		{"generated when missing", "", false},
+		{"line break refused", "id\nforged record", false},
+		{"space refused", "id forged", false},
+		{"too long", strings.Repeat("a", 129), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			var seen string
+			router.GET("/", Middleware(), func(c *gin.Context) {
+				seen = RequestID(c.Request.Context())
+			})
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set(HeaderRequestID, tt.header)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			got := w.Header().Get(HeaderRequestID)
+			if got == "" || got != seen {
+				t.Fatalf("response ID %q, context ID %q", got, seen)
+			}
+			if (got == tt.header) != tt.keep {
+				t.Fatalf("request ID = %q, keep caller ID %v", got, tt.keep)
+			}
+		})
+	}
+}
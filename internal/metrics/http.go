@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Middleware records the latency of every request by its Gin route, so
+// path parameters do not create a series per value
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			// Unmatched paths are arbitrary, keep them in one series
+			route = "unmatched"
+		}
+		httpDuration.WithLabelValues(
+			c.Request.Method,
+			route,
+			strconv.Itoa(c.Writer.Status()),
+		).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Transport records the latency of requests to the OpenID provider made
+// through base, http.DefaultTransport when nil
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &oidcTransport{base: base}
+}
+
+type oidcTransport struct {
+	base http.RoundTripper
+}
+
+func (t *oidcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	outcome := OutcomeSuccess
+	if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+		outcome = OutcomeFailure
+	}
+	oidcDuration.WithLabelValues(OIDCEndpoint(req.URL.Path), outcome).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// oidcEndpoints names the Keycloak endpoints by the end of their path
+var oidcEndpoints = []struct {
+	suffix string
+	name   string
+}{
+	{"/.well-known/openid-configuration", "discovery"},
+	{"/protocol/openid-connect/certs", "jwks"},
+	{"/protocol/openid-connect/token/introspect", "introspection"},
+	{"/protocol/openid-connect/token", "token"},
+	{"/protocol/openid-connect/userinfo", "userinfo"},
+	{"/protocol/openid-connect/revoke", "revocation"},
+	{"/protocol/openid-connect/ext/par/request", "par"},
+	{"/protocol/openid-connect/auth/device", "device"},
+}
+
+// OIDCEndpoint names the Keycloak endpoint of a request path, "other" when
+// it is not a known one
+func OIDCEndpoint(path string) string {
+	path = strings.TrimSuffix(path, "/")
+	for _, endpoint := range oidcEndpoints {
+		if strings.HasSuffix(path, endpoint.suffix) {
+			return endpoint.name
+		}
+	}
+	return "other"
+}
@@ -0,0 +1,175 @@
+// Package metrics exposes Prometheus metrics of logins, sessions and the
+// calls this service makes to Keycloak on /metrics.
+package metrics
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "keycloak_auth"
+
+var (
+	loginsStarted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logins_started_total",
+		Help:      "Logins started, by login method.",
+	}, []string{"method"})
+	loginsCompleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logins_completed_total",
+		Help:      "Logins that created a session or issued tokens, by login method.",
+	}, []string{"method"})
+	loginsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logins_failed_total",
+		Help:      "Failed logins, by login method and the stage that failed.",
+	}, []string{"method", "stage"})
+
+	tokenRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_refreshes_total",
+		Help:      "Access token refreshes of sessions, by outcome.",
+	}, []string{"outcome"})
+
+	storeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "session_store_operation_duration_seconds",
+		Help:      "Latency of session store operations, by backend and operation.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"backend", "operation"})
+	storeErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "session_store_errors_total",
+		Help:      "Failed session store operations, by backend and operation.",
+	}, []string{"backend", "operation"})
+
+	oidcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "oidc_request_duration_seconds",
+		Help:      "Latency of requests to the OpenID provider, by endpoint and outcome.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint", "outcome"})
+
+	rateLimitDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_decisions_total",
+		Help:      "Rate limit decisions, by route group and decision.",
+	}, []string{"group", "decision"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests, by method, Gin route and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+)
+
+// Outcomes of refreshes and OpenID provider requests
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Handler serves the metrics in the Prometheus exposition format to
+// scrapers presenting the bearer token
+//
+// Returns:
+// - 401: Unauthorized if the token is missing or wrong
+func Handler(token string) gin.HandlerFunc {
+	handler := promhttp.Handler()
+	expected := []byte("Bearer " + token)
+	return func(c *gin.Context) {
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), expected) != 1 {
+			c.Header("WWW-Authenticate", `Bearer realm="metrics"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// LoginStarted counts a login that was started with the method
+func LoginStarted(method string) {
+	loginsStarted.WithLabelValues(method).Inc()
+}
+
+// LoginCompleted counts a successful login
+func LoginCompleted(method string) {
+	loginsCompleted.WithLabelValues(method).Inc()
+}
+
+// LoginFailed counts a failed login with the stage it failed at, which must
+// come from a fixed set of values
+func LoginFailed(method, stage string) {
+	loginsFailed.WithLabelValues(method, stage).Inc()
+}
+
+// TokenRefreshed counts a refresh of a session access token
+func TokenRefreshed(outcome string) {
+	tokenRefreshes.WithLabelValues(outcome).Inc()
+}
+
+// Rate limit decisions
+const (
+	RateLimitAllowed = "allowed"
+	RateLimitLimited = "limited"
+	RateLimitError   = "error" // the limiter failed and the request was let through
+)
+
+// RateLimitDecided counts a rate limit decision of a route group
+func RateLimitDecided(group, decision string) {
+	rateLimitDecisions.WithLabelValues(group, decision).Inc()
+}
+
+// ObserveStoreOperation records the latency of a session store operation
+// started at start, counting it as an error when err is set
+func ObserveStoreOperation(backend, operation string, start time.Time, err error) {
+	storeDuration.WithLabelValues(backend, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		storeErrors.WithLabelValues(backend, operation).Inc()
+	}
+}
+
+// RegisterActiveSessions exports the number of active sessions, counted
+// by count on every scrape
+func RegisterActiveSessions(count func(ctx context.Context) (int, error)) {
+	prometheus.MustRegister(&activeSessions{
+		count: count,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "active_sessions"),
+			"Sessions that have not expired or been logged out.",
+			nil, nil,
+		),
+	})
+}
+
+// activeSessions collects the active sessions gauge. A failed count leaves
+// the gauge out of the scrape instead of reporting zero.
+type activeSessions struct {
+	count func(ctx context.Context) (int, error)
+	desc  *prometheus.Desc
+}
+
+func (a *activeSessions) Describe(ch chan<- *prometheus.Desc) {
+	ch <- a.desc
+}
+
+func (a *activeSessions) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	count, err := a.count(ctx)
+	if err != nil {
+		slog.Warn("failed to count active sessions", "error", err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(a.desc, prometheus.GaugeValue, float64(count))
+}
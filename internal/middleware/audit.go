@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"authorization_flow_keycloak/internal/audit"
+	"authorization_flow_keycloak/internal/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// auditLoggerKey is the context key of the audit logger
+const auditLoggerKey = "audit_logger"
+
+// AuditLogger makes the audit logger available to the handlers and
+// middlewares of every route through Audit
+func AuditLogger(logger *audit.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(auditLoggerKey, logger)
+		c.Next()
+	}
+}
+
+// Audit records an event about the request. The tenant, client and route
+// are filled in, and so is the user when the request is authenticated and
+// the event does not name one.
+func Audit(c *gin.Context, event audit.Event) {
+	value, _ := c.Get(auditLoggerKey)
+	logger, ok := value.(*audit.Logger)
+	if !ok {
+		return
+	}
+	event.Tenant = c.GetString(tenantKey)
+	event.IP = c.ClientIP()
+	event.UserAgent = c.Request.UserAgent()
+	event.Route = c.Request.Method + " " + c.Request.URL.Path
+	if event.Subject == "" {
+		if principal, ok := CurrentPrincipal(c); ok {
+			event.Subject = principal.Subject
+			event.Username = principal.Username
+			event.Email = principal.Email
+		} else if rawSession, exists := c.Get("user_session"); exists {
+			if sessionData, ok := rawSession.(*store.SessionData); ok {
+				event.Subject = sessionData.UserInfo.Subject
+				event.Username = sessionData.UserInfo.Username
+				event.Email = sessionData.UserInfo.Email
+			}
+		} else if claims, ok := c.Get("user_claims"); ok {
+			values, _ := claims.(map[string]interface{})
+			event.Subject, _ = values["sub"].(string)
+			event.Username, _ = values["preferred_username"].(string)
+			event.Email, _ = values["email"].(string)
+		}
+	}
+	logger.Record(c, event)
+}
+
+// auditDenied records a request refused by an authorization check
+func auditDenied(c *gin.Context, reason string, details map[string]string) {
+	Audit(c, audit.Event{
+		Type:    audit.TypeAuthorizationDenied,
+		Outcome: audit.OutcomeFailure,
+		Reason:  reason,
+		Details: details,
+	})
+}
+
+// auditSession records an event about a stored session
+func auditSession(c *gin.Context, eventType, outcome, reason string, sessionData *store.SessionData) {
+	Audit(c, audit.Event{
+		Type:     eventType,
+		Outcome:  outcome,
+		Reason:   reason,
+		Subject:  sessionData.UserInfo.Subject,
+		Username: sessionData.UserInfo.Username,
+		Email:    sessionData.UserInfo.Email,
+	})
+}
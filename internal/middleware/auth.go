@@ -2,70 +2,347 @@ package middleware
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
 
+	"authorization_flow_keycloak/internal/audit"
 	"authorization_flow_keycloak/internal/auth"
+	"authorization_flow_keycloak/internal/logging"
+	"authorization_flow_keycloak/internal/metrics"
 	"authorization_flow_keycloak/internal/store"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/gin-gonic/gin"
 )
 
+// errTokenInactive is returned when introspection reports a revoked or expired token
+var errTokenInactive = errors.New("access token is not active")
+
+var (
+	// errNoSession is returned when the request has no valid session
+	errNoSession = errors.New("no valid session")
+	// errSessionUnavailable is returned when an expired session could not be
+	// renewed because Keycloak or the session store failed
+	errSessionUnavailable = errors.New("session temporarily unavailable")
+)
+
 type AuthMiddleware struct {
-	authClient   *auth.Client
-	sessionStore store.SessionStore
+	sessionStore       store.SessionStore
+	dpopStore          store.DPoPStore
+	introspectionStore store.IntrospectionStore
+	offlineStore       store.OfflineTokenStore // nil when offline access is disabled
+	refreshSessions    bool                    // renew expired access tokens instead of ending the session
 }
 
-// NewAuthMiddleware creates a new authentication middleware with OIDC verification
+// NewAuthMiddleware creates a new authentication middleware with OIDC verification.
+// It expects TenantResolver.Resolve to run first so the realm's auth client is
+// available in the request context.
 func NewAuthMiddleware(c context.Context,
-	authClient *auth.Client,
 	sessionStore store.SessionStore,
+	dpopStore store.DPoPStore,
+	introspectionStore store.IntrospectionStore,
+	offlineStore store.OfflineTokenStore,
+	refreshSessions bool,
 ) *AuthMiddleware {
 	return &AuthMiddleware{
-		authClient:   authClient,
-		sessionStore: sessionStore,
+		sessionStore:       sessionStore,
+		dpopStore:          dpopStore,
+		introspectionStore: introspectionStore,
+		offlineStore:       offlineStore,
+		refreshSessions:    refreshSessions,
 	}
 }
 func (m *AuthMiddleware) RequireAuth() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Get session from cookie
-		sessionID, err := c.Cookie("session_id")
-		if err != nil {
-			c.Redirect(http.StatusTemporaryRedirect, "/")
-			c.Abort()
+		sessionData, claims, err := m.authenticateSession(c)
+		if errors.Is(err, errSessionUnavailable) {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
 			return
 		}
-		// Get session data from Redis
-		sessionData, err := m.sessionStore.Get(c, sessionID)
 		if err != nil {
-			// Clear invalid session cookie
-			c.SetCookie("session_id", "", -1, "/", "", true, true)
-			c.Redirect(http.StatusTemporaryRedirect, "/")
-			c.Abort()
+			unauthenticated(c)
 			return
 		}
-		// Verify the access token using the OIDC provider
-		token, err := m.authClient.Provider.Verifier(&oidc.Config{
-			SkipClientIDCheck: true, // Access tokens don't require client ID check
-		}).Verify(c, sessionData.AccessToken)
-		if err != nil {
-			// The token is invalid - let's clean up and redirect
-			m.sessionStore.Delete(c, sessionID)
-			c.SetCookie("session_id", "", -1, "/", "", true, true)
-			c.Redirect(http.StatusTemporaryRedirect, "/")
-			c.Abort()
-			return
-		}
-		// Extract claims from the token
-		var claims map[string]interface{}
-		if err := token.Claims(&claims); err != nil {
-			c.AbortWithStatus(http.StatusInternalServerError)
-			return
-		}
-
 		// Store the validated claims and session in the context
 		c.Set("user_session", sessionData)
 		c.Set("user_claims", claims)
 		c.Next()
 	}
 }
+
+// RequireSessionOrBearer authenticates requests carrying an Authorization
+// header like RequireBearer and the others like RequireAuth, for routes
+// shared by browsers and API clients
+func (m *AuthMiddleware) RequireSessionOrBearer() gin.HandlerFunc {
+	requireAuth, requireBearer := m.RequireAuth(), m.RequireBearer()
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") != "" {
+			requireBearer(c)
+			return
+		}
+		requireAuth(c)
+	}
+}
+
+// AccessToken returns the access token the request was authenticated with,
+// from the session set by RequireAuth or from the Authorization header
+func AccessToken(c *gin.Context) string {
+	if rawSession, exists := c.Get("user_session"); exists {
+		if sessionData, ok := rawSession.(*store.SessionData); ok {
+			return sessionData.AccessToken
+		}
+	}
+	_, accessToken := authorizationHeader(c.Request)
+	return accessToken
+}
+
+// authenticateSession validates the session of the cookie, renewing expired
+// access tokens. An invalid session is deleted and its cookie cleared and
+// errNoSession returned. When Keycloak cannot renew the tokens for another
+// reason than a rejected refresh token, the session is kept and
+// errSessionUnavailable returned.
+func (m *AuthMiddleware) authenticateSession(c *gin.Context) (*store.SessionData, map[string]interface{}, error) {
+	realm := Tenant(c)
+	authClient := AuthClient(c)
+	sessionStore := m.sessionStore.WithTenant(realm)
+
+	// Get session from cookie
+	sessionID, err := c.Cookie("session_id")
+	if err != nil {
+		return nil, nil, errNoSession
+	}
+	// Get session data from Redis
+	sessionData, err := sessionStore.Get(c, sessionID)
+	if err != nil || sessionData.Realm != realm {
+		// Clear invalid session cookie
+		c.SetCookie("session_id", "", -1, CookiePath(c), "", true, true)
+		return nil, nil, errNoSession
+	}
+	// Verify the access token using the OIDC provider
+	claims, err := m.validateAccessToken(c, authClient, sessionData.AccessToken)
+	if errors.Is(err, auth.ErrIntrospectionUnavailable) {
+		// Keycloak cannot tell whether the token is active, keep the session
+		return nil, nil, errSessionUnavailable
+	}
+	var expired *oidc.TokenExpiredError
+	if (errors.As(err, &expired) || errors.Is(err, errTokenInactive)) &&
+		m.refreshSessions && sessionData.RefreshToken != "" {
+		// Renew the expired access token instead of ending the session
+		claims, err = m.refreshSession(c, authClient, sessionStore, sessionID, sessionData)
+		if err != nil {
+			metrics.TokenRefreshed(metrics.OutcomeFailure)
+			if !refreshRejected(err) {
+				// Keycloak or Redis is unreachable, the session may still be valid
+				auditSession(c, audit.TypeTokenRefresh, audit.OutcomeFailure, "refresh_unavailable", sessionData)
+				slog.WarnContext(c, "failed to refresh session", "error", err)
+				return nil, nil, errSessionUnavailable
+			}
+			auditSession(c, audit.TypeTokenRefresh, audit.OutcomeFailure, "refresh_rejected", sessionData)
+		} else {
+			metrics.TokenRefreshed(metrics.OutcomeSuccess)
+			auditSession(c, audit.TypeTokenRefresh, audit.OutcomeSuccess, "", sessionData)
+		}
+	}
+	if err != nil {
+		// The token is invalid - let's clean up
+		if deleteErr := sessionStore.Delete(c, sessionID); deleteErr != nil {
+			slog.WarnContext(c, "failed to delete invalid session", "error", deleteErr)
+			auditSession(c, audit.TypeSessionRevoked, audit.OutcomeFailure, "store_error", sessionData)
+		} else {
+			auditSession(c, audit.TypeSessionRevoked, audit.OutcomeSuccess, "invalid_token", sessionData)
+		}
+		c.SetCookie("session_id", "", -1, CookiePath(c), "", true, true)
+		return nil, nil, errNoSession
+	}
+	logging.SetSession(c, sessionID)
+	logging.SetSubject(c, sessionData.UserInfo.Subject)
+	return sessionData, claims, nil
+}
+
+// validateAccessToken returns the claims of a valid access token. In
+// introspection mode Keycloak decides whether the token is still active,
+// falling back to local signature verification while it cannot answer. A
+// token that cannot be verified locally either is not known to be invalid
+// and auth.ErrIntrospectionUnavailable is returned.
+func (m *AuthMiddleware) validateAccessToken(
+	c *gin.Context,
+	authClient *auth.Client,
+	accessToken string,
+) (map[string]interface{}, error) {
+	if !authClient.IntrospectionEnabled() {
+		return verifiedClaims(c, authClient, accessToken)
+	}
+	claims, err := m.introspect(c, authClient, accessToken)
+	if !errors.Is(err, auth.ErrIntrospectionUnavailable) {
+		return claims, err
+	}
+	claims, verifyErr := verifiedClaims(c, authClient, accessToken)
+	var expired *oidc.TokenExpiredError
+	if verifyErr != nil && !errors.As(verifyErr, &expired) {
+		slog.WarnContext(c, "token introspection unavailable", "error", err)
+		return nil, err
+	}
+	return claims, verifyErr
+}
+
+// verifiedClaims returns the claims of an access token with a valid signature
+func verifiedClaims(
+	c *gin.Context,
+	authClient *auth.Client,
+	accessToken string,
+) (map[string]interface{}, error) {
+	token, err := verifyAccessToken(c, authClient, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := token.Claims(&claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// introspect checks the token against Keycloak, using the short lived
+// Redis cache to avoid one introspection call per request
+func (m *AuthMiddleware) introspect(
+	c *gin.Context,
+	authClient *auth.Client,
+	accessToken string,
+) (map[string]interface{}, error) {
+	cache := m.introspectionStore.WithTenant(Tenant(c))
+	if raw, ok, err := cache.Get(c, accessToken); err == nil && ok {
+		if result, err := auth.ParseIntrospection(raw); err == nil {
+			return activeClaims(result)
+		}
+	}
+
+	result, err := authClient.Introspect(c, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	// Inactive results are cached too, a revoked token never becomes active again
+	if raw, err := json.Marshal(result.Claims); err == nil {
+		_ = cache.Set(c, accessToken, raw, result.ExpiresAt)
+	}
+	return activeClaims(result)
+}
+
+func activeClaims(result *auth.Introspection) (map[string]interface{}, error) {
+	if !result.Active {
+		return nil, errTokenInactive
+	}
+	return result.Claims, nil
+}
+
+// verifyAccessToken validates the signature, issuer and expiry of an access token
+func verifyAccessToken(ctx context.Context, authClient *auth.Client, accessToken string) (*oidc.IDToken, error) {
+	return authClient.Provider.Verifier(&oidc.Config{
+		SkipClientIDCheck: true, // Access tokens don't require client ID check
+	}).Verify(ctx, accessToken)
+}
+
+// SessionDPoPKey returns the DPoP key the tokens of the request's session are
+// bound to, nil for bearer requests and sessions without DPoP. RequireAuth
+// must run first.
+func (m *AuthMiddleware) SessionDPoPKey(c *gin.Context) (*auth.DPoPKey, error) {
+	rawSession, exists := c.Get("user_session")
+	if !exists {
+		return nil, nil
+	}
+	sessionData, ok := rawSession.(*store.SessionData)
+	if !ok {
+		return nil, nil
+	}
+	return m.dpopKey(c, sessionData)
+}
+
+// dpopKey loads the DPoP key of a session, nil when it has none
+func (m *AuthMiddleware) dpopKey(ctx context.Context, sessionData *store.SessionData) (*auth.DPoPKey, error) {
+	if sessionData.DPoPKeyID == "" {
+		return nil, nil
+	}
+	jwk, err := m.dpopStore.WithTenant(sessionData.Realm).GetKey(ctx, sessionData.DPoPKeyID)
+	if err != nil {
+		return nil, err
+	}
+	return auth.ParseDPoPKey(jwk)
+}
+
+// refreshRejected reports whether a refresh failed for good: Keycloak
+// rejected the refresh token or the DPoP key it is bound to is gone
+func refreshRejected(err error) bool {
+	return auth.IsInvalidGrant(err) || errors.Is(err, store.ErrDPoPKeyNotFound)
+}
+
+// refreshSession renews the tokens of a session with its refresh token,
+// persists them and returns the claims of the new access token
+func (m *AuthMiddleware) refreshSession(
+	c *gin.Context,
+	authClient *auth.Client,
+	sessionStore store.SessionStore,
+	sessionID string,
+	sessionData *store.SessionData,
+) (map[string]interface{}, error) {
+	// DPoP bound refresh tokens need a proof from the session key
+	dpopKey, err := m.dpopKey(c, sessionData)
+	if err != nil {
+		return nil, err
+	}
+	// Offline sessions share their refresh token with background jobs, the
+	// offline store holds the current one
+	refreshToken := sessionData.RefreshToken
+	var offlineStore store.OfflineTokenStore
+	if sessionData.OfflineAccess && m.offlineStore != nil {
+		offlineStore = m.offlineStore.WithTenant(sessionData.Realm)
+		stored, err := offlineStore.Get(c, sessionData.UserInfo.Subject)
+		switch {
+		case err == nil:
+			refreshToken = stored
+		case errors.Is(err, store.ErrOfflineTokenNotFound):
+			// Withdrawn, the session copy was revoked along with it
+			offlineStore = nil
+		default:
+			return nil, err
+		}
+	}
+	oauthToken, err := authClient.Refresh(c, refreshToken, dpopKey)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := m.validateAccessToken(c, authClient, oauthToken.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	previousAccessToken := sessionData.AccessToken
+	sessionData.AccessToken = oauthToken.AccessToken
+	// Keycloak rotates refresh tokens unless disabled in the realm
+	if oauthToken.RefreshToken != "" {
+		sessionData.RefreshToken = oauthToken.RefreshToken
+		if offlineStore != nil {
+			err := offlineStore.Set(c, sessionData.UserInfo.Subject, oauthToken.RefreshToken)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	// Pick up profile changes, keeping the previous values if UserInfo fails
+	userInfoClaims, err := authClient.UserInfo(c, oauthToken.AccessToken, dpopKey)
+	if err == nil {
+		err = sessionData.UserInfo.ReplaceClaims(userInfoClaims)
+	}
+	if err != nil {
+		slog.WarnContext(c, "failed to refresh user info", "error", err)
+	}
+	if err := sessionStore.Set(c, sessionID, *sessionData); err != nil {
+		return nil, err
+	}
+	// Tokens exchanged for the previous access token are revoked with the session
+	for _, token := range authClient.MoveDownstreamTokens(previousAccessToken, oauthToken.AccessToken) {
+		if err := authClient.Revoke(c, token.AccessToken, "access_token"); err != nil {
+			slog.WarnContext(c, "failed to revoke downstream token", "error", err)
+		}
+	}
+	return claims, nil
+}
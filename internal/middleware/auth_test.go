@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"authorization_flow_keycloak/internal/auth"
+	"authorization_flow_keycloak/internal/store"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRefreshRejected(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"revoked refresh token", &auth.TokenError{StatusCode: 400, Code: "invalid_grant"}, true},
+		{"DPoP key expired", fmt.Errorf("load key: %w", store.ErrDPoPKeyNotFound), true},
+		{"keycloak unavailable", &auth.TokenError{StatusCode: 503}, false},
+		{"timeout", context.DeadlineExceeded, false},
+		{"redis failure", fmt.Errorf("failed to store session: %w", context.Canceled), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := refreshRejected(tt.err); got != tt.want {
+				t.Fatalf("refreshRejected(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// testRealm serves the realm "acme" of a Keycloak: discovery, the keys
+// access tokens are signed with and, when set, the introspection endpoint
+type testRealm struct {
+	*httptest.Server
+	key        *ecdsa.PrivateKey
+	introspect http.HandlerFunc
+}
+
+func newTestRealm(t *testing.T) *testRealm {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	realm := &testRealm{key: key}
+	realm.Server = httptest.NewServer(http.HandlerFunc(realm.serve))
+	t.Cleanup(realm.Close)
+	return realm
+}
+
+func (r *testRealm) issuer() string {
+	return r.URL + "/realms/acme"
+}
+
+func (r *testRealm) serve(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch strings.TrimPrefix(req.URL.Path, "/realms/acme/") {
+	case ".well-known/openid-configuration":
+		discovery := map[string]interface{}{
+			"issuer":                                r.issuer(),
+			"authorization_endpoint":                r.issuer() + "/protocol/openid-connect/auth",
+			"token_endpoint":                        r.issuer() + "/protocol/openid-connect/token",
+			"jwks_uri":                              r.issuer() + "/protocol/openid-connect/certs",
+			"id_token_signing_alg_values_supported": []string{string(jose.ES256)},
+		}
+		if r.introspect != nil {
+			discovery["introspection_endpoint"] = r.issuer() + "/protocol/openid-connect/token/introspect"
+		}
+		_ = json.NewEncoder(w).Encode(discovery)
+	case "protocol/openid-connect/certs":
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+			Key: &r.key.PublicKey, KeyID: "realm-key", Algorithm: string(jose.ES256), Use: "sig",
+		}}})
+	case "protocol/openid-connect/token/introspect":
+		r.introspect(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// client returns the auth client of the realm, introspecting tokens when
+// the realm answers introspection
+func (r *testRealm) client(t *testing.T) *auth.Client {
+	t.Helper()
+	client, err := auth.New(context.Background(), &auth.Config{
+		BaseURL:       r.URL,
+		ClientID:      "app",
+		ClientSecret:  "secret",
+		RedirectURL:   "http://localhost/auth/callback",
+		Realm:         "acme",
+		Introspection: r.introspect != nil,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// accessToken returns an access token of the realm with the claims, valid
+// for five minutes
+func (r *testRealm) accessToken(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: r.key},
+		(&jose.SignerOptions{}).WithHeader("kid", "realm-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := map[string]interface{}{
+		"iss": r.issuer(),
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(5 * time.Minute).Unix(),
+	}
+	for name, value := range claims {
+		all[name] = value
+	}
+	token, err := jwt.Signed(signer).Claims(all).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestRequireAuthIntrospection(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		body        string
+		wantStatus  int
+		wantSession bool
+	}{
+		{name: "revoked token", status: http.StatusOK, body: `{"active":false}`, wantStatus: http.StatusUnauthorized},
+		{name: "keycloak down", status: http.StatusBadGateway, wantStatus: http.StatusServiceUnavailable, wantSession: true},
+		{name: "client rejected", status: http.StatusUnauthorized, body: `{"error":"invalid_client"}`, wantStatus: http.StatusServiceUnavailable, wantSession: true},
+		{name: "unparsable response", status: http.StatusOK, body: `<html></html>`, wantStatus: http.StatusServiceUnavailable, wantSession: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The opaque session token cannot be verified locally either
+			realm := newTestRealm(t)
+			realm.introspect = func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}
+			authClient := realm.client(t)
+			rds := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+			t.Cleanup(func() { rds.Close() })
+			sessions := memorySessionStore{"session-1": {Realm: "acme", AccessToken: "opaque-token"}}
+			m := &AuthMiddleware{
+				sessionStore:       sessions,
+				introspectionStore: store.NewIntrospectionRedisManager(rds, time.Minute),
+			}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.GET("/", func(c *gin.Context) {
+				c.Set(tenantKey, "acme")
+				c.Set(authClientKey, authClient)
+				c.Set(apiRequestKey, true)
+			}, m.RequireAuth(), func(c *gin.Context) {
+				c.Status(http.StatusNoContent)
+			})
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.AddCookie(&http.Cookie{Name: "session_id", Value: "session-1"})
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if _, ok := sessions["session-1"]; ok != tt.wantSession {
+				t.Fatalf("session kept = %v, want %v", ok, tt.wantSession)
+			}
+		})
+	}
+}
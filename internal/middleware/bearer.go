@@ -0,0 +1,161 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"authorization_flow_keycloak/internal/auth"
+	"authorization_flow_keycloak/internal/logging"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Authorization schemes accepted on bearer API routes
+const (
+	schemeBearer = "Bearer"
+	schemeDPoP   = "DPoP"
+)
+
+// RequireBearer authenticates API requests carrying an access token in the
+// Authorization header instead of a session cookie. Tokens bound to a DPoP key
+// (cnf.jkt claim) are only accepted with the DPoP scheme and a valid proof of
+// that key, so a token copied out of the session store is useless on its own.
+func (m *AuthMiddleware) RequireBearer() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, challenge := m.authenticateBearer(c, c.Request.Method, requestURL(c))
+		if challenge != nil {
+			challenge.abort(c)
+			return
+		}
+
+		c.Set("user_claims", claims)
+		c.Next()
+	}
+}
+
+// bearerChallenge describes why a bearer request was rejected
+type bearerChallenge struct {
+	scheme      string
+	code        string
+	description string
+	// unavailable is set when the token could not be checked, which is
+	// answered with 503 instead of a challenge
+	unavailable bool
+}
+
+// abort ends the request with the challenge
+//
+// Returns:
+// - 401: Unauthorized with the WWW-Authenticate challenge
+// - 503: Service Unavailable if the token could not be checked
+func (b *bearerChallenge) abort(c *gin.Context) {
+	if b.unavailable {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": b.description})
+		return
+	}
+	abortUnauthorized(c, b.scheme, b.code, b.description)
+}
+
+// authenticateBearer validates the access token of the Authorization header
+// and its DPoP proof for the method and URL of the request the client made,
+// returning the challenge to answer when it is refused
+func (m *AuthMiddleware) authenticateBearer(c *gin.Context, method, htu string) (map[string]interface{}, *bearerChallenge) {
+	scheme, accessToken := authorizationHeader(c.Request)
+	if accessToken == "" {
+		return nil, &bearerChallenge{scheme: schemeBearer, code: "invalid_request", description: "missing access token"}
+	}
+	claims, err := m.validateAccessToken(c, AuthClient(c), accessToken)
+	if errors.Is(err, auth.ErrIntrospectionUnavailable) {
+		return nil, &bearerChallenge{description: "token introspection unavailable", unavailable: true}
+	}
+	if err != nil {
+		return nil, &bearerChallenge{scheme: scheme, code: "invalid_token", description: "access token is invalid or expired"}
+	}
+	if err := m.checkDPoP(c, scheme, accessToken, claims, method, htu); err != nil {
+		return nil, &bearerChallenge{scheme: schemeDPoP, code: "invalid_dpop_proof", description: err.Error()}
+	}
+	subject, _ := claims["sub"].(string)
+	logging.SetSubject(c, subject)
+	return claims, nil
+}
+
+// checkDPoP enforces the proof of possession for DPoP bound tokens, the
+// proof must be made for method and htu
+func (m *AuthMiddleware) checkDPoP(
+	c *gin.Context,
+	scheme, accessToken string,
+	claims map[string]interface{},
+	method, htu string,
+) error {
+	jkt := confirmationThumbprint(claims)
+	if jkt == "" {
+		if scheme == schemeDPoP {
+			return errors.New("access token is not DPoP bound")
+		}
+		return nil
+	}
+	if scheme != schemeDPoP {
+		return errors.New("DPoP bound token sent with the Bearer scheme")
+	}
+
+	proofs := c.Request.Header.Values("DPoP")
+	if len(proofs) != 1 {
+		return errors.New("exactly one DPoP proof is required")
+	}
+	proof, err := auth.VerifyDPoPProof(proofs[0], method, htu, accessToken)
+	if err != nil {
+		return err
+	}
+	if proof.Thumbprint != jkt {
+		return errors.New("DPoP proof is not signed by the token key")
+	}
+	// A proof is accepted once; keep its jti for as long as its iat is valid
+	fresh, err := m.dpopStore.WithTenant(Tenant(c)).MarkProofUsed(c, proof.ID, 2*auth.DPoPProofWindow)
+	if err != nil {
+		return fmt.Errorf("failed to check DPoP proof replay: %w", err)
+	}
+	if !fresh {
+		return errors.New("DPoP proof was replayed")
+	}
+	return nil
+}
+
+// authorizationHeader splits the Authorization header into scheme and token
+func authorizationHeader(r *http.Request) (string, string) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found {
+		return "", ""
+	}
+	switch {
+	case strings.EqualFold(scheme, schemeBearer):
+		return schemeBearer, strings.TrimSpace(token)
+	case strings.EqualFold(scheme, schemeDPoP):
+		return schemeDPoP, strings.TrimSpace(token)
+	}
+	return "", ""
+}
+
+// confirmationThumbprint returns the cnf.jkt claim of a DPoP bound token
+func confirmationThumbprint(claims map[string]interface{}) string {
+	cnf, _ := claims["cnf"].(map[string]interface{})
+	jkt, _ := cnf["jkt"].(string)
+	return jkt
+}
+
+// abortUnauthorized answers 401 with an RFC 6750 style WWW-Authenticate challenge
+func abortUnauthorized(c *gin.Context, scheme, code, description string) {
+	if scheme == "" {
+		scheme = schemeBearer
+	}
+	challenge := fmt.Sprintf(`%s error="%s", error_description="%s"`, scheme, code, description)
+	if scheme == schemeDPoP {
+		challenge += `, algs="ES256 ES384 ES512 RS256 PS256 EdDSA"`
+	}
+	c.Header("WWW-Authenticate", challenge)
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+		"error":             code,
+		"error_description": description,
+	})
+}
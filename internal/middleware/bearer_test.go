@@ -0,0 +1,130 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"authorization_flow_keycloak/internal/auth"
+	"authorization_flow_keycloak/internal/store"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestDPoPStore returns a DPoP store backed by miniredis
+func newTestDPoPStore(t *testing.T) store.DPoPStore {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	dpopStore, err := store.NewDPoPRedisManager(client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dpopStore
+}
+
+// testContext returns a gin context for a request from remoteAddr
+func testContext(r *http.Request, remoteAddr string, trusted *TrustedProxies) *gin.Context {
+	r.RemoteAddr = remoteAddr
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = r
+	trusted.Mark()(c)
+	return c
+}
+
+func TestRequestURL(t *testing.T) {
+	trusted, err := NewTrustedProxies([]string{"10.0.0.0/8", "192.0.2.10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		want       string
+	}{
+		{"trusted range", "10.1.2.3:5000", "https://app.example.com/api/reports"},
+		{"trusted address", "192.0.2.10:5000", "https://app.example.com/api/reports"},
+		{"any other client", "203.0.113.7:5000", "http://internal:8081/api/reports"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://internal:8081/api/reports?page=2", nil)
+			r.Header.Set("X-Forwarded-Proto", "https")
+			r.Header.Set("X-Forwarded-Host", "app.example.com")
+			if got := requestURL(testContext(r, tt.remoteAddr, trusted)); got != tt.want {
+				t.Fatalf("requestURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if _, err := NewTrustedProxies([]string{"proxy.internal"}); err == nil {
+		t.Fatal("host name accepted as trusted proxy")
+	}
+}
+
+func TestCheckDPoP(t *testing.T) {
+	const (
+		accessToken = "access-token"
+		htu         = "https://app.example.com/api/reports"
+	)
+	key, err := auth.NewDPoPKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := auth.NewDPoPKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bound := map[string]interface{}{"cnf": map[string]interface{}{"jkt": key.ID()}}
+	proof := func(key *auth.DPoPKey, method, url string) string {
+		proof, err := key.Proof(method, url, accessToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return proof
+	}
+	replayed := proof(key, http.MethodGet, htu)
+	m := &AuthMiddleware{dpopStore: newTestDPoPStore(t)}
+
+	tests := []struct {
+		name    string
+		scheme  string
+		claims  map[string]interface{}
+		proofs  []string
+		wantErr string
+	}{
+		{name: "bound token with proof", scheme: schemeDPoP, claims: bound, proofs: []string{replayed}},
+		{name: "replayed proof", scheme: schemeDPoP, claims: bound, proofs: []string{replayed}, wantErr: "replayed"},
+		{name: "proof for another URL", scheme: schemeDPoP, claims: bound, proofs: []string{proof(key, http.MethodGet, "https://evil.example.com/api/reports")}, wantErr: "htm/htu"},
+		{name: "proof for another method", scheme: schemeDPoP, claims: bound, proofs: []string{proof(key, http.MethodDelete, htu)}, wantErr: "htm/htu"},
+		{name: "proof of another key", scheme: schemeDPoP, claims: bound, proofs: []string{proof(other, http.MethodGet, htu)}, wantErr: "token key"},
+		{name: "bound token as bearer", scheme: schemeBearer, claims: bound, proofs: []string{proof(key, http.MethodGet, htu)}, wantErr: "Bearer scheme"},
+		{name: "no proof", scheme: schemeDPoP, claims: bound, wantErr: "exactly one"},
+		{name: "two proofs", scheme: schemeDPoP, claims: bound, proofs: []string{proof(key, http.MethodGet, htu), proof(key, http.MethodGet, htu)}, wantErr: "exactly one"},
+		{name: "bearer token", scheme: schemeBearer, claims: map[string]interface{}{}},
+		{name: "bearer token with DPoP scheme", scheme: schemeDPoP, claims: map[string]interface{}{}, wantErr: "not DPoP bound"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/reports", nil)
+			for _, proof := range tt.proofs {
+				r.Header.Add("DPoP", proof)
+			}
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = r
+			err := m.checkDPoP(c, tt.scheme, accessToken, tt.claims, http.MethodGet, htu)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"authorization_flow_keycloak/internal/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// memorySessionStore keeps sessions in a map
+type memorySessionStore map[string]store.SessionData
+
+func (m memorySessionStore) Set(_ context.Context, sessionID string, data store.SessionData) error {
+	m[sessionID] = data
+	return nil
+}
+
+func (m memorySessionStore) Get(_ context.Context, sessionID string) (*store.SessionData, error) {
+	data, ok := m[sessionID]
+	if !ok {
+		return nil, nil
+	}
+	return &data, nil
+}
+
+func (m memorySessionStore) Delete(_ context.Context, sessionID string) error {
+	delete(m, sessionID)
+	return nil
+}
+
+func (m memorySessionStore) WithTenant(string) store.SessionStore {
+	return m
+}
+
+func TestRequireCSRF(t *testing.T) {
+	const token = "csrf-token"
+	tests := []struct {
+		name   string
+		method string
+		header string
+		form   string
+		want   int
+	}{
+		{"safe method without token", http.MethodGet, "", "", http.StatusNoContent},
+		{"header", http.MethodPost, token, "", http.StatusNoContent},
+		{"form field", http.MethodPost, "", token, http.StatusNoContent},
+		{"missing token", http.MethodPost, "", "", http.StatusForbidden},
+		{"wrong token", http.MethodDelete, "other-token", "", http.StatusForbidden},
+		{"token prefix", http.MethodPost, token[:4], "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sessions := memorySessionStore{}
+			w := serveCSRF(sessions, &store.SessionData{CSRFToken: token}, tt.method, tt.header, tt.form)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequireCSRFAddsToken(t *testing.T) {
+	sessions := memorySessionStore{}
+	var seen string
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	m := &AuthMiddleware{sessionStore: sessions}
+	router.GET("/", func(c *gin.Context) {
+		c.Set("user_session", &store.SessionData{})
+	}, m.RequireCSRF(), func(c *gin.Context) {
+		seen = CSRFToken(c)
+	})
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: "session_id", Value: "session-1"})
+	router.ServeHTTP(httptest.NewRecorder(), r)
+
+	if seen == "" {
+		t.Fatal("no CSRF token for the template")
+	}
+	if stored := sessions["session-1"].CSRFToken; stored != seen {
+		t.Fatalf("stored token = %q, want %q", stored, seen)
+	}
+	// The new token protects the next unsafe request
+	w := serveCSRF(sessions, &store.SessionData{CSRFToken: seen}, http.MethodPost, "", "")
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+// serveCSRF sends one request through RequireCSRF for the session
+func serveCSRF(sessions store.SessionStore, sessionData *store.SessionData, method, header, form string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	m := &AuthMiddleware{sessionStore: sessions}
+	router.Handle(method, "/", func(c *gin.Context) {
+		c.Set("user_session", sessionData)
+	}, m.RequireCSRF(), func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+	body := url.Values{csrfFormField: {form}}.Encode()
+	r := httptest.NewRequest(method, "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if header != "" {
+		r.Header.Set(csrfHeader, header)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Identity headers answered by the forward-auth endpoint, and injected
+// upstream by the proxy configured with it
+const (
+	HeaderAuthUser    = "X-Auth-User"
+	HeaderAuthSubject = "X-Auth-Subject"
+	HeaderAuthEmail   = "X-Auth-Email"
+	HeaderAuthRoles   = "X-Auth-Roles"
+	HeaderAuthGroups  = "X-Auth-Groups"
+	// HeaderAuthRedirect holds the login URL on 401 answers
+	HeaderAuthRedirect = "X-Auth-Redirect"
+)
+
+// ForwardAuth serves the forward-auth endpoint of nginx auth_request,
+// Traefik ForwardAuth and Envoy ext_authz (HTTP service). The subrequest is
+// authenticated by its bearer token when it has an Authorization header and
+// by its session cookie otherwise, with the same checks as RequireBearer and
+// RequireAuth. The proxy copies the identity headers to the upstream request.
+// DPoP proofs are checked against the original request, see originalRequest.
+//
+// Returns:
+// - 200: authenticated, with X-Auth-User, X-Auth-Subject, X-Auth-Email,
+// X-Auth-Roles and X-Auth-Groups (comma separated)
+// - 401: Unauthorized with the login URL in X-Auth-Redirect, e.g. for nginx
+// auth_request_set $login $upstream_http_x_auth_redirect; error_page 401 =302 $login;
+func (m *AuthMiddleware) ForwardAuth(groups *Groups) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Decisions depend on the caller's credentials, never let a proxy cache them
+		c.Header("Cache-Control", "no-store")
+
+		var claims map[string]interface{}
+		if c.GetHeader("Authorization") != "" {
+			var challenge *bearerChallenge
+			method, htu := originalRequest(c)
+			if claims, challenge = m.authenticateBearer(c, method, htu); challenge != nil {
+				if !challenge.unavailable {
+					c.Header(HeaderAuthRedirect, loginURL(c))
+				}
+				challenge.abort(c)
+				return
+			}
+		} else {
+			var err error
+			_, claims, err = m.authenticateSession(c)
+			if errors.Is(err, errSessionUnavailable) {
+				c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				c.Header(HeaderAuthRedirect, loginURL(c))
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+					"error":     "unauthenticated",
+					"login_url": loginURL(c),
+				})
+				return
+			}
+		}
+		c.Set("user_claims", claims)
+
+		principal := groups.principal(c)
+		user := principal.Username
+		if user == "" {
+			user = principal.Subject
+		}
+		c.Header(HeaderAuthUser, user)
+		c.Header(HeaderAuthSubject, principal.Subject)
+		c.Header(HeaderAuthEmail, principal.Email)
+		c.Header(HeaderAuthRoles, strings.Join(principal.Roles, ","))
+		c.Header(HeaderAuthGroups, strings.Join(principal.Groups, ","))
+		c.Status(http.StatusOK)
+	}
+}
+
+// loginURL is the absolute login URL of the tenant, derived from the
+// configured callback URL since the forward-auth subrequest is addressed to
+// this service's internal host rather than the public one
+func loginURL(c *gin.Context) string {
+	redirectURL := AuthClient(c).Oauth.RedirectURL
+	return strings.TrimSuffix(redirectURL, "/auth/callback") + "/auth/login"
+}
+
+// originalRequest returns the method and htu of the request the proxy is
+// authorizing rather than of the subrequest to /auth/verify. Traefik sends
+// them in X-Forwarded-Method and X-Forwarded-Uri, nginx the URI in
+// X-Original-URI (proxy_set_header X-Original-URI $request_uri) and Envoy
+// appends the original path to the verify path. The headers are only
+// believed from trusted proxies.
+func originalRequest(c *gin.Context) (method, htu string) {
+	method = c.Request.Method
+	if forwarded := forwardedHeader(c, "X-Forwarded-Method"); forwarded != "" {
+		method = forwarded
+	}
+	path := c.Request.URL.Path
+	if envoyPath := c.Param("path"); envoyPath != "" {
+		path = envoyPath
+	}
+	for _, name := range []string{"X-Forwarded-Uri", "X-Original-URI"} {
+		if uri := forwardedHeader(c, name); uri != "" {
+			// The htu has no query, a malformed URI cannot match any proof
+			if parsed, err := url.ParseRequestURI(uri); err == nil {
+				path = parsed.Path
+			} else {
+				path = uri
+			}
+			break
+		}
+	}
+	return method, requestOrigin(c) + path
+}
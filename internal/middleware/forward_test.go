@@ -0,0 +1,212 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"authorization_flow_keycloak/internal/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestForwardAuth(t *testing.T) {
+	realm := newTestRealm(t)
+	authClient := realm.client(t)
+	trusted, err := NewTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := auth.NewDPoPKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := map[string]interface{}{
+		"sub":                "user-1",
+		"preferred_username": "alice",
+		"email":              "alice@example.com",
+		"realm_access":       map[string]interface{}{"roles": []string{"admin", "user"}},
+		"groups":             []string{"/engineering"},
+	}
+	bearerToken := realm.accessToken(t, identity)
+	boundToken := realm.accessToken(t, map[string]interface{}{
+		"sub": "user-1",
+		"cnf": map[string]interface{}{"jkt": key.ID()},
+	})
+
+	m := &AuthMiddleware{sessionStore: memorySessionStore{}, dpopStore: newTestDPoPStore(t)}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(trusted.Mark(), func(c *gin.Context) {
+		c.Set(tenantKey, "acme")
+		c.Set(authClientKey, authClient)
+	})
+	router.Any("/auth/verify", m.ForwardAuth(NewGroups("groups")))
+	router.Any("/auth/verify/*path", m.ForwardAuth(NewGroups("groups")))
+
+	tests := []struct {
+		name          string
+		target        string // the subrequest to the verify endpoint
+		remoteAddr    string
+		headers       map[string]string
+		authorization string
+		proofMethod   string // the DPoP proof is made for proofMethod and proofURL when set
+		proofURL      string
+		wantStatus    int
+	}{
+		{
+			name:          "bearer token",
+			target:        "/auth/verify",
+			authorization: "Bearer " + bearerToken,
+			wantStatus:    http.StatusOK,
+		},
+		{
+			name:       "no credentials",
+			target:     "/auth/verify",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:          "invalid token",
+			target:        "/auth/verify",
+			authorization: "Bearer not-a-token",
+			wantStatus:    http.StatusUnauthorized,
+		},
+		{
+			name:       "traefik",
+			target:     "/auth/verify",
+			remoteAddr: "10.0.0.2:4000",
+			headers: map[string]string{
+				"X-Forwarded-Method": http.MethodDelete,
+				"X-Forwarded-Uri":    "/api/reports/7?force=true",
+				"X-Forwarded-Proto":  "https",
+				"X-Forwarded-Host":   "app.example.com",
+			},
+			authorization: "DPoP " + boundToken,
+			proofMethod:   http.MethodDelete,
+			proofURL:      "https://app.example.com/api/reports/7",
+			wantStatus:    http.StatusOK,
+		},
+		{
+			name:       "nginx",
+			target:     "/auth/verify",
+			remoteAddr: "10.0.0.2:4000",
+			headers: map[string]string{
+				"X-Original-URI":    "/api/reports?page=2",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "app.example.com",
+			},
+			authorization: "DPoP " + boundToken,
+			proofMethod:   http.MethodGet,
+			proofURL:      "https://app.example.com/api/reports",
+			wantStatus:    http.StatusOK,
+		},
+		{
+			name:          "envoy",
+			target:        "http://app.example.com/auth/verify/api/reports",
+			authorization: "DPoP " + boundToken,
+			proofMethod:   http.MethodGet,
+			proofURL:      "http://app.example.com/api/reports",
+			wantStatus:    http.StatusOK,
+		},
+		{
+			name:       "proof for the verify subrequest",
+			target:     "/auth/verify",
+			remoteAddr: "10.0.0.2:4000",
+			headers: map[string]string{
+				"X-Forwarded-Uri":  "/api/reports",
+				"X-Forwarded-Host": "app.example.com",
+			},
+			authorization: "DPoP " + boundToken,
+			proofMethod:   http.MethodGet,
+			proofURL:      "http://app.example.com/auth/verify",
+			wantStatus:    http.StatusUnauthorized,
+		},
+		{
+			name:       "forwarded headers of an untrusted client",
+			target:     "/auth/verify",
+			remoteAddr: "203.0.113.7:4000",
+			headers: map[string]string{
+				"X-Forwarded-Uri":   "/api/reports",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "app.example.com",
+			},
+			authorization: "DPoP " + boundToken,
+			proofMethod:   http.MethodGet,
+			proofURL:      "https://app.example.com/api/reports",
+			wantStatus:    http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.remoteAddr != "" {
+				r.RemoteAddr = tt.remoteAddr
+			}
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			if tt.proofURL != "" {
+				proof, err := key.Proof(tt.proofMethod, tt.proofURL, boundToken)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.Header.Set("DPoP", proof)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code == http.StatusUnauthorized {
+				if got := w.Header().Get(HeaderAuthRedirect); got != "http://localhost/auth/login" {
+					t.Fatalf("%s = %q", HeaderAuthRedirect, got)
+				}
+			}
+		})
+	}
+}
+
+func TestForwardAuthIdentityHeaders(t *testing.T) {
+	realm := newTestRealm(t)
+	authClient := realm.client(t)
+	accessToken := realm.accessToken(t, map[string]interface{}{
+		"sub":                "user-1",
+		"preferred_username": "alice",
+		"email":              "alice@example.com",
+		"realm_access":       map[string]interface{}{"roles": []string{"admin", "user"}},
+		"groups":             []string{"/engineering", "/ops"},
+	})
+	m := &AuthMiddleware{sessionStore: memorySessionStore{}}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/auth/verify", func(c *gin.Context) {
+		c.Set(tenantKey, "acme")
+		c.Set(authClientKey, authClient)
+	}, m.ForwardAuth(NewGroups("groups")))
+
+	r := httptest.NewRequest(http.MethodGet, "/auth/verify", nil)
+	r.Header.Set("Authorization", "Bearer "+accessToken)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	want := map[string]string{
+		HeaderAuthUser:    "alice",
+		HeaderAuthSubject: "user-1",
+		HeaderAuthEmail:   "alice@example.com",
+		HeaderAuthRoles:   "admin,user",
+		HeaderAuthGroups:  "/engineering,/ops",
+		"Cache-Control":   "no-store",
+	}
+	for name, value := range want {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// trustedProxyKey marks requests received from one of the trusted proxies
+const trustedProxyKey = "trusted_proxy"
+
+// TrustedProxies decides whether the X-Forwarded-* headers of a request
+// describe the original request. They are only believed when the connection
+// comes from one of the configured reverse proxies, any client can send them.
+type TrustedProxies struct {
+	networks []*net.IPNet
+}
+
+// NewTrustedProxies parses the addresses and CIDR ranges of TRUSTED_PROXIES
+func NewTrustedProxies(proxies []string) (*TrustedProxies, error) {
+	t := &TrustedProxies{}
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			t.networks = append(t.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		t.networks = append(t.networks, network)
+	}
+	return t, nil
+}
+
+// Mark records whether the request comes from a trusted proxy
+func (t *TrustedProxies) Mark() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(trustedProxyKey, t.contains(net.ParseIP(c.RemoteIP())))
+		c.Next()
+	}
+}
+
+func (t *TrustedProxies) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range t.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHeader returns a X-Forwarded-* header of a request from a
+// trusted proxy, empty for any other request
+func forwardedHeader(c *gin.Context, name string) string {
+	if !c.GetBool(trustedProxyKey) {
+		return ""
+	}
+	return c.GetHeader(name)
+}
+
+// requestURL rebuilds the htu of the request: scheme, host and path without
+// query, as the client addressed it
+func requestURL(c *gin.Context) string {
+	return requestOrigin(c) + c.Request.URL.Path
+}
+
+// requestOrigin returns the scheme and host the client addressed, taken from
+// the forwarded headers of trusted proxies
+func requestOrigin(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := forwardedHeader(c, "X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	host := c.Request.Host
+	if forwarded := forwardedHeader(c, "X-Forwarded-Host"); forwarded != "" {
+		host = forwarded
+	}
+	return scheme + "://" + host
+}
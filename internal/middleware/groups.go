@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GroupMatch selects how RequireGroups compares group paths
+type GroupMatch int
+
+const (
+	ExactGroup      GroupMatch = iota // member of the group itself
+	GroupOrSubgroup                   // member of the group or of any group below it
+)
+
+// Groups authorizes requests by Keycloak group membership, read from the
+// groups claim of the verified token (a "Group Membership" mapper with full
+// group paths)
+type Groups struct {
+	claim string
+}
+
+// NewGroups creates the group middlewares for the configured groups claim
+func NewGroups(claim string) *Groups {
+	return &Groups{claim: claim}
+}
+
+// Principal makes the Principal of the verified claims set by RequireAuth or
+// RequireBearer available to handlers and templates
+func (g *Groups) Principal() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		g.principal(c)
+		c.Next()
+	}
+}
+
+// RequireGroups allows members of any of the groups. With GroupOrSubgroup
+// /engineering also admits members of /engineering/platform.
+//
+// Returns:
+// - 403: Forbidden if the user is in none of the groups
+func (g *Groups) RequireGroups(match GroupMatch, groups ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := g.principal(c)
+		for _, required := range groups {
+			for _, member := range principal.Groups {
+				if member == required || (match == GroupOrSubgroup && isSubgroup(member, required)) {
+					c.Next()
+					return
+				}
+			}
+		}
+		auditDenied(c, "groups", map[string]string{"groups": strings.Join(groups, ",")})
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error":  "access_denied",
+			"groups": groups,
+		})
+	}
+}
+
+// principal returns the principal of the request, building it on first use
+func (g *Groups) principal(c *gin.Context) *Principal {
+	if principal, ok := CurrentPrincipal(c); ok {
+		return principal
+	}
+	rawClaims, _ := c.Get("user_claims")
+	claims, _ := rawClaims.(map[string]interface{})
+	principal := newPrincipal(claims, g.claim)
+	c.Set(principalKey, principal)
+	return principal
+}
+
+// isSubgroup reports whether group lies below parent, comparing whole path
+// segments so /engineering-ops is not under /engineering
+func isSubgroup(group, parent string) bool {
+	return strings.HasPrefix(group, strings.TrimSuffix(parent, "/")+"/")
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRequireGroups(t *testing.T) {
+	tests := []struct {
+		name     string
+		member   []interface{}
+		match    GroupMatch
+		required []string
+		want     int
+	}{
+		{"exact member", []interface{}{"/engineering"}, ExactGroup, []string{"/engineering"}, http.StatusNoContent},
+		{"subgroup without subgroups", []interface{}{"/engineering/platform"}, ExactGroup, []string{"/engineering"}, http.StatusForbidden},
+		{"subgroup", []interface{}{"/engineering/platform"}, GroupOrSubgroup, []string{"/engineering"}, http.StatusNoContent},
+		{"parent with trailing slash", []interface{}{"/engineering/platform"}, GroupOrSubgroup, []string{"/engineering/"}, http.StatusNoContent},
+		{"sibling with the same prefix", []interface{}{"/engineering-ops"}, GroupOrSubgroup, []string{"/engineering"}, http.StatusForbidden},
+		{"parent of the required group", []interface{}{"/engineering"}, GroupOrSubgroup, []string{"/engineering/platform"}, http.StatusForbidden},
+		{"any of the groups", []interface{}{"/sales"}, ExactGroup, []string{"/engineering", "/sales"}, http.StatusNoContent},
+		{"non string entries skipped", []interface{}{42, "/sales"}, ExactGroup, []string{"/sales"}, http.StatusNoContent},
+		{"no groups", nil, GroupOrSubgroup, []string{"/engineering"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := map[string]interface{}{"sub": "user-1"}
+			if tt.member != nil {
+				claims["groups"] = tt.member
+			}
+			w := runWithClaims(claims, NewGroups("groups").RequireGroups(tt.match, tt.required...))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPrincipal(t *testing.T) {
+	principal := newPrincipal(map[string]interface{}{
+		"sub":                "user-1",
+		"preferred_username": "jane",
+		"email":              "jane@example.com",
+		"member_of":          []interface{}{"/engineering/platform"},
+		"realm_access":       map[string]interface{}{"roles": []interface{}{"reporting"}},
+	}, "member_of")
+	if principal.Subject != "user-1" || principal.Username != "jane" || principal.Email != "jane@example.com" {
+		t.Fatalf("principal = %+v", principal)
+	}
+	if len(principal.Groups) != 1 || principal.Groups[0] != "/engineering/platform" {
+		t.Fatalf("Groups = %v, want the configured claim", principal.Groups)
+	}
+	if len(principal.Roles) != 1 || principal.Roles[0] != "reporting" {
+		t.Fatalf("Roles = %v", principal.Roles)
+	}
+}
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestUnauthenticated(t *testing.T) {
+	tests := []struct {
+		name    string
+		api     bool
+		method  string
+		headers map[string]string
+		want    int
+	}{
+		{"browser navigation", false, http.MethodGet, map[string]string{"Accept": "text/html,application/xhtml+xml,*/*;q=0.8"}, http.StatusTemporaryRedirect},
+		{"form post", false, http.MethodPost, nil, http.StatusSeeOther},
+		{"route group of an API", true, http.MethodGet, map[string]string{"Accept": "text/html"}, http.StatusUnauthorized},
+		{"XHR", false, http.MethodGet, map[string]string{"X-Requested-With": "XMLHttpRequest"}, http.StatusUnauthorized},
+		{"fetch", false, http.MethodPost, map[string]string{"Sec-Fetch-Mode": "cors"}, http.StatusUnauthorized},
+		{"JSON client", false, http.MethodGet, map[string]string{"Accept": "application/problem+json"}, http.StatusUnauthorized},
+		{"JSON refused", false, http.MethodGet, map[string]string{"Accept": "application/json;q=0"}, http.StatusTemporaryRedirect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			if tt.api {
+				router.Use(APIResponses())
+			}
+			router.Handle(tt.method, "/dashboard/", unauthenticated)
+			r := httptest.NewRequest(tt.method, "/dashboard/", nil)
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// principalKey is the context key of the authenticated Principal
+const principalKey = "principal"
+
+// Principal is the identity behind a request, built from the verified token
+// claims by Groups.Principal for handlers and templates
+type Principal struct {
+	Subject  string
+	Username string
+	Email    string
+	Groups   []string // group paths, e.g. /engineering/platform
+	Roles    []string // realm roles
+	Claims   map[string]interface{}
+}
+
+// newPrincipal extracts the principal from access token claims
+func newPrincipal(claims map[string]interface{}, groupsClaim string) *Principal {
+	principal := &Principal{Claims: claims}
+	principal.Subject, _ = claims["sub"].(string)
+	principal.Username, _ = claims["preferred_username"].(string)
+	principal.Email, _ = claims["email"].(string)
+	principal.Groups = stringList(claims[groupsClaim])
+	realmAccess, _ := claims["realm_access"].(map[string]interface{})
+	principal.Roles = stringList(realmAccess["roles"])
+	return principal
+}
+
+// CurrentPrincipal returns the principal of the request, if any
+func CurrentPrincipal(c *gin.Context) (*Principal, bool) {
+	value, exists := c.Get(principalKey)
+	if !exists {
+		return nil, false
+	}
+	principal, ok := value.(*Principal)
+	return principal, ok
+}
+
+// stringList converts a JSON array claim to strings, skipping other values
+func stringList(value interface{}) []string {
+	values, _ := value.([]interface{})
+	list := make([]string, 0, len(values))
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			list = append(list, s)
+		}
+	}
+	return list
+}
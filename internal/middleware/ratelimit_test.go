@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"authorization_flow_keycloak/internal/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// keyLimiter records the keys it is asked about and refuses refused ones
+type keyLimiter struct {
+	keys    []string
+	refused map[string]bool
+}
+
+func (l *keyLimiter) Allow(_ context.Context, key string, _ int, _ time.Duration) (bool, time.Duration, error) {
+	l.keys = append(l.keys, key)
+	if l.refused[key] {
+		return false, 1500 * time.Millisecond, nil
+	}
+	return true, 0, nil
+}
+
+func TestRateLimit(t *testing.T) {
+	// SHA-256 of session-1
+	const sessionKey = "mw:auth::session:84097828fc31a8c8d29210df48901a85de7fd013f686b17be77d1be29cb7a98b"
+	tests := []struct {
+		name           string
+		trustedProxies []string
+		forwardedFor   string
+		session        bool
+		refused        string
+		wantKeys       []string
+		want           int
+	}{
+		{
+			name:         "spoofed X-Forwarded-For without trusted proxies",
+			forwardedFor: "203.0.113.7",
+			wantKeys:     []string{"mw:auth::ip:192.0.2.1"},
+			want:         http.StatusNoContent,
+		},
+		{
+			name:           "X-Forwarded-For of a trusted proxy",
+			trustedProxies: []string{"192.0.2.0/24"},
+			forwardedFor:   "203.0.113.7",
+			wantKeys:       []string{"mw:auth::ip:203.0.113.7"},
+			want:           http.StatusNoContent,
+		},
+		{
+			name:     "session counted too",
+			session:  true,
+			wantKeys: []string{"mw:auth::ip:192.0.2.1", sessionKey},
+			want:     http.StatusNoContent,
+		},
+		{
+			name:     "client IP over the limit",
+			session:  true,
+			refused:  "mw:auth::ip:192.0.2.1",
+			wantKeys: []string{"mw:auth::ip:192.0.2.1"},
+			want:     http.StatusTooManyRequests,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := &keyLimiter{refused: map[string]bool{tt.refused: true}}
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			if err := router.SetTrustedProxies(tt.trustedProxies); err != nil {
+				t.Fatal(err)
+			}
+			rule := config.RateLimitRule{Limit: 1, Window: time.Minute}
+			router.GET("/", NewRateLimit(limiter).Limit("auth", rule), func(c *gin.Context) {
+				c.Status(http.StatusNoContent)
+			})
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = "192.0.2.1:43210"
+			if tt.forwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			if tt.session {
+				r.AddCookie(&http.Cookie{Name: "session_id", Value: "session-1"})
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if len(limiter.keys) != len(tt.wantKeys) {
+				t.Fatalf("keys = %v, want %v", limiter.keys, tt.wantKeys)
+			}
+			for i := range tt.wantKeys {
+				if limiter.keys[i] != tt.wantKeys[i] {
+					t.Fatalf("keys = %v, want %v", limiter.keys, tt.wantKeys)
+				}
+			}
+			if tt.want == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "2" {
+				t.Fatalf("Retry-After = %q, want 2", w.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ScopeMatch selects how RequireScopes combines the required scopes
+type ScopeMatch int
+
+const (
+	AllScopes ScopeMatch = iota // every scope must be granted
+	AnyScope                    // at least one scope must be granted
+)
+
+// RequireScopes checks the space delimited scope claim of the verified
+// access token set by RequireBearer (or RequireAuth), which must run first.
+//
+// Returns:
+// - 403: Forbidden with an RFC 6750 insufficient_scope challenge
+func RequireScopes(match ScopeMatch, scopes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, _ := c.Get("user_claims")
+		granted := grantedScopes(claims)
+		allowed := match == AllScopes
+		for _, scope := range scopes {
+			if match == AllScopes && !granted[scope] {
+				allowed = false
+				break
+			}
+			if match == AnyScope && granted[scope] {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			auditDenied(c, "insufficient_scope", map[string]string{"scope": strings.Join(scopes, " ")})
+			abortInsufficientScope(c, scopes)
+			return
+		}
+		c.Next()
+	}
+}
+
+// grantedScopes parses the scope claim of the token claims
+func grantedScopes(claims interface{}) map[string]bool {
+	granted := make(map[string]bool)
+	values, _ := claims.(map[string]interface{})
+	scope, _ := values["scope"].(string)
+	for _, s := range strings.Fields(scope) {
+		granted[s] = true
+	}
+	return granted
+}
+
+// abortInsufficientScope answers 403 with the scopes the route needs (RFC 6750 section 3.1)
+func abortInsufficientScope(c *gin.Context, scopes []string) {
+	scheme, _ := authorizationHeader(c.Request)
+	if scheme == "" {
+		scheme = schemeBearer
+	}
+	description := "the access token does not grant the required scope"
+	c.Header("WWW-Authenticate", fmt.Sprintf(`%s error="insufficient_scope", error_description="%s", scope="%s"`,
+		scheme, description, strings.Join(scopes, " ")))
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+		"error":             "insufficient_scope",
+		"error_description": description,
+		"scope":             strings.Join(scopes, " "),
+	})
+}
@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// runWithClaims serves one request through handler with the verified token
+// claims RequireBearer would have set
+func runWithClaims(claims map[string]interface{}, handler gin.HandlerFunc) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/", func(c *gin.Context) {
+		if claims != nil {
+			c.Set("user_claims", claims)
+		}
+	}, handler, func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	return w
+}
+
+func TestRequireScopes(t *testing.T) {
+	tests := []struct {
+		name   string
+		scope  interface{}
+		match  ScopeMatch
+		scopes []string
+		want   int
+	}{
+		{"all granted", "openid reports:read reports:write", AllScopes, []string{"reports:read", "reports:write"}, http.StatusNoContent},
+		{"one of all missing", "openid reports:read", AllScopes, []string{"reports:read", "reports:write"}, http.StatusForbidden},
+		{"any granted", "openid reports:write", AnyScope, []string{"reports:read", "reports:write"}, http.StatusNoContent},
+		{"none of any granted", "openid", AnyScope, []string{"reports:read", "reports:write"}, http.StatusForbidden},
+		{"scope is a whole word", "reports:readonly", AllScopes, []string{"reports:read"}, http.StatusForbidden},
+		{"no scope claim", nil, AllScopes, []string{"reports:read"}, http.StatusForbidden},
+		{"scope claim not a string", []interface{}{"reports:read"}, AllScopes, []string{"reports:read"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := map[string]interface{}{"sub": "user-1"}
+			if tt.scope != nil {
+				claims["scope"] = tt.scope
+			}
+			w := runWithClaims(claims, RequireScopes(tt.match, tt.scopes...))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want != http.StatusForbidden {
+				return
+			}
+			want := fmt.Sprintf(`Bearer error="insufficient_scope", error_description="the access token does not grant the required scope", scope="%s"`,
+				strings.Join(tt.scopes, " "))
+			if got := w.Header().Get("WWW-Authenticate"); got != want {
+				t.Fatalf("WWW-Authenticate = %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package middleware
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"authorization_flow_keycloak/internal/auth"
+	"authorization_flow_keycloak/internal/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Context keys set by TenantResolver.Resolve
+const (
+	tenantKey     = "tenant"
+	authClientKey = "auth_client"
+	basePathKey   = "tenant_base_path"
+)
+
+// TenantResolver maps every request to a Keycloak realm and its auth client
+type TenantResolver struct {
+	config       *config.TenantConfig
+	defaultRealm string
+	clients      *auth.Registry
+}
+
+// NewTenantResolver creates a resolver for the configured tenant mode
+func NewTenantResolver(
+	cfg *config.TenantConfig,
+	defaultRealm string,
+	clients *auth.Registry,
+) *TenantResolver {
+	return &TenantResolver{
+		config:       cfg,
+		defaultRealm: defaultRealm,
+		clients:      clients,
+	}
+}
+
+// Resolve determines the realm of the request and stores it, together with
+// the realm's auth client, in the gin context for handlers and middlewares.
+func (t *TenantResolver) Resolve() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		realm, err := t.realm(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Unknown tenant"})
+			return
+		}
+		client, err := t.clients.Client(c, realm)
+		if errors.Is(err, auth.ErrUnknownRealm) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Unknown tenant"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadGateway,
+				gin.H{"error": "Failed to reach identity provider"})
+			return
+		}
+
+		basePath := ""
+		if t.config.Mode == config.TenantModePath {
+			basePath = "/t/" + realm
+		}
+		c.Set(tenantKey, realm)
+		c.Set(authClientKey, client)
+		c.Set(basePathKey, basePath)
+		c.Next()
+	}
+}
+
+func (t *TenantResolver) realm(c *gin.Context) (string, error) {
+	switch t.config.Mode {
+	case config.TenantModeSubdomain:
+		host := c.Request.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		labels := strings.Split(host, ".")
+		if len(labels) < 3 {
+			return "", errors.New("host has no tenant subdomain")
+		}
+		return labels[0], nil
+	case config.TenantModePath:
+		return c.Param("tenant"), nil
+	case config.TenantModeHeader:
+		if realm := c.GetHeader(t.config.Header); realm != "" {
+			return realm, nil
+		}
+		return t.defaultRealm, nil
+	default:
+		return t.defaultRealm, nil
+	}
+}
+
+// Tenant returns the realm resolved for the request
+func Tenant(c *gin.Context) string {
+	return c.GetString(tenantKey)
+}
+
+// AuthClient returns the auth client of the realm resolved for the request
+func AuthClient(c *gin.Context) *auth.Client {
+	client, _ := c.MustGet(authClientKey).(*auth.Client)
+	return client
+}
+
+// BasePath returns the URL prefix of the tenant ("/t/<realm>" in path mode),
+// used to build redirects and cookie paths that stay inside the tenant.
+func BasePath(c *gin.Context) string {
+	return c.GetString(basePathKey)
+}
+
+// CookiePath returns the path session cookies must be scoped to
+func CookiePath(c *gin.Context) string {
+	if basePath := BasePath(c); basePath != "" {
+		return basePath
+	}
+	return "/"
+}
@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"authorization_flow_keycloak/internal/auth"
+	"authorization_flow_keycloak/internal/config"
+	"authorization_flow_keycloak/internal/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PolicyEnforcer enforces Keycloak Authorization Services permissions on
+// session routes. Each route and method is mapped to the resources and scopes
+// it requires, Keycloak evaluates them by issuing an RPT and the decisions
+// are cached per session.
+type PolicyEnforcer struct {
+	config          *config.UMAConfig
+	permissionStore store.PermissionStore
+	authMiddleware  *AuthMiddleware // loads the DPoP key of the session
+}
+
+// NewPolicyEnforcer creates the enforcer for the configured route permissions
+func NewPolicyEnforcer(
+	cfg *config.UMAConfig,
+	permissionStore store.PermissionStore,
+	authMiddleware *AuthMiddleware,
+) *PolicyEnforcer {
+	return &PolicyEnforcer{
+		config:          cfg,
+		permissionStore: permissionStore,
+		authMiddleware:  authMiddleware,
+	}
+}
+
+// Enforce checks the permissions of the matched route. It must run after
+// RequireAuth. routePrefix is the path of the tenant route group, stripped
+// from the matched route before looking up its permissions.
+//
+// Returns:
+// - 403: Forbidden with the first denied permission
+// - 502: Bad Gateway if Keycloak cannot evaluate the permissions
+func (p *PolicyEnforcer) Enforce(routePrefix string) gin.HandlerFunc {
+	routePrefix = strings.TrimSuffix(routePrefix, "/")
+	return func(c *gin.Context) {
+		route := routeKey(c, routePrefix)
+		required := p.config.Permissions[route]
+		if len(required) == 0 {
+			c.Next()
+			return
+		}
+		rawSession, _ := c.Get("user_session")
+		sessionData, ok := rawSession.(*store.SessionData)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Invalid session data type"})
+			return
+		}
+		sessionID, _ := c.Cookie("session_id")
+
+		denied, err := p.denied(c, sessionID, sessionData.AccessToken, required)
+		if err != nil {
+			slog.WarnContext(c, "failed to evaluate permissions", "route", route, "error", err)
+			c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": "Failed to evaluate permissions"})
+			return
+		}
+		if denied != nil {
+			auditDenied(c, "uma_permission", map[string]string{"permission": denied.String()})
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error":      "access_denied",
+				"permission": denied.String(),
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// denied returns the first required permission that is not granted, nil when
+// all are. Only permissions missing from the cache are sent to Keycloak.
+func (p *PolicyEnforcer) denied(
+	c *gin.Context,
+	sessionID, accessToken string,
+	required []auth.Permission,
+) (*auth.Permission, error) {
+	cache := p.permissionStore.WithTenant(Tenant(c))
+	var uncached []auth.Permission
+	for i, permission := range required {
+		granted, ok, err := cache.Get(c, sessionID, permission.String())
+		if err != nil || !ok {
+			uncached = append(uncached, permission)
+			continue
+		}
+		if !granted {
+			return &required[i], nil
+		}
+	}
+	if len(uncached) == 0 {
+		return nil, nil
+	}
+
+	// The session token is sent as the subject, bound tokens need a proof
+	dpopKey, err := p.authMiddleware.SessionDPoPKey(c)
+	if err != nil {
+		return nil, err
+	}
+	rpt, err := AuthClient(c).RequestingPartyToken(c, accessToken, p.config.Audience, uncached, dpopKey)
+	if err != nil {
+		return nil, err
+	}
+	// A denial has no RPT expiry to follow, keep it for the default TTL
+	var expiresAt time.Time
+	if rpt != nil {
+		expiresAt = rpt.ExpiresAt
+	}
+	var denied *auth.Permission
+	for i, permission := range uncached {
+		granted := rpt.Granted(permission)
+		if err := cache.Set(c, sessionID, permission.String(), granted, expiresAt); err != nil {
+			slog.WarnContext(c, "failed to cache permission decision", "error", err)
+		}
+		if !granted && denied == nil {
+			denied = &uncached[i]
+		}
+	}
+	return denied, nil
+}
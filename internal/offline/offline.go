@@ -0,0 +1,86 @@
+// Package offline lets background jobs act on behalf of users who granted
+// offline access, using the offline refresh tokens kept in the offline store.
+package offline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"authorization_flow_keycloak/internal/auth"
+	"authorization_flow_keycloak/internal/store"
+
+	"golang.org/x/oauth2"
+)
+
+// ErrNoConsent is returned when the user has not granted offline access or
+// has withdrawn it in Keycloak
+var ErrNoConsent = errors.New("user has not granted offline access")
+
+// Tokens issues access tokens for offline users
+type Tokens struct {
+	authClients *auth.Registry
+	store       store.OfflineTokenStore
+}
+
+func NewTokens(authClients *auth.Registry, offlineStore store.OfflineTokenStore) *Tokens {
+	return &Tokens{
+		authClients: authClients,
+		store:       offlineStore,
+	}
+}
+
+// AccessToken returns a fresh access token for the user identified by
+// subject in realm, refreshed with the stored offline token. A rotated
+// offline token replaces the stored one.
+func (t *Tokens) AccessToken(ctx context.Context, realm, subject string) (*oauth2.Token, error) {
+	offlineStore := t.store.WithTenant(realm)
+	refreshToken, err := offlineStore.Get(ctx, subject)
+	if errors.Is(err, store.ErrOfflineTokenNotFound) {
+		return nil, ErrNoConsent
+	}
+	if err != nil {
+		return nil, err
+	}
+	authClient, err := t.authClients.Client(ctx, realm)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := authClient.Refresh(ctx, refreshToken, nil)
+	if auth.IsInvalidGrant(err) {
+		// Revoked in Keycloak (consent withdrawn, admin action): forget it,
+		// unless a concurrent refresh already stored its rotated successor
+		_ = offlineStore.CompareAndDelete(ctx, subject, refreshToken)
+		return nil, ErrNoConsent
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh offline token: %w", err)
+	}
+	if token.RefreshToken != "" && token.RefreshToken != refreshToken {
+		if err := offlineStore.Set(ctx, subject, token.RefreshToken); err != nil {
+			return nil, err
+		}
+	}
+	return token, nil
+}
+
+// Revoke withdraws the offline access of a user, at Keycloak and locally
+func (t *Tokens) Revoke(ctx context.Context, realm, subject string) error {
+	offlineStore := t.store.WithTenant(realm)
+	refreshToken, err := offlineStore.Get(ctx, subject)
+	if errors.Is(err, store.ErrOfflineTokenNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	authClient, err := t.authClients.Client(ctx, realm)
+	if err != nil {
+		return err
+	}
+	if err := authClient.Revoke(ctx, refreshToken, "refresh_token"); err != nil {
+		return err
+	}
+	return offlineStore.Delete(ctx, subject)
+}
@@ -0,0 +1,149 @@
+package offline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"authorization_flow_keycloak/internal/auth"
+	"authorization_flow_keycloak/internal/store"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newKeycloak serves discovery and a token endpoint rotating the offline
+// token "offline-1" to "offline-2" and rejecting any other
+func newKeycloak(t *testing.T) *httptest.Server {
+	t.Helper()
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		issuer := server.URL + "/realms/acme"
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/realms/acme/.well-known/openid-configuration":
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 issuer,
+				"authorization_endpoint": issuer + "/protocol/openid-connect/auth",
+				"token_endpoint":         issuer + "/protocol/openid-connect/token",
+				"jwks_uri":               issuer + "/protocol/openid-connect/certs",
+			})
+		case "/realms/acme/protocol/openid-connect/token":
+			if r.PostFormValue("refresh_token") != "offline-1" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token":  "access",
+				"token_type":    "Bearer",
+				"refresh_token": "offline-2",
+				"expires_in":    300,
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestAccessToken(t *testing.T) {
+	ctx := context.Background()
+	keycloak := newKeycloak(t)
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	offlineStore, err := store.NewOfflineTokenRedisManager(rdb, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authClients := auth.NewRegistry(&auth.Config{
+		BaseURL:      keycloak.URL,
+		ClientID:     "jobs",
+		ClientSecret: "secret",
+		Realm:        "acme",
+	}, []string{"acme"})
+	tokens := NewTokens(authClients, offlineStore)
+	users := offlineStore.WithTenant("acme")
+
+	if _, err := tokens.AccessToken(ctx, "acme", "user-1"); !errors.Is(err, ErrNoConsent) {
+		t.Fatalf("AccessToken without consent: %v, want ErrNoConsent", err)
+	}
+
+	if err := users.Set(ctx, "user-1", "offline-1"); err != nil {
+		t.Fatal(err)
+	}
+	token, err := tokens.AccessToken(ctx, "acme", "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "access" {
+		t.Fatalf("access token = %q", token.AccessToken)
+	}
+	if stored, _ := users.Get(ctx, "user-1"); stored != "offline-2" {
+		t.Fatalf("stored offline token = %q, want the rotated one", stored)
+	}
+
+	// Keycloak rejects the token once consent is withdrawn, it is forgotten
+	if _, err := tokens.AccessToken(ctx, "acme", "user-1"); !errors.Is(err, ErrNoConsent) {
+		t.Fatalf("AccessToken after invalid_grant: %v, want ErrNoConsent", err)
+	}
+	if _, err := users.Get(ctx, "user-1"); !errors.Is(err, store.ErrOfflineTokenNotFound) {
+		t.Fatalf("revoked offline token kept: %v", err)
+	}
+}
+
+// staleStore hands out stale once, as if the token was rotated by a
+// concurrent refresh right after it was read
+type staleStore struct {
+	store.OfflineTokenStore
+	stale string
+}
+
+func (s *staleStore) Get(ctx context.Context, subject string) (string, error) {
+	if s.stale != "" {
+		stale := s.stale
+		s.stale = ""
+		return stale, nil
+	}
+	return s.OfflineTokenStore.Get(ctx, subject)
+}
+
+func (s *staleStore) WithTenant(string) store.OfflineTokenStore {
+	return s
+}
+
+func TestAccessTokenKeepsRotatedToken(t *testing.T) {
+	ctx := context.Background()
+	keycloak := newKeycloak(t)
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	offlineStore, err := store.NewOfflineTokenRedisManager(rdb, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := offlineStore.WithTenant("acme")
+	if err := users.Set(ctx, "user-1", "offline-1"); err != nil {
+		t.Fatal(err)
+	}
+	authClients := auth.NewRegistry(&auth.Config{
+		BaseURL:      keycloak.URL,
+		ClientID:     "jobs",
+		ClientSecret: "secret",
+		Realm:        "acme",
+	}, []string{"acme"})
+	tokens := NewTokens(authClients, &staleStore{OfflineTokenStore: users, stale: "offline-0"})
+
+	// The rotated-away token is rejected, its successor must survive
+	if _, err := tokens.AccessToken(ctx, "acme", "user-1"); !errors.Is(err, ErrNoConsent) {
+		t.Fatalf("AccessToken with a stale token: %v, want ErrNoConsent", err)
+	}
+	if stored, err := users.Get(ctx, "user-1"); err != nil || stored != "offline-1" {
+		t.Fatalf("stored offline token = %q, %v, want the current one kept", stored, err)
+	}
+	if _, err := tokens.AccessToken(ctx, "acme", "user-1"); err != nil {
+		t.Fatalf("AccessToken with the current token: %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package policy
+
+import (
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// reloadInterval is how often the policy file is checked for changes
+const reloadInterval = 5 * time.Second
+
+// Engine evaluates requests against a policy file and reloads it when it
+// changes on disk. An invalid file is reported and the previous policy stays
+// in effect, so a bad edit cannot open or lock every route.
+type Engine struct {
+	path string
+
+	mu        sync.Mutex
+	policy    *Policy
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+// NewEngine loads the policy file, which must be valid at startup
+func NewEngine(path string) (*Engine, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Engine{
+		path:      path,
+		policy:    policy,
+		modTime:   info.ModTime(),
+		checkedAt: time.Now(),
+	}, nil
+}
+
+// Evaluate decides on a request with the current policy
+func (e *Engine) Evaluate(route string, attrs Attributes) Decision {
+	return e.current().Evaluate(route, attrs)
+}
+
+// current returns the policy, picking up changes of the file first
+func (e *Engine) current() *Policy {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if time.Since(e.checkedAt) < reloadInterval {
+		return e.policy
+	}
+	e.checkedAt = time.Now()
+	info, err := os.Stat(e.path)
+	if err != nil {
+		slog.Warn("failed to check policy file", "error", err)
+		return e.policy
+	}
+	if info.ModTime().Equal(e.modTime) {
+		return e.policy
+	}
+	// Remember the broken version too so it is reported only once
+	e.modTime = info.ModTime()
+	policy, err := Load(e.path)
+	if err != nil {
+		slog.Warn("keeping the previous policy", "error", err)
+		return e.policy
+	}
+	slog.Info("policy reloaded", "file", e.path, "rules", len(policy.Rules))
+	e.policy = policy
+	return e.policy
+}
@@ -0,0 +1,252 @@
+// Package policy evaluates the local attribute based access control rules
+// declared in a YAML file, complementing the roles and permissions managed
+// in Keycloak.
+//
+// A rule applies to routes written "METHOD /route" as registered in gin,
+// relative to the tenant root, with "*" matching any method and a trailing
+// "*" any route with that prefix. Rules are evaluated in order and the first
+// one whose conditions all hold decides. A route covered by rules is denied
+// when none of them holds, routes without rules are not restricted.
+//
+//	rules:
+//	  - name: same-tenant
+//	    routes: ["GET /dashboard/", "* /api/*"]
+//	    effect: allow
+//	    when:
+//	      - attr: claims.tenant_id
+//	        op: eq
+//	        ref: params.tenant
+//	      - attr: claims.realm_access.roles
+//	        op: contains
+//	        value: reporting
+//
+// Attributes are addressed with dotted paths: claims.<claim> for the verified
+// token claims, params.<name> for route parameters, query.<name>,
+// header.<Name>, request.method, request.path, request.ip and tenant.
+package policy
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Rule effects
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// Condition operators
+const (
+	OpEqual    = "eq"       // attribute equals the operand
+	OpNotEqual = "ne"       // attribute differs from the operand
+	OpIn       = "in"       // attribute is one of the operand values
+	OpContains = "contains" // attribute list contains the operand
+	OpPrefix   = "prefix"   // attribute string starts with the operand
+	OpPresent  = "present"  // attribute is set, the operand is ignored
+)
+
+// Policy is the content of a policy file
+type Policy struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Rule grants or denies access to routes when all its conditions hold
+type Rule struct {
+	Name   string      `yaml:"name"`
+	Routes []string    `yaml:"routes"`
+	Effect string      `yaml:"effect"`
+	When   []Condition `yaml:"when"`
+}
+
+// Condition compares an attribute to a literal value or to another attribute
+type Condition struct {
+	Attr  string      `yaml:"attr"`
+	Op    string      `yaml:"op"`
+	Value interface{} `yaml:"value"` // literal operand
+	Ref   string      `yaml:"ref"`   // attribute operand, takes precedence over Value
+}
+
+// Decision is the outcome of evaluating a request
+type Decision struct {
+	Allowed bool
+	Covered bool   // false when no rule applies to the route
+	Rule    string // name of the deciding rule, empty when none held
+}
+
+// Load reads and validates a policy file
+func Load(path string) (*Policy, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file %s: %w", path, err)
+	}
+	var policy Policy
+	if err := yaml.Unmarshal(raw, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse policy file %s: %w", path, err)
+	}
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
+	}
+	return &policy, nil
+}
+
+func (p *Policy) validate() error {
+	for i, rule := range p.Rules {
+		if rule.Name == "" {
+			return fmt.Errorf("rule %d has no name", i)
+		}
+		if rule.Effect != EffectAllow && rule.Effect != EffectDeny {
+			return fmt.Errorf("rule %s: effect must be %s or %s", rule.Name, EffectAllow, EffectDeny)
+		}
+		if len(rule.Routes) == 0 {
+			return fmt.Errorf("rule %s has no routes", rule.Name)
+		}
+		for _, route := range rule.Routes {
+			if _, path, found := strings.Cut(route, " "); !found || !strings.HasPrefix(path, "/") {
+				return fmt.Errorf("rule %s: invalid route %q, expected METHOD /route", rule.Name, route)
+			}
+		}
+		for _, condition := range rule.When {
+			if condition.Attr == "" {
+				return fmt.Errorf("rule %s: condition without attr", rule.Name)
+			}
+			switch condition.Op {
+			case OpEqual, OpNotEqual, OpIn, OpContains, OpPrefix, OpPresent:
+			default:
+				return fmt.Errorf("rule %s: unsupported op %q", rule.Name, condition.Op)
+			}
+		}
+	}
+	return nil
+}
+
+// Evaluate decides on a request to route ("METHOD /route") with the given
+// attributes
+func (p *Policy) Evaluate(route string, attrs Attributes) Decision {
+	decision := Decision{}
+	for _, rule := range p.Rules {
+		if !rule.matches(route) {
+			continue
+		}
+		decision.Covered = true
+		if rule.holds(attrs) {
+			decision.Allowed = rule.Effect == EffectAllow
+			decision.Rule = rule.Name
+			return decision
+		}
+	}
+	// Routes under policy are denied unless a rule allows them
+	decision.Allowed = !decision.Covered
+	return decision
+}
+
+func (r *Rule) matches(route string) bool {
+	method, path, _ := strings.Cut(route, " ")
+	for _, pattern := range r.Routes {
+		patternMethod, patternPath, _ := strings.Cut(pattern, " ")
+		if patternMethod != "*" && !strings.EqualFold(patternMethod, method) {
+			continue
+		}
+		if prefix, wildcard := strings.CutSuffix(patternPath, "*"); wildcard && strings.HasPrefix(path, prefix) {
+			return true
+		}
+		if patternPath == path {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) holds(attrs Attributes) bool {
+	for _, condition := range r.When {
+		if !condition.holds(attrs) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Condition) holds(attrs Attributes) bool {
+	value, ok := attrs.Lookup(c.Attr)
+	if c.Op == OpPresent {
+		return ok
+	}
+	if !ok {
+		return false
+	}
+	operand := c.Value
+	if c.Ref != "" {
+		if operand, ok = attrs.Lookup(c.Ref); !ok {
+			return false
+		}
+	}
+	switch c.Op {
+	case OpEqual:
+		return equal(value, operand)
+	case OpNotEqual:
+		return !equal(value, operand)
+	case OpIn:
+		return contains(operand, value)
+	case OpContains:
+		return contains(value, operand)
+	case OpPrefix:
+		s, isString := value.(string)
+		prefix, isPrefix := operand.(string)
+		return isString && isPrefix && strings.HasPrefix(s, prefix)
+	}
+	return false
+}
+
+// equal compares scalars by their string form, so a claim decoded from JSON
+// as float64 equals an integer written in YAML or a route parameter
+func equal(a, b interface{}) bool {
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+// contains reports whether list, a []interface{} or []string, holds item
+func contains(list, item interface{}) bool {
+	switch values := list.(type) {
+	case []interface{}:
+		for _, value := range values {
+			if equal(value, item) {
+				return true
+			}
+		}
+	case []string:
+		for _, value := range values {
+			if equal(value, item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Attributes are the values conditions refer to, nested maps are addressed
+// with dotted paths
+type Attributes map[string]interface{}
+
+// Lookup resolves a dotted path such as claims.realm_access.roles
+func (a Attributes) Lookup(path string) (interface{}, bool) {
+	var current interface{} = map[string]interface{}(a)
+	for _, part := range strings.Split(path, ".") {
+		var value interface{}
+		var ok bool
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok = node[part]
+		case map[string]string:
+			value, ok = node[part]
+		case Attributes:
+			value, ok = node[part]
+		}
+		if !ok {
+			return nil, false
+		}
+		current = value
+	}
+	return current, true
+}
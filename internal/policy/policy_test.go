@@ -0,0 +1,198 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testPolicy = `
+rules:
+  - name: admins
+    routes: ["* /api/*"]
+    effect: allow
+    when:
+      - attr: claims.realm_access.roles
+        op: contains
+        value: admin
+  - name: suspended
+    routes: ["* /api/*", "GET /dashboard/"]
+    effect: deny
+    when:
+      - attr: claims.suspended
+        op: present
+  - name: same-tenant
+    routes: ["GET /api/tenants/:tenant/reports"]
+    effect: allow
+    when:
+      - attr: claims.tenant_id
+        op: eq
+        ref: params.tenant
+      - attr: claims.level
+        op: in
+        value: [1, 2]
+  - name: internal
+    routes: ["POST /api/exports"]
+    effect: allow
+    when:
+      - attr: claims.email
+        op: prefix
+        value: ops@
+  - name: dashboard
+    routes: ["GET /dashboard/"]
+    effect: allow
+    when:
+      - attr: tenant
+        op: ne
+        value: staging
+`
+
+func writePolicy(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEvaluate(t *testing.T) {
+	policy, err := Load(writePolicy(t, testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := func(claims map[string]interface{}) Attributes {
+		return Attributes{"claims": claims, "params": map[string]string{"tenant": "acme"}, "tenant": "acme"}
+	}
+	tests := []struct {
+		name  string
+		route string
+		attrs Attributes
+		want  Decision
+	}{
+		{
+			name:  "first rule that holds decides",
+			route: "DELETE /api/users",
+			attrs: claims(map[string]interface{}{
+				"realm_access": map[string]interface{}{"roles": []interface{}{"admin"}},
+				"suspended":    true,
+			}),
+			want: Decision{Allowed: true, Covered: true, Rule: "admins"},
+		},
+		{
+			name:  "deny rule",
+			route: "GET /api/tenants/:tenant/reports",
+			attrs: claims(map[string]interface{}{"suspended": false, "tenant_id": "acme", "level": 1}),
+			want:  Decision{Allowed: false, Covered: true, Rule: "suspended"},
+		},
+		{
+			name:  "reference to a route parameter",
+			route: "GET /api/tenants/:tenant/reports",
+			attrs: claims(map[string]interface{}{"tenant_id": "acme", "level": float64(2)}),
+			want:  Decision{Allowed: true, Covered: true, Rule: "same-tenant"},
+		},
+		{
+			name:  "reference that differs",
+			route: "GET /api/tenants/:tenant/reports",
+			attrs: claims(map[string]interface{}{"tenant_id": "globex", "level": 1}),
+			want:  Decision{Allowed: false, Covered: true},
+		},
+		{
+			name:  "value not in the list",
+			route: "GET /api/tenants/:tenant/reports",
+			attrs: claims(map[string]interface{}{"tenant_id": "acme", "level": 3}),
+			want:  Decision{Allowed: false, Covered: true},
+		},
+		{
+			name:  "method must match",
+			route: "GET /api/exports",
+			attrs: claims(map[string]interface{}{"email": "ops@example.com"}),
+			want:  Decision{Allowed: false, Covered: true},
+		},
+		{
+			name:  "prefix",
+			route: "post /api/exports",
+			attrs: claims(map[string]interface{}{"email": "ops@example.com"}),
+			want:  Decision{Allowed: true, Covered: true, Rule: "internal"},
+		},
+		{
+			name:  "missing attribute",
+			route: "POST /api/exports",
+			attrs: claims(map[string]interface{}{}),
+			want:  Decision{Allowed: false, Covered: true},
+		},
+		{
+			name:  "not equal",
+			route: "GET /dashboard/",
+			attrs: claims(map[string]interface{}{}),
+			want:  Decision{Allowed: true, Covered: true, Rule: "dashboard"},
+		},
+		{
+			name:  "route without rules",
+			route: "GET /auth/userinfo",
+			attrs: claims(map[string]interface{}{}),
+			want:  Decision{Allowed: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.Evaluate(tt.route, tt.attrs); got != tt.want {
+				t.Fatalf("Evaluate(%q) = %+v, want %+v", tt.route, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"no name", "rules:\n  - routes: [\"GET /\"]\n    effect: allow\n"},
+		{"unknown effect", "rules:\n  - name: r\n    routes: [\"GET /\"]\n    effect: maybe\n"},
+		{"no routes", "rules:\n  - name: r\n    effect: allow\n"},
+		{"route without method", "rules:\n  - name: r\n    routes: [\"/api\"]\n    effect: allow\n"},
+		{"condition without attr", "rules:\n  - name: r\n    routes: [\"GET /\"]\n    effect: allow\n    when:\n      - op: eq\n"},
+		{"unknown op", "rules:\n  - name: r\n    routes: [\"GET /\"]\n    effect: allow\n    when:\n      - attr: tenant\n        op: like\n"},
+		{"not YAML", "rules: ["},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Load(writePolicy(t, tt.content)); err == nil {
+				t.Fatal("Load succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestEngineReload(t *testing.T) {
+	path := writePolicy(t, "rules:\n  - name: open\n    routes: [\"GET /\"]\n    effect: allow\n")
+	engine, err := NewEngine(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reload := func(content string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		engine.checkedAt = time.Time{}
+	}
+
+	if !engine.Evaluate("GET /", nil).Allowed {
+		t.Fatal("initial policy not applied")
+	}
+	reload("rules:\n  - name: closed\n    routes: [\"GET /\"]\n    effect: deny\n", time.Now().Add(time.Minute))
+	if decision := engine.Evaluate("GET /", nil); decision.Allowed || decision.Rule != "closed" {
+		t.Fatalf("Evaluate = %+v, want the reloaded policy", decision)
+	}
+	// A broken edit keeps the previous policy
+	reload("rules: [", time.Now().Add(2*time.Minute))
+	if decision := engine.Evaluate("GET /", nil); decision.Rule != "closed" {
+		t.Fatalf("Evaluate = %+v, want the previous policy", decision)
+	}
+}
@@ -0,0 +1,193 @@
+// Package proxy serves the configured upstream applications behind the
+// login of this service, like an authenticating reverse proxy.
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"authorization_flow_keycloak/internal/audit"
+	"authorization_flow_keycloak/internal/auth"
+	"authorization_flow_keycloak/internal/config"
+	"authorization_flow_keycloak/internal/middleware"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// identityHeaders are removed from incoming requests so clients cannot
+// impersonate a user, X-Auth-* headers are removed by prefix
+var identityHeaders = []string{
+	"X-Forwarded-User",
+	"X-Forwarded-Email",
+	"X-Forwarded-Groups",
+	"X-Forwarded-Preferred-Username",
+	"X-Remote-User",
+	"Remote-User",
+}
+
+// SessionKeys loads the DPoP key of the request's session, needed to
+// exchange the tokens of DPoP bound sessions
+type SessionKeys interface {
+	SessionDPoPKey(c *gin.Context) (*auth.DPoPKey, error)
+}
+
+// Upstream proxies authenticated requests to one configured application
+type Upstream struct {
+	config  config.UpstreamConfig
+	reverse *httputil.ReverseProxy
+	keys    SessionKeys
+}
+
+// NewUpstream creates the reverse proxy of an upstream. WebSocket upgrades
+// are passed through by httputil.ReverseProxy.
+func NewUpstream(cfg config.UpstreamConfig, keys SessionKeys) (*Upstream, error) {
+	target, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream url %q: %w", cfg.URL, err)
+	}
+	reverse := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.SetXForwarded()
+		},
+		// Stream responses such as server-sent events without buffering
+		FlushInterval: -1,
+		// Trace the upstream call and pass the trace context on
+		Transport: otelhttp.NewTransport(http.DefaultTransport, otelhttp.WithSpanNameFormatter(
+			func(_ string, r *http.Request) string {
+				return "upstream " + cfg.Name
+			},
+		)),
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.WarnContext(r.Context(), "upstream failed", "upstream", cfg.Name, "error", err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	return &Upstream{config: cfg, reverse: reverse, keys: keys}, nil
+}
+
+// Prefix is the path the upstream is served under, relative to the tenant root
+func (u *Upstream) Prefix() string {
+	return u.config.Prefix
+}
+
+// API reports whether unauthenticated requests get 401 JSON responses
+func (u *Upstream) API() bool {
+	return u.config.API
+}
+
+// Handler proxies the request. RequireSessionOrBearer and Groups.Principal
+// must run first.
+//
+// Returns:
+// - 403: Forbidden if the user has none of the upstream roles
+// - 502: Bad Gateway if the upstream or the token exchange fails
+func (u *Upstream) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal, ok := middleware.CurrentPrincipal(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "No principal found"})
+			return
+		}
+		if !u.allowed(principal) {
+			middleware.Audit(c, audit.Event{
+				Type:    audit.TypeAuthorizationDenied,
+				Outcome: audit.OutcomeFailure,
+				Reason:  "upstream_roles",
+				Details: map[string]string{"upstream": u.config.Name},
+			})
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "access_denied"})
+			return
+		}
+
+		req := c.Request.Clone(c.Request.Context())
+		if u.config.StripPrefix {
+			req.URL.Path = c.Param("path")
+			req.URL.RawPath = ""
+		}
+		stripIdentity(req.Header)
+		req.Header.Del("Authorization")
+		removeCookie(req, "session_id")
+		if u.config.PassAccessToken {
+			accessToken, err := u.accessToken(c)
+			if err != nil {
+				slog.WarnContext(c, "failed to get access token for upstream", "upstream", u.config.Name, "error", err)
+				c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": "Failed to obtain upstream token"})
+				return
+			}
+			req.Header.Set("Authorization", "Bearer "+accessToken)
+		}
+		user := principal.Username
+		if user == "" {
+			user = principal.Subject
+		}
+		req.Header.Set(middleware.HeaderAuthUser, user)
+		req.Header.Set(middleware.HeaderAuthSubject, principal.Subject)
+		req.Header.Set(middleware.HeaderAuthEmail, principal.Email)
+		req.Header.Set(middleware.HeaderAuthRoles, strings.Join(principal.Roles, ","))
+		req.Header.Set(middleware.HeaderAuthGroups, strings.Join(principal.Groups, ","))
+
+		u.reverse.ServeHTTP(c.Writer, req)
+	}
+}
+
+// allowed reports whether the principal has one of the upstream roles
+func (u *Upstream) allowed(principal *middleware.Principal) bool {
+	if len(u.config.Roles) == 0 {
+		return true
+	}
+	for _, required := range u.config.Roles {
+		for _, role := range principal.Roles {
+			if role == required {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// accessToken returns the token sent upstream, exchanged for the configured
+// audience when set
+func (u *Upstream) accessToken(c *gin.Context) (string, error) {
+	accessToken := middleware.AccessToken(c)
+	if u.config.TokenAudience == "" {
+		return accessToken, nil
+	}
+	dpopKey, err := u.keys.SessionDPoPKey(c)
+	if err != nil {
+		return "", err
+	}
+	token, err := middleware.AuthClient(c).DownstreamToken(c, accessToken, u.config.TokenAudience, dpopKey)
+	if err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// stripIdentity removes every identity header a client could forge
+func stripIdentity(header http.Header) {
+	for name := range header {
+		if strings.HasPrefix(name, "X-Auth-") {
+			header.Del(name)
+		}
+	}
+	for _, name := range identityHeaders {
+		header.Del(name)
+	}
+}
+
+// removeCookie drops a cookie from the request, keeping the others
+func removeCookie(req *http.Request, name string) {
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			req.AddCookie(cookie)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"authorization_flow_keycloak/internal/auth"
+	"authorization_flow_keycloak/internal/config"
+	"authorization_flow_keycloak/internal/middleware"
+	"authorization_flow_keycloak/internal/tracing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// installMemoryTracing installs the production propagators and a provider
+// keeping the finished spans in memory
+func installMemoryTracing(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	if _, err := tracing.Setup(context.Background(), &config.TracingConfig{Exporter: config.TracingExporterNone}); err != nil {
+		t.Fatal(err)
+	}
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		_ = provider.Shutdown(context.Background())
+	})
+	return exporter
+}
+
+func TestUpstreamTracing(t *testing.T) {
+	exporter := installMemoryTracing(t)
+
+	var traceparent string
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer app.Close()
+
+	upstream, err := NewUpstream(config.UpstreamConfig{Name: "grafana", Prefix: "/grafana", URL: app.URL}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(tracing.Middleware("test"))
+	router.GET("/grafana/*path", func(c *gin.Context) {
+		c.Set("user_claims", map[string]interface{}{"sub": "user-1"})
+	}, middleware.NewGroups("groups").Principal(), upstream.Handler())
+
+	// ReverseProxy needs a real connection, ResponseRecorder cannot close notify
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	// The caller's trace is continued
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	r, err := http.NewRequest(http.MethodGet, proxy.URL+"/grafana/api/health", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("traceparent", parent)
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+
+	// Wait for the handler, the server span ends after the response is sent
+	proxy.Close()
+	spans := exporter.GetSpans()
+	server, client := findSpan(t, spans, "/grafana/*path"), findSpan(t, spans, "upstream grafana")
+	if server.SpanKind != trace.SpanKindServer || server.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Fatalf("server span %v with parent %v, want a child of the caller", server.SpanKind, server.Parent.SpanID())
+	}
+	if client.SpanKind != trace.SpanKindClient || client.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Fatal("upstream span is not a client child of the server span")
+	}
+	for _, span := range spans {
+		if span.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Fatalf("span %s in trace %s, want the caller's", span.Name, span.SpanContext.TraceID())
+		}
+	}
+	want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + client.SpanContext.SpanID().String() + "-01"
+	if traceparent != want {
+		t.Fatalf("upstream traceparent = %q, want %q", traceparent, want)
+	}
+}
+
+// findSpan returns the span with the name
+func findSpan(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	t.Helper()
+	for _, span := range spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	t.Fatalf("no span %q in %d spans", name, len(spans))
+	return tracetest.SpanStub{}
+}
+
+// newKeycloak serves the discovery document of the realm "acme" and a token
+// endpoint exchanging any subject token for "exchanged-<audience>"
+func newKeycloak(t *testing.T) *httptest.Server {
+	t.Helper()
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		issuer := server.URL + "/realms/acme"
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/realms/acme/.well-known/openid-configuration":
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 issuer,
+				"authorization_endpoint": issuer + "/protocol/openid-connect/auth",
+				"token_endpoint":         issuer + "/protocol/openid-connect/token",
+				"jwks_uri":               issuer + "/protocol/openid-connect/certs",
+			})
+		case "/realms/acme/protocol/openid-connect/token":
+			if r.PostFormValue("subject_token") != "user-token" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error":"invalid_token"}`))
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token": "exchanged-" + r.PostFormValue("audience"),
+				"token_type":   "Bearer",
+				"expires_in":   300,
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// noSessionKeys is used for bearer requests, which have no session key
+type noSessionKeys struct{}
+
+func (noSessionKeys) SessionDPoPKey(*gin.Context) (*auth.DPoPKey, error) {
+	return nil, nil
+}
+
+func TestUpstreamHandler(t *testing.T) {
+	keycloak := newKeycloak(t)
+	registry := auth.NewRegistry(&auth.Config{
+		BaseURL:      keycloak.URL,
+		ClientID:     "app",
+		ClientSecret: "secret",
+		Realm:        "acme",
+	}, []string{"acme"})
+
+	tests := []struct {
+		name    string
+		config  config.UpstreamConfig
+		path    string
+		headers map[string]string
+		roles   []string // realm roles of the user
+
+		wantStatus int
+		wantPath   string            // path received upstream
+		wantHeader map[string]string // headers received upstream, "" for absent
+	}{
+		{
+			name:   "forged identity headers",
+			config: config.UpstreamConfig{Prefix: "/grafana"},
+			path:   "/grafana/api/health",
+			headers: map[string]string{
+				"X-Auth-User":      "admin",
+				"X-Auth-Tenant":    "other",
+				"X-Forwarded-User": "admin",
+				"Remote-User":      "admin",
+			},
+			wantStatus: http.StatusOK,
+			wantPath:   "/grafana/api/health",
+			wantHeader: map[string]string{
+				"X-Auth-User":      "alice",
+				"X-Auth-Subject":   "user-1",
+				"X-Auth-Email":     "alice@example.com",
+				"X-Auth-Roles":     "viewer",
+				"X-Auth-Groups":    "/engineering",
+				"X-Auth-Tenant":    "",
+				"X-Forwarded-User": "",
+				"Remote-User":      "",
+			},
+		},
+		{
+			name:       "session cookie",
+			config:     config.UpstreamConfig{Prefix: "/grafana"},
+			path:       "/grafana/",
+			headers:    map[string]string{"Cookie": "theme=dark; session_id=secret-session; lang=en"},
+			wantStatus: http.StatusOK,
+			wantPath:   "/grafana/",
+			wantHeader: map[string]string{"Cookie": "theme=dark; lang=en"},
+		},
+		{
+			name:       "missing role",
+			config:     config.UpstreamConfig{Prefix: "/admin", Roles: []string{"admin", "ops"}},
+			path:       "/admin/users",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "one of the roles",
+			config:     config.UpstreamConfig{Prefix: "/admin", Roles: []string{"admin", "ops"}},
+			path:       "/admin/users",
+			roles:      []string{"ops"},
+			wantStatus: http.StatusOK,
+			wantPath:   "/admin/users",
+			wantHeader: map[string]string{"X-Auth-Roles": "ops"},
+		},
+		{
+			name:       "strip prefix",
+			config:     config.UpstreamConfig{Prefix: "/grafana", StripPrefix: true},
+			path:       "/grafana/api/dashboards/uid/abc",
+			wantStatus: http.StatusOK,
+			wantPath:   "/api/dashboards/uid/abc",
+		},
+		{
+			name:       "access token withheld",
+			config:     config.UpstreamConfig{Prefix: "/grafana"},
+			path:       "/grafana/api/health",
+			headers:    map[string]string{"Authorization": "Bearer user-token"},
+			wantStatus: http.StatusOK,
+			wantHeader: map[string]string{"Authorization": ""},
+			wantPath:   "/grafana/api/health",
+		},
+		{
+			name:       "access token passed",
+			config:     config.UpstreamConfig{Prefix: "/api", PassAccessToken: true},
+			path:       "/api/reports",
+			headers:    map[string]string{"Authorization": "Bearer user-token"},
+			wantStatus: http.StatusOK,
+			wantPath:   "/api/reports",
+			wantHeader: map[string]string{"Authorization": "Bearer user-token"},
+		},
+		{
+			name:       "access token exchanged",
+			config:     config.UpstreamConfig{Prefix: "/api", PassAccessToken: true, TokenAudience: "reports"},
+			path:       "/api/reports",
+			headers:    map[string]string{"Authorization": "Bearer user-token"},
+			wantStatus: http.StatusOK,
+			wantPath:   "/api/reports",
+			wantHeader: map[string]string{"Authorization": "Bearer exchanged-reports"},
+		},
+		{
+			name:       "exchange refused",
+			config:     config.UpstreamConfig{Prefix: "/api", PassAccessToken: true, TokenAudience: "reports"},
+			path:       "/api/reports",
+			headers:    map[string]string{"Authorization": "Bearer other-token"},
+			wantStatus: http.StatusBadGateway,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received *http.Request
+			app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received = r
+			}))
+			defer app.Close()
+
+			tt.config.Name = "app"
+			tt.config.URL = app.URL
+			upstream, err := NewUpstream(tt.config, noSessionKeys{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			roles := tt.roles
+			if roles == nil {
+				roles = []string{"viewer"}
+			}
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.Use(middleware.NewTenantResolver(&config.TenantConfig{}, "acme", registry).Resolve())
+			router.Any(tt.config.Prefix+"/*path", func(c *gin.Context) {
+				c.Set("user_claims", map[string]interface{}{
+					"sub":                "user-1",
+					"preferred_username": "alice",
+					"email":              "alice@example.com",
+					"realm_access":       map[string]interface{}{"roles": toInterfaces(roles)},
+					"groups":             []interface{}{"/engineering"},
+				})
+			}, middleware.NewGroups("groups").Principal(), upstream.Handler())
+			proxy := httptest.NewServer(router)
+			defer proxy.Close()
+
+			r, err := http.NewRequest(http.MethodGet, proxy.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			resp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if received != nil {
+					t.Fatal("refused request reached the upstream")
+				}
+				return
+			}
+			if received.URL.Path != tt.wantPath {
+				t.Errorf("upstream path = %q, want %q", received.URL.Path, tt.wantPath)
+			}
+			for name, want := range tt.wantHeader {
+				if got := received.Header.Get(name); got != want {
+					t.Errorf("upstream %s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func toInterfaces(values []string) []interface{} {
+	list := make([]interface{}, len(values))
+	for i, value := range values {
+		list[i] = value
+	}
+	return list
+}
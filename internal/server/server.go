@@ -2,76 +2,353 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"time"
 
+	"authorization_flow_keycloak/internal/audit"
 	"authorization_flow_keycloak/internal/auth"
 	"authorization_flow_keycloak/internal/config"
 	"authorization_flow_keycloak/internal/handlers"
+	"authorization_flow_keycloak/internal/logging"
+	"authorization_flow_keycloak/internal/metrics"
 	"authorization_flow_keycloak/internal/middleware"
+	"authorization_flow_keycloak/internal/offline"
+	"authorization_flow_keycloak/internal/policy"
+	"authorization_flow_keycloak/internal/proxy"
 	"authorization_flow_keycloak/internal/store"
+	"authorization_flow_keycloak/internal/tracing"
 
 	"github.com/gin-gonic/gin"
 	"github.com/redis/go-redis/v9"
 )
 
 type Server struct {
-	router      *gin.Engine
-	config      *config.Config
-	authHandler *handlers.AuthHandler
+	router             *gin.Engine
+	config             *config.Config
+	authHandler        *handlers.AuthHandler
+	legacyLoginHandler *handlers.LegacyLoginHandler
+	upstreams          []*proxy.Upstream
+	rateLimit          *middleware.RateLimit
+	revocations        *auth.RevocationQueue
+	offlineHandler     *handlers.OfflineHandler // nil when offline access is disabled
 }
 
+// shutdownTimeout bounds the wait for in flight requests and queued token
+// revocations when the server stops
+const shutdownTimeout = 30 * time.Second
+
 func NewServer(c context.Context,
 	cfg *config.Config,
-	authClient *auth.Client,
+	authClients *auth.Registry,
 	redisClient *redis.Client,
 ) *Server {
-	router := gin.Default()
+	router := gin.New()
+	// Let slog find the request attributes through gin contexts
+	router.ContextWithFallback = true
+	// The client IP keys rate limits and audit events, only believe
+	// X-Forwarded-For from the configured proxies
+	if err := router.SetTrustedProxies(cfg.App.TrustedProxies); err != nil {
+		logging.Fatal("invalid TRUSTED_PROXIES", "error", err)
+	}
+	// and the original scheme and host in DPoP proofs from the same proxies
+	trustedProxies, err := middleware.NewTrustedProxies(cfg.App.TrustedProxies)
+	if err != nil {
+		logging.Fatal("invalid TRUSTED_PROXIES", "error", err)
+	}
+	router.Use(trustedProxies.Mark())
+	router.Use(tracing.Middleware(cfg.Tracing.ServiceName))
+	router.Use(logging.Middleware(), gin.Recovery(), metrics.Middleware())
+	router.Use(middleware.AuditLogger(newAuditLogger(cfg.Audit, redisClient)))
 	// / Load HTML templates
 	router.LoadHTMLGlob("../internal/templates/*.*")
 
 	// r.LoadHTMLGlob("../internal/templates/*/*.tmpl")
 	authStore := store.NewAuthRedisManager(redisClient)
-	sessionStore := store.NewSessionRedisManager(redisClient)
+	dpopStore, err := store.NewDPoPRedisManager(redisClient, cfg.Session.DPoPKeyEncryptionKey)
+	if err != nil {
+		logging.Fatal("failed to initialize DPoP store", "error", err)
+	}
+	revocations := auth.NewRevocationQueue(auth.RevocationWorkers, auth.RevocationQueueSize)
+	sessionManager := store.NewSessionRedisManager(redisClient)
+	metrics.RegisterActiveSessions(sessionManager.Count)
+	// Deleting a session anywhere also revokes its tokens at Keycloak, and
+	// saving it keeps its DPoP key alive
+	sessionStore := store.NewRevokingSessionStore(
+		store.NewDPoPKeySessionStore(
+			store.NewInstrumentedSessionStore(sessionManager, "redis"),
+			dpopStore,
+		),
+		newSessionRevoker(authClients, dpopStore, revocations),
+	)
+	introspectionStore := store.NewIntrospectionRedisManager(redisClient, cfg.Auth.IntrospectionCacheTTL)
+
+	deviceStore := store.NewDeviceRedisManager(redisClient)
+	var offlineStore store.OfflineTokenStore
+	if cfg.Offline.Enabled {
+		offlineTokens, err := store.NewOfflineTokenRedisManager(redisClient, cfg.Offline.EncryptionKey)
+		if err != nil {
+			logging.Fatal("failed to initialize offline token store", "error", err)
+		}
+		offlineStore = offlineTokens
+	}
 
-	authHandler := handlers.NewAuthHandler(authClient, authStore, sessionStore)
+	authHandler := handlers.NewAuthHandler(authStore, sessionStore, dpopStore, deviceStore, offlineStore)
+	// Resolve the realm of every request before authenticating it
+	tenantResolver := middleware.NewTenantResolver(cfg.Tenant, cfg.Auth.Realm, authClients)
 	// Initialize the auth middleware with your Keycloak configuration
 	authMiddleware := middleware.NewAuthMiddleware(
 		c,
-		authClient,
 		sessionStore,
+		dpopStore,
+		introspectionStore,
+		offlineStore,
+		cfg.Session.Refresh,
 	)
+	rateLimiter := store.NewRedisRateLimiter(redisClient)
+	legacyLoginHandler := handlers.NewLegacyLoginHandler(authHandler, cfg.LegacyLogin, rateLimiter)
 	server := &Server{
-		router:      router,
-		config:      cfg,
-		authHandler: authHandler,
+		router:             router,
+		config:             cfg,
+		authHandler:        authHandler,
+		legacyLoginHandler: legacyLoginHandler,
+		rateLimit:          middleware.NewRateLimit(rateLimiter),
+		revocations:        revocations,
+	}
+	if offlineStore != nil {
+		server.offlineHandler = handlers.NewOfflineHandler(offline.NewTokens(authClients, offlineStore))
+	}
+	// Applications served in reverse proxy mode
+	for _, upstreamConfig := range cfg.Proxy.Upstreams {
+		upstream, err := proxy.NewUpstream(upstreamConfig, authMiddleware)
+		if err != nil {
+			logging.Fatal("failed to initialize upstream", "upstream", upstreamConfig.Name, "error", err)
+		}
+		server.upstreams = append(server.upstreams, upstream)
+	}
+
+	// Keycloak Authorization Services decisions, nil when no route is mapped
+	var policyEnforcer *middleware.PolicyEnforcer
+	if cfg.UMA.Enabled {
+		policyEnforcer = middleware.NewPolicyEnforcer(
+			cfg.UMA,
+			store.NewPermissionRedisManager(redisClient, cfg.UMA.CacheTTL),
+			authMiddleware,
+		)
+	}
+
+	// Local ABAC policy, nil when no policy file is configured
+	var attributePolicy *middleware.AttributePolicy
+	if cfg.Policy.File != "" {
+		engine, err := policy.NewEngine(cfg.Policy.File)
+		if err != nil {
+			logging.Fatal("failed to load policy", "error", err)
+		}
+		attributePolicy = middleware.NewAttributePolicy(engine)
 	}
 
-	server.setupRoutes(authMiddleware)
+	server.setupRoutes(
+		tenantResolver,
+		authMiddleware,
+		policyEnforcer,
+		attributePolicy,
+		middleware.NewGroups(cfg.Groups.Claim),
+	)
 	return server
 }
 
-func (s *Server) setupRoutes(authMiddleware *middleware.AuthMiddleware) {
+func (s *Server) setupRoutes(
+	tenantResolver *middleware.TenantResolver,
+	authMiddleware *middleware.AuthMiddleware,
+	policyEnforcer *middleware.PolicyEnforcer,
+	attributePolicy *middleware.AttributePolicy,
+	groups *middleware.Groups,
+) {
 
 	// Health check
 	s.router.GET("/health", s.healthCheck)
+	// Prometheus metrics, only for scrapers holding the token
+	if s.config.App.MetricsToken != "" {
+		s.router.GET("/metrics", metrics.Handler(s.config.App.MetricsToken))
+	}
+
+	// Tenant scoped routes, mounted under /t/:tenant when the realm comes from the path
+	tenant := s.router.Group("/")
+	if s.config.Tenant.Mode == config.TenantModePath {
+		tenant = s.router.Group("/t/:tenant")
+	}
+	tenant.Use(tenantResolver.Resolve())
 
 	// Serve login page
-	s.router.GET("/", s.authHandler.ShowLoginPage)
+	tenant.GET("/", s.authHandler.ShowLoginPage)
+	tenant.POST("/logout",
+		authMiddleware.RequireAuth(),
+		authMiddleware.RequireCSRF(),
+		s.authHandler.LogoutHandler,
+	)
 
 	// Auth routes will be added later
-	auth := s.router.Group("/auth")
+	auth := tenant.Group("/auth")
+	auth.Use(s.limit("auth")...)
 	{
 		auth.GET("/login", s.authHandler.LoginHandler)
 		auth.GET("/callback", s.authHandler.CallbackHandler)
+		auth.GET("/jwks", s.authHandler.JWKSHandler)
+		if s.offlineHandler != nil {
+			auth.GET("/offline", s.authHandler.ShowOfflineConsentPage)
+			auth.POST("/offline/revoke",
+				authMiddleware.RequireAuth(),
+				authMiddleware.RequireCSRF(),
+				s.offlineHandler.RevokeHandler,
+			)
+		}
+		// Device authorization grant for CLI and TV clients
+		auth.GET("/device", s.authHandler.ShowDevicePage)
+		auth.POST("/device", s.authHandler.StartDeviceHandler)
+		auth.POST("/device/token", s.authHandler.DeviceTokenHandler)
+		// Legacy integrations only, disabled unless explicitly configured
+		if s.config.LegacyLogin.Enabled {
+			auth.POST("/password", s.legacyLoginHandler.PasswordLoginHandler)
+			auth.POST("/apikey", s.legacyLoginHandler.APIKeyLoginHandler)
+		}
+	}
+
+	// Forward authentication for nginx auth_request, Traefik and Envoy. The
+	// proxy asks once per request of every user, so it has its own rate limit
+	// group instead of the one of the login routes. Subrequests keep the
+	// original method, Envoy also appends the original path.
+	verify := tenant.Group("/auth/verify")
+	verify.Use(s.limit("verify")...)
+	{
+		verify.Any("", authMiddleware.ForwardAuth(groups))
+		verify.Any("/*path", authMiddleware.ForwardAuth(groups))
 	}
 
 	// Protected routes
-	protected := s.router.Group("/dashboard")
-	protected.Use(authMiddleware.RequireAuth())
+	protected := tenant.Group("/dashboard")
+	protected.Use(s.limit("dashboard")...)
+	protected.Use(authMiddleware.RequireAuth(), authMiddleware.RequireCSRF(), groups.Principal())
+	if len(s.config.Groups.Dashboard) > 0 {
+		protected.Use(groups.RequireGroups(middleware.GroupOrSubgroup, s.config.Groups.Dashboard...))
+	}
+	if policyEnforcer != nil {
+		protected.Use(policyEnforcer.Enforce(tenant.BasePath()))
+	}
+	if attributePolicy != nil {
+		protected.Use(attributePolicy.Enforce(tenant.BasePath()))
+	}
 	{
 		protected.GET("/", showDashboard)
 	}
+
+	// API routes authenticated with bearer or DPoP access tokens
+	api := tenant.Group("/api")
+	api.Use(s.limit("api")...)
+	api.Use(authMiddleware.RequireBearer(), groups.Principal())
+	if attributePolicy != nil {
+		api.Use(attributePolicy.Enforce(tenant.BasePath()))
+	}
+	{
+		api.GET("/me", middleware.RequireScopes(middleware.AllScopes, "profile"), showProfile)
+		// Access tokens of offline users for background jobs
+		if s.offlineHandler != nil {
+			api.POST("/offline/token",
+				middleware.RequireScopes(middleware.AllScopes, s.config.Offline.JobScope),
+				s.offlineHandler.TokenHandler,
+			)
+		}
+	}
+
+	// Upstream applications, the identity of the user is injected as X-Auth-* headers
+	for _, upstream := range s.upstreams {
+		handlers := s.limit("proxy")
+		if upstream.API() {
+			handlers = append(handlers, middleware.APIResponses())
+		}
+		handlers = append(handlers,
+			authMiddleware.RequireSessionOrBearer(),
+			groups.Principal(),
+			upstream.Handler(),
+		)
+		tenant.Any(upstream.Prefix(), handlers...)
+		tenant.Any(upstream.Prefix()+"/*path", handlers...)
+	}
+}
+
+// newAuditLogger creates the audit logger with the configured sinks
+func newAuditLogger(cfg *config.AuditConfig, redisClient *redis.Client) *audit.Logger {
+	var sinks []audit.Sink
+	if cfg.File != "" {
+		fileSink, err := audit.NewFileSink(cfg.File)
+		if err != nil {
+			logging.Fatal("failed to initialize audit log", "error", err)
+		}
+		sinks = append(sinks, fileSink)
+	}
+	if cfg.RedisStream != "" {
+		sinks = append(sinks, audit.NewRedisStreamSink(redisClient, cfg.RedisStream, 100000))
+	}
+	if len(sinks) == 0 {
+		sinks = append(sinks, audit.LogSink{})
+	}
+	redaction := audit.Redaction{}
+	for _, field := range cfg.Redact {
+		switch field {
+		case "email":
+			redaction.Email = true
+		case "ip":
+			redaction.IP = true
+		case "username":
+			redaction.Username = true
+		default:
+			logging.Fatal("unsupported AUDIT_REDACT field", "field", field)
+		}
+	}
+	return audit.NewLogger(redaction, sinks...)
+}
+
+// limit returns the rate limiting middleware of a route group, none when
+// RATE_LIMITS has no rule for it
+func (s *Server) limit(group string) []gin.HandlerFunc {
+	rule, ok := s.config.RateLimits[group]
+	if !ok {
+		return nil
+	}
+	return []gin.HandlerFunc{s.rateLimit.Limit(group, rule)}
+}
+
+// newSessionRevoker revokes the tokens of a deleted session at the realm
+// that issued them and drops the session's DPoP key
+func newSessionRevoker(
+	authClients *auth.Registry,
+	dpopStore store.DPoPStore,
+	revocations *auth.RevocationQueue,
+) store.SessionRevokerFunc {
+	return func(ctx context.Context, data store.SessionData) {
+		if data.DPoPKeyID != "" {
+			if err := dpopStore.WithTenant(data.Realm).DeleteKey(ctx, data.DPoPKeyID); err != nil {
+				slog.WarnContext(ctx, "failed to delete DPoP key", "error", err)
+			}
+		}
+		authClient, err := authClients.Client(ctx, data.Realm)
+		if err != nil {
+			slog.WarnContext(ctx, "cannot revoke session tokens", "realm", data.Realm, "error", err)
+			return
+		}
+		refreshToken := data.RefreshToken
+		if data.OfflineAccess {
+			// The offline token keeps serving background jobs after logout
+			refreshToken = ""
+		}
+		revocations.Revoke(authClient, refreshToken, data.AccessToken)
+		// Tokens exchanged on behalf of the session must not outlive it
+		for _, token := range authClient.EvictDownstreamTokens(data.AccessToken) {
+			revocations.Revoke(authClient, "", token.AccessToken)
+		}
+	}
 }
+
 func showDashboard(c *gin.Context) {
 	// Get session data with safe type assertion
 	rawSession, exists := c.Get("user_session")
@@ -85,19 +362,60 @@ func showDashboard(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid session data type"})
 		return
 	}
+	// Prefer the groups of the verified token, the UserInfo copy may be older
+	groups := sessionData.UserInfo.Groups
+	if principal, ok := middleware.CurrentPrincipal(c); ok && len(principal.Groups) > 0 {
+		groups = principal.Groups
+	}
 	// Now you can safely use the properly typed sessionData
 	c.HTML(http.StatusOK, "dashboard.tmpl", gin.H{
-		"username":  sessionData.UserInfo.Username,
-		"email":     sessionData.UserInfo.Email,
-		"createdat": sessionData.CreatedAt,
+		"username":   sessionData.UserInfo.Username,
+		"email":      sessionData.UserInfo.Email,
+		"givenname":  sessionData.UserInfo.GivenName,
+		"familyname": sessionData.UserInfo.FamilyName,
+		"locale":     sessionData.UserInfo.Locale,
+		"picture":    sessionData.UserInfo.Picture,
+		"groups":     groups,
+		"attributes": sessionData.UserInfo.Attributes,
+		"createdat":  sessionData.CreatedAt,
+		"logoutURL":  middleware.BasePath(c) + "/logout",
+		"csrfToken":  middleware.CSRFToken(c),
 	})
 }
+func showProfile(c *gin.Context) {
+	claims, ok := c.Get("user_claims")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "No claims found"})
+		return
+	}
+	c.JSON(http.StatusOK, claims)
+}
 func (s *Server) healthCheck(c *gin.Context) {
 	c.JSON(200, gin.H{
 		"status": "ok",
 	})
 }
 
-func (s *Server) Start() error {
-	return s.router.Run(s.config.App.Port)
+// Start serves requests until ctx is cancelled, then waits for the requests
+// in flight and the queued token revocations before returning
+func (s *Server) Start(ctx context.Context) error {
+	httpServer := &http.Server{Addr: s.config.App.Port, Handler: s.router}
+	served := make(chan error, 1)
+	go func() {
+		served <- httpServer.ListenAndServe()
+	}()
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to stop server: %w", err)
+	}
+	// Sessions ended by the last requests still get their tokens revoked
+	return s.revocations.Shutdown(shutdownCtx)
 }
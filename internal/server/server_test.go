@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"authorization_flow_keycloak/internal/auth"
+	"authorization_flow_keycloak/internal/config"
+	"authorization_flow_keycloak/internal/handlers"
+	"authorization_flow_keycloak/internal/middleware"
+	"authorization_flow_keycloak/internal/store"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// newKeycloak serves the discovery document of the realm "acme"
+func newKeycloak(t *testing.T) *httptest.Server {
+	t.Helper()
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/realms/acme/.well-known/openid-configuration" {
+			http.NotFound(w, r)
+			return
+		}
+		issuer := server.URL + "/realms/acme"
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer,
+			"authorization_endpoint": issuer + "/protocol/openid-connect/auth",
+			"token_endpoint":         issuer + "/protocol/openid-connect/token",
+			"jwks_uri":               issuer + "/protocol/openid-connect/certs",
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestVerifyRateLimit(t *testing.T) {
+	keycloak := newKeycloak(t)
+	authClients := auth.NewRegistry(&auth.Config{
+		BaseURL:      keycloak.URL,
+		ClientID:     "app",
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost/auth/callback",
+		Realm:        "acme",
+	}, []string{"acme"})
+	redisClient := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { redisClient.Close() })
+
+	cfg := &config.Config{
+		App:         &config.AppConfig{},
+		Tenant:      &config.TenantConfig{},
+		LegacyLogin: &config.LegacyLoginConfig{},
+		Groups:      &config.GroupsConfig{},
+		// The default rule
+		RateLimits: map[string]config.RateLimitRule{"auth": {Limit: 30, Window: time.Minute}},
+	}
+	sessionStore := store.NewSessionRedisManager(redisClient)
+	gin.SetMode(gin.TestMode)
+	s := &Server{
+		router:      gin.New(),
+		config:      cfg,
+		authHandler: handlers.NewAuthHandler(nil, sessionStore, nil, nil, nil),
+		rateLimit:   middleware.NewRateLimit(store.NewRedisRateLimiter(redisClient)),
+	}
+	s.setupRoutes(
+		middleware.NewTenantResolver(cfg.Tenant, "acme", authClients),
+		middleware.NewAuthMiddleware(context.Background(), sessionStore, nil, nil, nil, false),
+		nil,
+		nil,
+		middleware.NewGroups("groups"),
+	)
+
+	serve := func(path string) int {
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+	// A proxy asks for every request of every user
+	for i := 0; i < 50; i++ {
+		for _, path := range []string{"/auth/verify", "/auth/verify/api/reports"} {
+			if status := serve(path); status != http.StatusUnauthorized {
+				t.Fatalf("request %d to %s: status = %d, want %d", i+1, path, status, http.StatusUnauthorized)
+			}
+		}
+	}
+	// while the login routes keep their limit
+	for i := 0; i < 30; i++ {
+		if status := serve("/auth/jwks"); status == http.StatusTooManyRequests {
+			t.Fatalf("request %d to /auth/jwks rate limited", i+1)
+		}
+	}
+	if status := serve("/auth/jwks"); status != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want the auth rule to apply", status)
+	}
+}
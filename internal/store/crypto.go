@@ -0,0 +1,39 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// newAEAD creates the AES-GCM cipher protecting secrets kept in Redis from
+// a 32 byte AES-256 key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plain with a random nonce prepended to the ciphertext. The
+// Redis key is bound as additional data so ciphertexts cannot be swapped
+// between entries.
+func seal(aead cipher.AEAD, plain []byte, key string) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plain, []byte(key)), nil
+}
+
+// open decrypts a value produced by seal for the same Redis key
+func open(aead cipher.AEAD, sealed []byte, key string) ([]byte, error) {
+	nonceSize := aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, errors.New("ciphertext is too short")
+	}
+	return aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(key))
+}
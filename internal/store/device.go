@@ -0,0 +1,115 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrDeviceNotFound is returned when a device authorization expired or ended
+var ErrDeviceNotFound = errors.New("device authorization not found")
+
+// DeviceData tracks the polling state of a pending device authorization
+type DeviceData struct {
+	Interval int       `json:"interval"`  // seconds the device must wait between polls
+	NextPoll time.Time `json:"next_poll"` // earliest time of the next poll
+	// DPoPKeyID is the DPoPStore key created with the authorization, the
+	// tokens are bound to it when the device asks for a session
+	DPoPKeyID string `json:"dpop_key_id,omitempty"`
+}
+
+// DeviceStore defines the contract for pending device authorizations
+type DeviceStore interface {
+	SetDevice(ctx context.Context, deviceCode string, data DeviceData, ttl time.Duration) error
+	// UpdateDevice replaces the data, keeping the expiry set by SetDevice
+	UpdateDevice(ctx context.Context, deviceCode string, data DeviceData) error
+	GetDevice(ctx context.Context, deviceCode string) (*DeviceData, error)
+	DeleteDevice(ctx context.Context, deviceCode string) error
+	// WithTenant returns a store whose keys are namespaced to the tenant
+	WithTenant(tenant string) DeviceStore
+}
+
+type RedisDeviceManager struct {
+	client      *redis.Client
+	PrefixState string
+	tenant      string
+}
+
+func NewDeviceRedisManager(rds *redis.Client) *RedisDeviceManager {
+	return &RedisDeviceManager{
+		client:      rds,
+		PrefixState: "device",
+	}
+}
+
+// buildKeyState hashes the device code, which is a bearer secret until redeemed
+func (r *RedisDeviceManager) buildKeyState(deviceCode string) string {
+	sum := sha256.Sum256([]byte(deviceCode))
+	return buildKey(r.PrefixState, r.tenant, hex.EncodeToString(sum[:]))
+}
+
+// WithTenant returns a copy of the manager scoped to the tenant
+func (r *RedisDeviceManager) WithTenant(tenant string) DeviceStore {
+	scoped := *r
+	scoped.tenant = tenant
+	return &scoped
+}
+
+func (r *RedisDeviceManager) SetDevice(
+	ctx context.Context,
+	deviceCode string,
+	data DeviceData,
+	ttl time.Duration,
+) error {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal device data: %w", err)
+	}
+	if err := r.client.Set(ctx, r.buildKeyState(deviceCode), jsonData, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to set device data in Redis: %w", err)
+	}
+	return nil
+}
+
+func (r *RedisDeviceManager) UpdateDevice(ctx context.Context, deviceCode string, data DeviceData) error {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal device data: %w", err)
+	}
+	err = r.client.SetArgs(ctx, r.buildKeyState(deviceCode), jsonData, redis.SetArgs{
+		KeepTTL: true,
+		Mode:    "XX", // never resurrect an expired authorization
+	}).Err()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("failed to update device data in Redis: %w", err)
+	}
+	return nil
+}
+
+func (r *RedisDeviceManager) GetDevice(ctx context.Context, deviceCode string) (*DeviceData, error) {
+	data, err := r.client.Get(ctx, r.buildKeyState(deviceCode)).Result()
+	if err == redis.Nil {
+		return nil, ErrDeviceNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device data: %w", err)
+	}
+	var deviceData DeviceData
+	if err := json.Unmarshal([]byte(data), &deviceData); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal device data: %w", err)
+	}
+	return &deviceData, nil
+}
+
+func (r *RedisDeviceManager) DeleteDevice(ctx context.Context, deviceCode string) error {
+	if err := r.client.Del(ctx, r.buildKeyState(deviceCode)).Err(); err != nil {
+		return fmt.Errorf("failed to remove device data from Redis: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package store
+
+import (
+	"context"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"time"
+
+	"authorization_flow_keycloak/internal/constant"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrDPoPKeyNotFound is returned when a key expired or was deleted
+var ErrDPoPKeyNotFound = errors.New("DPoP key not found")
+
+// errDPoPKeysDisabled is returned when keys are stored without an encryption key
+var errDPoPKeysDisabled = errors.New("DPoP key encryption key is not configured")
+
+// DPoPStore keeps the per-session DPoP private keys and the replay cache of
+// proofs received on bearer API routes
+type DPoPStore interface {
+	SetKey(ctx context.Context, keyID string, jwk []byte) error
+	GetKey(ctx context.Context, keyID string) ([]byte, error)
+	DeleteKey(ctx context.Context, keyID string) error
+	// TouchKey extends the key to the session TTL again, the session keeps
+	// needing it for as long as it lives
+	TouchKey(ctx context.Context, keyID string) error
+	// MarkProofUsed records a proof jti until ttl elapses and reports
+	// false when the jti was already seen (a replayed proof)
+	MarkProofUsed(ctx context.Context, jti string, ttl time.Duration) (bool, error)
+	// WithTenant returns a store whose keys are namespaced to the tenant
+	WithTenant(tenant string) DPoPStore
+}
+
+// RedisDPoPManager stores the private keys AES-GCM encrypted, a Redis dump
+// must not be enough to use the tokens bound to them. Keys expire with the
+// session and are extended with TouchKey whenever the session is saved.
+type RedisDPoPManager struct {
+	client      *redis.Client
+	PrefixKey   string
+	PrefixProof string
+	tenant      string
+	defaultTTL  time.Duration
+	aead        cipher.AEAD
+}
+
+// NewDPoPRedisManager creates the DPoP store with a 32 byte AES-256 key. The
+// key may be empty when sessions are not DPoP bound, only the proof replay
+// cache is usable then.
+func NewDPoPRedisManager(rds *redis.Client, key []byte) (*RedisDPoPManager, error) {
+	manager := &RedisDPoPManager{
+		client:      rds,
+		PrefixKey:   "dpopkey",
+		PrefixProof: "dpopjti",
+		defaultTTL:  constant.SessionDuration,
+	}
+	if len(key) > 0 {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DPoP key encryption key: %w", err)
+		}
+		manager.aead = aead
+	}
+	return manager, nil
+}
+
+// WithTenant returns a copy of the manager scoped to the tenant
+func (r *RedisDPoPManager) WithTenant(tenant string) DPoPStore {
+	scoped := *r
+	scoped.tenant = tenant
+	return &scoped
+}
+
+func (r *RedisDPoPManager) SetKey(ctx context.Context, keyID string, jwk []byte) error {
+	if r.aead == nil {
+		return errDPoPKeysDisabled
+	}
+	key := buildKey(r.PrefixKey, r.tenant, keyID)
+	sealed, err := seal(r.aead, jwk, key)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt DPoP key: %w", err)
+	}
+	if err := r.client.Set(ctx, key, sealed, r.defaultTTL).Err(); err != nil {
+		return fmt.Errorf("failed to store DPoP key: %w", err)
+	}
+	return nil
+}
+
+func (r *RedisDPoPManager) GetKey(ctx context.Context, keyID string) ([]byte, error) {
+	if r.aead == nil {
+		return nil, errDPoPKeysDisabled
+	}
+	key := buildKey(r.PrefixKey, r.tenant, keyID)
+	sealed, err := r.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrDPoPKeyNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get DPoP key: %w", err)
+	}
+	jwk, err := open(r.aead, sealed, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt DPoP key: %w", err)
+	}
+	return jwk, nil
+}
+
+func (r *RedisDPoPManager) TouchKey(ctx context.Context, keyID string) error {
+	key := buildKey(r.PrefixKey, r.tenant, keyID)
+	if err := r.client.Expire(ctx, key, r.defaultTTL).Err(); err != nil {
+		return fmt.Errorf("failed to extend DPoP key: %w", err)
+	}
+	return nil
+}
+
+func (r *RedisDPoPManager) DeleteKey(ctx context.Context, keyID string) error {
+	key := buildKey(r.PrefixKey, r.tenant, keyID)
+	if err := r.client.Del(ctx, key).Err(); err != nil {
+		return fmt.Errorf("failed to remove DPoP key: %w", err)
+	}
+	return nil
+}
+
+func (r *RedisDPoPManager) MarkProofUsed(ctx context.Context, jti string, ttl time.Duration) (bool, error) {
+	key := buildKey(r.PrefixProof, r.tenant, jti)
+	fresh, err := r.client.SetNX(ctx, key, 1, ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to record DPoP proof: %w", err)
+	}
+	return fresh, nil
+}
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"authorization_flow_keycloak/internal/constant"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return server, client
+}
+
+func newTestDPoPStore(t *testing.T, client *redis.Client) *RedisDPoPManager {
+	t.Helper()
+	manager, err := NewDPoPRedisManager(client, bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager
+}
+
+func TestDPoPKeyEncrypted(t *testing.T) {
+	ctx := context.Background()
+	server, client := newTestRedis(t)
+	keys := newTestDPoPStore(t, client).WithTenant("acme")
+	jwk := []byte(`{"kty":"EC","crv":"P-256","d":"secret"}`)
+
+	if err := keys.SetKey(ctx, "kid", jwk); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := server.Get("dpopkey:acme:kid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains([]byte(stored), []byte("secret")) {
+		t.Fatal("DPoP key stored in plaintext")
+	}
+	got, err := keys.GetKey(ctx, "kid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, jwk) {
+		t.Fatalf("GetKey = %s, want %s", got, jwk)
+	}
+
+	// A ciphertext moved to another entry must not decrypt
+	server.Set("dpopkey:acme:other", stored)
+	if _, err := keys.GetKey(ctx, "other"); err == nil {
+		t.Fatal("swapped ciphertext was decrypted")
+	}
+}
+
+func TestDPoPKeyWithoutEncryptionKey(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestRedis(t)
+	manager, err := NewDPoPRedisManager(client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.SetKey(ctx, "kid", []byte("{}")); err == nil {
+		t.Fatal("SetKey succeeded without an encryption key")
+	}
+	// The replay cache does not need the key
+	fresh, err := manager.MarkProofUsed(ctx, "jti", time.Minute)
+	if err != nil || !fresh {
+		t.Fatalf("MarkProofUsed = %v, %v", fresh, err)
+	}
+	if fresh, _ := manager.MarkProofUsed(ctx, "jti", time.Minute); fresh {
+		t.Fatal("replayed proof reported as fresh")
+	}
+}
+
+func TestDPoPKeyExtendedWithSession(t *testing.T) {
+	ctx := context.Background()
+	server, client := newTestRedis(t)
+	keys := newTestDPoPStore(t, client)
+	sessions := NewDPoPKeySessionStore(NewSessionRedisManager(client), keys).WithTenant("acme")
+
+	if err := keys.WithTenant("acme").SetKey(ctx, "kid", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	data := SessionData{Realm: "acme", DPoPKeyID: "kid"}
+	if err := sessions.Set(ctx, "session", data); err != nil {
+		t.Fatal(err)
+	}
+	// Saving the session again, as a refresh does, extends both
+	for i := 0; i < 3; i++ {
+		server.FastForward(constant.SessionDuration - time.Second)
+		if err := sessions.Set(ctx, "session", data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ttl := server.TTL("dpopkey:acme:kid"); ttl != constant.SessionDuration {
+		t.Fatalf("DPoP key TTL = %v, want %v", ttl, constant.SessionDuration)
+	}
+	if _, err := keys.WithTenant("acme").GetKey(ctx, "kid"); err != nil {
+		t.Fatalf("DPoP key expired before its session: %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"authorization_flow_keycloak/internal/metrics"
+)
+
+// InstrumentedSessionStore decorates a SessionStore with latency and error
+// metrics labelled with the name of its backend
+type InstrumentedSessionStore struct {
+	inner   SessionStore
+	backend string
+}
+
+func NewInstrumentedSessionStore(inner SessionStore, backend string) *InstrumentedSessionStore {
+	return &InstrumentedSessionStore{
+		inner:   inner,
+		backend: backend,
+	}
+}
+
+func (s *InstrumentedSessionStore) Set(ctx context.Context, sessionID string, data SessionData) error {
+	start := time.Now()
+	err := s.inner.Set(ctx, sessionID, data)
+	metrics.ObserveStoreOperation(s.backend, "set", start, err)
+	return err
+}
+
+func (s *InstrumentedSessionStore) Get(ctx context.Context, sessionID string) (*SessionData, error) {
+	start := time.Now()
+	data, err := s.inner.Get(ctx, sessionID)
+	// A missing session is an answer, not a failure of the store
+	storeErr := err
+	if errors.Is(err, ErrSessionNotFound) {
+		storeErr = nil
+	}
+	metrics.ObserveStoreOperation(s.backend, "get", start, storeErr)
+	return data, err
+}
+
+func (s *InstrumentedSessionStore) Delete(ctx context.Context, sessionID string) error {
+	start := time.Now()
+	err := s.inner.Delete(ctx, sessionID)
+	metrics.ObserveStoreOperation(s.backend, "delete", start, err)
+	return err
+}
+
+// WithTenant returns the decorated store scoped to the tenant
+func (s *InstrumentedSessionStore) WithTenant(tenant string) SessionStore {
+	return &InstrumentedSessionStore{
+		inner:   s.inner.WithTenant(tenant),
+		backend: s.backend,
+	}
+}
@@ -0,0 +1,82 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// IntrospectionStore caches token introspection results for a short time so
+// Keycloak is not called on every request
+type IntrospectionStore interface {
+	// Get returns the cached response, ok is false on a cache miss
+	Get(ctx context.Context, accessToken string) (result []byte, ok bool, err error)
+	// Set caches a response, never beyond the token expiry
+	Set(ctx context.Context, accessToken string, result []byte, expiresAt time.Time) error
+	// WithTenant returns a store whose keys are namespaced to the tenant
+	WithTenant(tenant string) IntrospectionStore
+}
+
+type RedisIntrospectionManager struct {
+	client      *redis.Client
+	PrefixState string
+	tenant      string
+	defaultTTL  time.Duration
+}
+
+func NewIntrospectionRedisManager(rds *redis.Client, ttl time.Duration) *RedisIntrospectionManager {
+	return &RedisIntrospectionManager{
+		client:      rds,
+		PrefixState: "introspection",
+		defaultTTL:  ttl,
+	}
+}
+
+// buildKeyState hashes the token so raw access tokens never end up in key names
+func (r *RedisIntrospectionManager) buildKeyState(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return buildKey(r.PrefixState, r.tenant, hex.EncodeToString(sum[:]))
+}
+
+// WithTenant returns a copy of the manager scoped to the tenant
+func (r *RedisIntrospectionManager) WithTenant(tenant string) IntrospectionStore {
+	scoped := *r
+	scoped.tenant = tenant
+	return &scoped
+}
+
+func (r *RedisIntrospectionManager) Get(ctx context.Context, accessToken string) ([]byte, bool, error) {
+	data, err := r.client.Get(ctx, r.buildKeyState(accessToken)).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get introspection result: %w", err)
+	}
+	return data, true, nil
+}
+
+func (r *RedisIntrospectionManager) Set(
+	ctx context.Context,
+	accessToken string,
+	result []byte,
+	expiresAt time.Time,
+) error {
+	ttl := r.defaultTTL
+	if !expiresAt.IsZero() {
+		if remaining := time.Until(expiresAt); remaining < ttl {
+			ttl = remaining
+		}
+	}
+	if ttl <= 0 {
+		return nil
+	}
+	if err := r.client.Set(ctx, r.buildKeyState(accessToken), result, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to cache introspection result: %w", err)
+	}
+	return nil
+}
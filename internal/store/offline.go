@@ -0,0 +1,131 @@
+package store
+
+import (
+	"context"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrOfflineTokenNotFound is returned when a user never granted offline access
+var ErrOfflineTokenNotFound = errors.New("offline token not found")
+
+// OfflineTokenStore keeps the offline refresh tokens of users who consented
+// to background access, keyed by their subject
+type OfflineTokenStore interface {
+	Set(ctx context.Context, subject string, refreshToken string) error
+	Get(ctx context.Context, subject string) (string, error)
+	Delete(ctx context.Context, subject string) error
+	// CompareAndDelete removes the token only while it still is refreshToken,
+	// so a token rotated in the meantime by another refresh is kept
+	CompareAndDelete(ctx context.Context, subject string, refreshToken string) error
+	// WithTenant returns a store whose keys are namespaced to the tenant
+	WithTenant(tenant string) OfflineTokenStore
+}
+
+// RedisOfflineTokenManager stores the tokens AES-GCM encrypted: offline tokens
+// do not expire with the browser session, so a Redis dump must not leak them.
+// Entries have no TTL, they live until the user or Keycloak revokes them.
+type RedisOfflineTokenManager struct {
+	client      *redis.Client
+	PrefixState string
+	tenant      string
+	aead        cipher.AEAD
+}
+
+// NewOfflineTokenRedisManager creates the store with a 32 byte AES-256 key
+func NewOfflineTokenRedisManager(rds *redis.Client, key []byte) (*RedisOfflineTokenManager, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid offline token key: %w", err)
+	}
+	return &RedisOfflineTokenManager{
+		client:      rds,
+		PrefixState: "offline",
+		aead:        aead,
+	}, nil
+}
+
+func (r *RedisOfflineTokenManager) buildKeyState(subject string) string {
+	return buildKey(r.PrefixState, r.tenant, subject)
+}
+
+// WithTenant returns a copy of the manager scoped to the tenant
+func (r *RedisOfflineTokenManager) WithTenant(tenant string) OfflineTokenStore {
+	scoped := *r
+	scoped.tenant = tenant
+	return &scoped
+}
+
+func (r *RedisOfflineTokenManager) Set(ctx context.Context, subject string, refreshToken string) error {
+	key := r.buildKeyState(subject)
+	sealed, err := seal(r.aead, []byte(refreshToken), key)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt offline token: %w", err)
+	}
+	if err := r.client.Set(ctx, key, sealed, 0).Err(); err != nil {
+		return fmt.Errorf("failed to store offline token: %w", err)
+	}
+	return nil
+}
+
+func (r *RedisOfflineTokenManager) Get(ctx context.Context, subject string) (string, error) {
+	key := r.buildKeyState(subject)
+	sealed, err := r.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return "", ErrOfflineTokenNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get offline token: %w", err)
+	}
+	plain, err := open(r.aead, sealed, key)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt offline token: %w", err)
+	}
+	return string(plain), nil
+}
+
+func (r *RedisOfflineTokenManager) Delete(ctx context.Context, subject string) error {
+	if err := r.client.Del(ctx, r.buildKeyState(subject)).Err(); err != nil {
+		return fmt.Errorf("failed to remove offline token: %w", err)
+	}
+	return nil
+}
+
+// CompareAndDelete watches the key so a Set between reading and deleting the
+// token aborts the delete. The tokens are sealed with a random nonce, they
+// can only be compared after decrypting.
+func (r *RedisOfflineTokenManager) CompareAndDelete(ctx context.Context, subject string, refreshToken string) error {
+	key := r.buildKeyState(subject)
+	err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+		sealed, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		plain, err := open(r.aead, sealed, key)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt offline token: %w", err)
+		}
+		if string(plain) != refreshToken {
+			return nil
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			return nil
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		// Replaced while comparing, the new token is not the one that failed
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove offline token: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestOfflineTokenCompareAndDelete(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestRedis(t)
+	manager, err := NewOfflineTokenRedisManager(client, bytes.Repeat([]byte{3}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := manager.WithTenant("acme")
+
+	if err := tokens.CompareAndDelete(ctx, "user-1", "offline-1"); err != nil {
+		t.Fatalf("CompareAndDelete without a token: %v", err)
+	}
+	if err := tokens.Set(ctx, "user-1", "offline-2"); err != nil {
+		t.Fatal(err)
+	}
+	// A failed refresh of the previous token leaves its successor alone
+	if err := tokens.CompareAndDelete(ctx, "user-1", "offline-1"); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := tokens.Get(ctx, "user-1"); err != nil || stored != "offline-2" {
+		t.Fatalf("stored token = %q, %v, want offline-2 kept", stored, err)
+	}
+	if err := tokens.CompareAndDelete(ctx, "user-1", "offline-2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens.Get(ctx, "user-1"); !errors.Is(err, ErrOfflineTokenNotFound) {
+		t.Fatalf("Get after CompareAndDelete: %v, want ErrOfflineTokenNotFound", err)
+	}
+}
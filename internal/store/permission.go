@@ -0,0 +1,83 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// PermissionStore caches Keycloak Authorization Services decisions per
+// session so an RPT is not requested on every request
+type PermissionStore interface {
+	// Get returns the cached decision, ok is false on a cache miss
+	Get(ctx context.Context, sessionID, permission string) (granted bool, ok bool, err error)
+	// Set caches a decision for at most the default TTL and never past expiresAt
+	Set(ctx context.Context, sessionID, permission string, granted bool, expiresAt time.Time) error
+	// WithTenant returns a store whose keys are namespaced to the tenant
+	WithTenant(tenant string) PermissionStore
+}
+
+type RedisPermissionManager struct {
+	client      *redis.Client
+	PrefixState string
+	tenant      string
+	defaultTTL  time.Duration
+}
+
+func NewPermissionRedisManager(rds *redis.Client, ttl time.Duration) *RedisPermissionManager {
+	return &RedisPermissionManager{
+		client:      rds,
+		PrefixState: "permission",
+		defaultTTL:  ttl,
+	}
+}
+
+// buildKeyState hashes the session ID, which is a bearer secret for as
+// long as the session lives
+func (r *RedisPermissionManager) buildKeyState(sessionID, permission string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return buildKey(r.PrefixState, r.tenant, hex.EncodeToString(sum[:])+":"+permission)
+}
+
+// WithTenant returns a copy of the manager scoped to the tenant
+func (r *RedisPermissionManager) WithTenant(tenant string) PermissionStore {
+	scoped := *r
+	scoped.tenant = tenant
+	return &scoped
+}
+
+func (r *RedisPermissionManager) Get(ctx context.Context, sessionID, permission string) (bool, bool, error) {
+	granted, err := r.client.Get(ctx, r.buildKeyState(sessionID, permission)).Bool()
+	if err == redis.Nil {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, fmt.Errorf("failed to get permission decision: %w", err)
+	}
+	return granted, true, nil
+}
+
+func (r *RedisPermissionManager) Set(
+	ctx context.Context,
+	sessionID, permission string,
+	granted bool,
+	expiresAt time.Time,
+) error {
+	ttl := r.defaultTTL
+	if !expiresAt.IsZero() {
+		if remaining := time.Until(expiresAt); remaining < ttl {
+			ttl = remaining
+		}
+	}
+	if ttl <= 0 {
+		return nil
+	}
+	if err := r.client.Set(ctx, r.buildKeyState(sessionID, permission), granted, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to cache permission decision: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package store
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPermissionCache(t *testing.T) {
+	ctx := context.Background()
+	server, client := newTestRedis(t)
+	cache := NewPermissionRedisManager(client, time.Minute).WithTenant("acme")
+
+	if _, ok, err := cache.Get(ctx, "session-secret", "invoices#read"); err != nil || ok {
+		t.Fatalf("Get on empty cache = %v, %v", ok, err)
+	}
+	if err := cache.Set(ctx, "session-secret", "invoices#read", true, time.Now().Add(10*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Set(ctx, "session-secret", "invoices#write", false, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	granted, ok, err := cache.Get(ctx, "session-secret", "invoices#read")
+	if err != nil || !ok || !granted {
+		t.Fatalf("Get = %v, %v, %v, want a cached grant", granted, ok, err)
+	}
+	granted, ok, _ = cache.Get(ctx, "session-secret", "invoices#write")
+	if !ok || granted {
+		t.Fatalf("Get = %v, %v, want a cached denial", granted, ok)
+	}
+
+	for _, key := range server.Keys() {
+		if strings.Contains(key, "session-secret") {
+			t.Fatalf("session ID stored in key %q", key)
+		}
+		// Decisions never outlive the RPT they came from
+		if strings.HasSuffix(key, "invoices#read") && server.TTL(key) > 10*time.Second {
+			t.Fatalf("TTL of %q = %v, want at most the RPT expiry", key, server.TTL(key))
+		}
+	}
+	// An RPT that already expired is not cached
+	if err := cache.Set(ctx, "session-secret", "reports", true, time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := cache.Get(ctx, "session-secret", "reports"); ok {
+		t.Fatal("decision of an expired RPT was cached")
+	}
+}
@@ -0,0 +1,74 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimiter counts attempts per key inside a time window
+type RateLimiter interface {
+	// Allow records an attempt for key and reports whether it is within limit
+	// attempts per window, and otherwise how long the caller has to wait
+	Allow(ctx context.Context, key string, limit int, window time.Duration) (bool, time.Duration, error)
+}
+
+type RedisRateLimiter struct {
+	client      *redis.Client
+	PrefixState string
+}
+
+func NewRedisRateLimiter(rds *redis.Client) *RedisRateLimiter {
+	return &RedisRateLimiter{
+		client:      rds,
+		PrefixState: "ratelimit",
+	}
+}
+
+// slidingWindow keeps the accepted attempts of the last window in a sorted
+// set scored by time in milliseconds. It returns {allowed, retry after ms}.
+var slidingWindow = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+if redis.call("ZCARD", KEYS[1]) < limit then
+	redis.call("ZADD", KEYS[1], now, ARGV[4])
+	redis.call("PEXPIRE", KEYS[1], window)
+	return {1, 0}
+end
+local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+return {0, tonumber(oldest[2]) + window - now}
+`)
+
+// Allow implements a sliding window log: an attempt is accepted when fewer
+// than limit attempts were accepted during the preceding window, so bursts
+// cannot straddle the boundary of fixed windows. Refused attempts are not recorded.
+func (r *RedisRateLimiter) Allow(
+	ctx context.Context,
+	key string,
+	limit int,
+	window time.Duration,
+) (bool, time.Duration, error) {
+	// Attempts of the same millisecond need distinct members
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return false, 0, err
+	}
+	now := time.Now().UnixMilli()
+	result, err := slidingWindow.Run(ctx, r.client,
+		[]string{fmt.Sprintf("%s:%s", r.PrefixState, key)},
+		now, window.Milliseconds(), limit, fmt.Sprintf("%d-%s", now, hex.EncodeToString(nonce)),
+	).Int64Slice()
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to count attempt: %w", err)
+	}
+	if result[0] == 1 {
+		return true, 0, nil
+	}
+	return false, time.Duration(result[1]) * time.Millisecond, nil
+}
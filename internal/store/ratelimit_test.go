@@ -0,0 +1,53 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRedisRateLimiter(t *testing.T) {
+	ctx := context.Background()
+	server, client := newTestRedis(t)
+	limiter := NewRedisRateLimiter(client)
+	const window = 300 * time.Millisecond
+
+	allow := func(key string) (bool, time.Duration) {
+		t.Helper()
+		allowed, retryAfter, err := limiter.Allow(ctx, key, 2, window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return allowed, retryAfter
+	}
+
+	// Attempts of the same millisecond are counted separately
+	for i := 0; i < 2; i++ {
+		if allowed, _ := allow("ip:192.0.2.1"); !allowed {
+			t.Fatalf("attempt %d refused", i+1)
+		}
+	}
+	allowed, retryAfter := allow("ip:192.0.2.1")
+	if allowed {
+		t.Fatal("attempt over the limit allowed")
+	}
+	if retryAfter <= 0 || retryAfter > window {
+		t.Fatalf("retry after %v, want within the window", retryAfter)
+	}
+	// Keys are counted independently
+	if allowed, _ := allow("ip:192.0.2.2"); !allowed {
+		t.Fatal("attempt of another key refused")
+	}
+	// Refused attempts are not recorded, so the window slides past the
+	// accepted ones
+	if got := len(server.Keys()); got != 2 {
+		t.Fatalf("%d keys, want 2", got)
+	}
+	if members, _ := server.ZMembers("ratelimit:ip:192.0.2.1"); len(members) != 2 {
+		t.Fatalf("%d attempts recorded, want 2", len(members))
+	}
+	time.Sleep(retryAfter + 10*time.Millisecond)
+	if allowed, _ := allow("ip:192.0.2.1"); !allowed {
+		t.Fatal("attempt refused after the window")
+	}
+}
@@ -3,7 +3,9 @@ package store
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"authorization_flow_keycloak/internal/constant"
@@ -11,18 +13,78 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
+// ErrSessionNotFound is returned for sessions that expired or never existed
+var ErrSessionNotFound = errors.New("session not found")
+
 // SessionData represents the data we'll store for each session
 type SessionData struct {
-	AccessToken string    `json:"access_token"`
-	UserInfo    UserInfo  `json:"user_info"`
-	CreatedAt   time.Time `json:"created_at"`
+	Realm        string `json:"realm"` // tenant the session was created for
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	DPoPKeyID    string `json:"dpop_key_id,omitempty"` // DPoPStore key the tokens are bound to
+	// OfflineAccess marks RefreshToken as an offline token shared with the
+	// OfflineTokenStore, it must survive the end of the session
+	OfflineAccess bool      `json:"offline_access,omitempty"`
+	CSRFToken     string    `json:"csrf_token"` // synchronizer token of unsafe browser requests
+	UserInfo      UserInfo  `json:"user_info"`
+	CreatedAt     time.Time `json:"created_at"`
 }
 
 // UserInfo contains the essential user information we want to cache
 type UserInfo struct {
+	Subject  string `json:"subject"`
 	Username string `json:"username"`
 	Email    string `json:"email"`
-	// Add other user fields you need
+
+	// Filled from the UserInfo endpoint
+	GivenName  string                 `json:"given_name,omitempty"`
+	FamilyName string                 `json:"family_name,omitempty"`
+	Locale     string                 `json:"locale,omitempty"`
+	Picture    string                 `json:"picture,omitempty"`
+	Groups     []string               `json:"groups,omitempty"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"` // custom claims
+}
+
+// ReplaceClaims rebuilds the user info from UserInfo endpoint claims, only
+// the subject is kept, so claims Keycloak no longer returns are dropped.
+// Standard claims fill their fields, any other claim is kept as a custom
+// attribute. Claims issued for a different subject are rejected and leave
+// the user info unchanged (OIDC Core 5.3.2).
+func (u *UserInfo) ReplaceClaims(claims map[string]interface{}) error {
+	if sub, _ := claims["sub"].(string); sub != u.Subject {
+		return fmt.Errorf("user info subject does not match the session")
+	}
+	*u = UserInfo{Subject: u.Subject}
+	for name, value := range claims {
+		switch name {
+		case "sub":
+		case "preferred_username":
+			u.Username, _ = value.(string)
+		case "email":
+			u.Email, _ = value.(string)
+		case "given_name":
+			u.GivenName, _ = value.(string)
+		case "family_name":
+			u.FamilyName, _ = value.(string)
+		case "locale":
+			u.Locale, _ = value.(string)
+		case "picture":
+			u.Picture, _ = value.(string)
+		case "groups":
+			values, _ := value.([]interface{})
+			for _, group := range values {
+				if group, ok := group.(string); ok {
+					u.Groups = append(u.Groups, group)
+				}
+			}
+		default:
+			if u.Attributes == nil {
+				u.Attributes = make(map[string]interface{})
+			}
+			u.Attributes[name] = value
+		}
+	}
+	return nil
 }
 
 // AuthStore defines the contract for state management
@@ -30,6 +92,8 @@ type AuthStore interface {
 	SetState(ctx context.Context, state string) error
 	GetState(ctx context.Context, state string) (string, error)
 	DeleteState(ctx context.Context, state string) error
+	// WithTenant returns a store whose keys are namespaced to the tenant
+	WithTenant(tenant string) AuthStore
 }
 
 // SessionStore defines the contract for session management
@@ -37,23 +101,47 @@ type SessionStore interface {
 	Set(ctx context.Context, sessionID string, data SessionData) error
 	Get(ctx context.Context, sessionID string) (*SessionData, error)
 	Delete(ctx context.Context, sessionID string) error
+	// WithTenant returns a store whose keys are namespaced to the tenant
+	WithTenant(tenant string) SessionStore
+}
+
+// buildKey joins the key parts, inserting the tenant namespace when set
+// so a session or state of one realm can never be read from another one
+func buildKey(prefix, tenant, id string) string {
+	if tenant == "" {
+		return fmt.Sprintf("%s:%s", prefix, id)
+	}
+	return fmt.Sprintf("%s:%s:%s", prefix, tenant, id)
 }
 
 type RedisSessionManager struct {
 	client      *redis.Client
 	PrefixState string
-	defaultTTL  time.Duration
+	// IndexKey is a sorted set of the session keys of every tenant scored
+	// by their expiry in milliseconds, so they can be counted without
+	// scanning the keyspace
+	IndexKey   string
+	tenant     string
+	defaultTTL time.Duration
 }
 
 func NewSessionRedisManager(rds *redis.Client) *RedisSessionManager {
 	return &RedisSessionManager{
 		client:      rds,
 		PrefixState: "session",
+		IndexKey:    "session_index",
 		defaultTTL:  constant.SessionDuration,
 	}
 }
 func (r *RedisSessionManager) buildKeyState(session string) string {
-	return fmt.Sprintf("%s:%s", r.PrefixState, session)
+	return buildKey(r.PrefixState, r.tenant, session)
+}
+
+// WithTenant returns a copy of the manager scoped to the tenant
+func (r *RedisSessionManager) WithTenant(tenant string) SessionStore {
+	scoped := *r
+	scoped.tenant = tenant
+	return &scoped
 }
 
 // Set stores session data in Redis
@@ -64,7 +152,13 @@ func (r *RedisSessionManager) Set(ctx context.Context, sessionID string, data Se
 	}
 
 	key := r.buildKeyState(sessionID)
-	return r.client.Set(ctx, key, jsonData, r.defaultTTL).Err()
+	expiresAt := time.Now().Add(r.defaultTTL)
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key, jsonData, r.defaultTTL)
+		pipe.ZAdd(ctx, r.IndexKey, redis.Z{Score: float64(expiresAt.UnixMilli()), Member: key})
+		return nil
+	})
+	return err
 }
 
 // Get retrieves session data from Redis
@@ -73,7 +167,7 @@ func (r *RedisSessionManager) Get(ctx context.Context, sessionID string) (*Sessi
 	data, err := r.client.Get(ctx, key).Result()
 
 	if err == redis.Nil {
-		return nil, fmt.Errorf("session not found")
+		return nil, ErrSessionNotFound
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get session: %w", err)
@@ -90,12 +184,33 @@ func (r *RedisSessionManager) Get(ctx context.Context, sessionID string) (*Sessi
 // Delete removes a session from Redis
 func (r *RedisSessionManager) Delete(ctx context.Context, sessionID string) error {
 	key := r.buildKeyState(sessionID)
-	return r.client.Del(ctx, key).Err()
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.ZRem(ctx, r.IndexKey, key)
+		return nil
+	})
+	return err
+}
+
+// Count returns the number of sessions of every tenant from the index,
+// dropping the sessions that expired since the last count first
+func (r *RedisSessionManager) Count(ctx context.Context) (int, error) {
+	var count *redis.IntCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(ctx, r.IndexKey, "-inf", strconv.FormatInt(time.Now().UnixMilli(), 10))
+		count = pipe.ZCard(ctx, r.IndexKey)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count sessions: %w", err)
+	}
+	return int(count.Val()), nil
 }
 
 type RedisAuthManager struct {
 	client      *redis.Client
 	PrefixState string
+	tenant      string
 	defaultTTL  time.Duration
 }
 
@@ -107,7 +222,14 @@ func NewAuthRedisManager(rds *redis.Client) *RedisAuthManager {
 	}
 }
 func (r *RedisAuthManager) buildKeyState(state string) string {
-	return fmt.Sprintf("%s:%s", r.PrefixState, state)
+	return buildKey(r.PrefixState, r.tenant, state)
+}
+
+// WithTenant returns a copy of the manager scoped to the tenant
+func (r *RedisAuthManager) WithTenant(tenant string) AuthStore {
+	scoped := *r
+	scoped.tenant = tenant
+	return &scoped
 }
 
 func (r *RedisAuthManager) SetState(ctx context.Context, state string) error {
@@ -0,0 +1,118 @@
+package store
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestUserInfoReplaceClaims(t *testing.T) {
+	previous := UserInfo{
+		Subject:    "user-1",
+		Username:   "jdoe",
+		Email:      "old@example.com",
+		GivenName:  "John",
+		Groups:     []string{"/old"},
+		Attributes: map[string]interface{}{"department": "sales"},
+	}
+	tests := []struct {
+		name    string
+		claims  map[string]interface{}
+		want    UserInfo
+		wantErr bool
+	}{
+		{
+			name: "standard and custom claims",
+			claims: map[string]interface{}{
+				"sub":                "user-1",
+				"preferred_username": "jdoe",
+				"email":              "new@example.com",
+				"family_name":        "Doe",
+				"locale":             "en",
+				"picture":            "https://example.com/jdoe.png",
+				"groups":             []interface{}{"/engineering", 42, "/ops"},
+				"team":               "platform",
+			},
+			want: UserInfo{
+				Subject:    "user-1",
+				Username:   "jdoe",
+				Email:      "new@example.com",
+				FamilyName: "Doe",
+				Locale:     "en",
+				Picture:    "https://example.com/jdoe.png",
+				Groups:     []string{"/engineering", "/ops"},
+				Attributes: map[string]interface{}{"team": "platform"},
+			},
+		},
+		{
+			name:   "removed claims are dropped",
+			claims: map[string]interface{}{"sub": "user-1", "preferred_username": "jdoe"},
+			want:   UserInfo{Subject: "user-1", Username: "jdoe"},
+		},
+		{
+			name:    "other subject",
+			claims:  map[string]interface{}{"sub": "user-2", "email": "attacker@example.com"},
+			want:    previous,
+			wantErr: true,
+		},
+		{
+			name:    "missing subject",
+			claims:  map[string]interface{}{"email": "attacker@example.com"},
+			want:    previous,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := previous
+			err := info.ReplaceClaims(tt.claims)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReplaceClaims() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(info, tt.want) {
+				t.Fatalf("ReplaceClaims() = %+v, want %+v", info, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedisSessionManagerCount(t *testing.T) {
+	ctx := context.Background()
+	server, client := newTestRedis(t)
+	sessions := NewSessionRedisManager(client)
+
+	for _, tenant := range []string{"acme", "globex"} {
+		for _, sessionID := range []string{"session-1", "session-2"} {
+			if err := sessions.WithTenant(tenant).Set(ctx, sessionID, SessionData{Realm: tenant}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Saving a session again does not count it twice
+	if err := sessions.WithTenant("acme").Set(ctx, "session-1", SessionData{Realm: "acme"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sessions.WithTenant("globex").Delete(ctx, "session-2"); err != nil {
+		t.Fatal(err)
+	}
+	count, err := sessions.Count(ctx)
+	if err != nil || count != 3 {
+		t.Fatalf("Count = %d, %v, want 3", count, err)
+	}
+
+	// Sessions that expired leave the index on the next count
+	expired := redis.Z{Score: float64(time.Now().Add(-time.Second).UnixMilli()), Member: "session:acme:expired"}
+	if err := client.ZAdd(ctx, sessions.IndexKey, expired).Err(); err != nil {
+		t.Fatal(err)
+	}
+	count, err = sessions.Count(ctx)
+	if err != nil || count != 3 {
+		t.Fatalf("Count = %d, %v, want 3 with an expired session", count, err)
+	}
+	if members, _ := server.ZMembers(sessions.IndexKey); len(members) != 3 {
+		t.Fatalf("index = %v, want the expired session removed", members)
+	}
+}
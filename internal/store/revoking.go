@@ -0,0 +1,84 @@
+package store
+
+import "context"
+
+// SessionRevoker is notified with the data of every session that is deleted,
+// so its tokens can be invalidated at the identity provider
+type SessionRevoker interface {
+	RevokeSession(ctx context.Context, data SessionData)
+}
+
+// SessionRevokerFunc adapts a function to the SessionRevoker interface
+type SessionRevokerFunc func(ctx context.Context, data SessionData)
+
+func (f SessionRevokerFunc) RevokeSession(ctx context.Context, data SessionData) {
+	f(ctx, data)
+}
+
+// RevokingSessionStore decorates a SessionStore so that any deletion
+// (logout, admin revoke, invalid token cleanup) also revokes the session tokens
+type RevokingSessionStore struct {
+	SessionStore
+	revoker SessionRevoker
+}
+
+func NewRevokingSessionStore(inner SessionStore, revoker SessionRevoker) *RevokingSessionStore {
+	return &RevokingSessionStore{
+		SessionStore: inner,
+		revoker:      revoker,
+	}
+}
+
+// Delete removes the session and hands its data to the revoker
+func (r *RevokingSessionStore) Delete(ctx context.Context, sessionID string) error {
+	data, err := r.SessionStore.Get(ctx, sessionID)
+	if err := r.SessionStore.Delete(ctx, sessionID); err != nil {
+		return err
+	}
+	// An already expired session has nothing left to revoke
+	if err == nil {
+		r.revoker.RevokeSession(ctx, *data)
+	}
+	return nil
+}
+
+// WithTenant returns the decorated store scoped to the tenant
+func (r *RevokingSessionStore) WithTenant(tenant string) SessionStore {
+	return &RevokingSessionStore{
+		SessionStore: r.SessionStore.WithTenant(tenant),
+		revoker:      r.revoker,
+	}
+}
+
+// DPoPKeySessionStore decorates a SessionStore so that saving a DPoP bound
+// session also extends its key, which would otherwise expire first
+type DPoPKeySessionStore struct {
+	SessionStore
+	keys DPoPStore
+}
+
+func NewDPoPKeySessionStore(inner SessionStore, keys DPoPStore) *DPoPKeySessionStore {
+	return &DPoPKeySessionStore{
+		SessionStore: inner,
+		keys:         keys,
+	}
+}
+
+// Set saves the session and resets the TTL of its DPoP key
+func (d *DPoPKeySessionStore) Set(ctx context.Context, sessionID string, data SessionData) error {
+	if err := d.SessionStore.Set(ctx, sessionID, data); err != nil {
+		return err
+	}
+	if data.DPoPKeyID == "" {
+		return nil
+	}
+	return d.keys.WithTenant(data.Realm).TouchKey(ctx, data.DPoPKeyID)
+}
+
+// WithTenant returns the decorated store scoped to the tenant
+func (d *DPoPKeySessionStore) WithTenant(tenant string) SessionStore {
+	return &DPoPKeySessionStore{
+		SessionStore: d.SessionStore.WithTenant(tenant),
+		keys:         d.keys,
+	}
+}
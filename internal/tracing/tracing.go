@@ -0,0 +1,87 @@
+// Package tracing sets up OpenTelemetry tracing. Spans cover the Gin
+// handlers, the calls to Keycloak and upstreams, and Redis commands, and the
+// W3C trace context is propagated on every outgoing request.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"authorization_flow_keycloak/internal/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+// Tracing is the installed tracer provider
+type Tracing struct {
+	provider *sdktrace.TracerProvider
+}
+
+// Setup installs the global tracer provider and the W3C trace context and
+// baggage propagators. Without an exporter no spans are recorded, but the
+// trace context of incoming requests is still passed on.
+func Setup(ctx context.Context, cfg *config.TracingConfig) (*Tracing, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	tracing := &Tracing{}
+	if cfg.Exporter != config.TracingExporterOTLP {
+		return tracing, nil
+	}
+	var opts []otlptracehttp.Option
+	if cfg.Endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName(cfg.ServiceName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tracing resource: %w", err)
+	}
+	tracing.provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(tracing.provider)
+	return tracing, nil
+}
+
+// Shutdown flushes the spans still buffered and stops the exporter
+func (t *Tracing) Shutdown(ctx context.Context) error {
+	if t.provider == nil {
+		return nil
+	}
+	return t.provider.Shutdown(ctx)
+}
+
+// Middleware starts a span for every request, named after its Gin route.
+// Health checks and metric scrapes are not traced.
+func Middleware(serviceName string) gin.HandlerFunc {
+	return otelgin.Middleware(serviceName, otelgin.WithFilter(func(r *http.Request) bool {
+		return r.URL.Path != "/health" && r.URL.Path != "/metrics"
+	}))
+}
+
+// InstrumentRedis traces the commands of the client. Command arguments are
+// left out of the spans, they hold session data and tokens.
+func InstrumentRedis(rdb *redis.Client) error {
+	return redisotel.InstrumentTracing(rdb, redisotel.WithDBStatement(false))
+}